@@ -0,0 +1,392 @@
+// Package cache provides a content-addressed on-disk cache of thumbnails, keyed on a hash of the input's content (or a
+// key supplied for it) and the thumbnail's options, with LRU eviction by a byte budget, and a Group coalescing
+// concurrent requests for the same thumbnail into a single job.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// keyVersion is hashed into every key, and must be bumped whenever the entries' encoding or the options they're keyed
+// on change.
+const keyVersion = "thumbnailer-cache-v2"
+
+const tempPrefix = ".tmp-"
+
+// ErrNoInput is returned for Files without an input to hash.
+var ErrNoInput = errors.New("cache: File has no input")
+
+// Config stores the configuration of a Cache. Dir is the directory holding the entries (created if needed), MaxBytes
+// the budget for their combined size (unlimited if not positive), and Create the function creating the thumbnails on
+// misses (thumbnailer.CreateThumbnailWithContext if nil), e.g. the Thumbnail method of a thumbnailer.Thumbnailer or
+// thumbnailer.WorkerPool.
+type Config struct {
+	Dir      string
+	MaxBytes int64
+	Create   func(ctx context.Context, file *thumbnailer.File) error
+}
+
+// Stats is a snapshot of the state of a Cache.
+type Stats struct {
+	Entries                 int
+	Bytes, MaxBytes         int64
+	Hits, Misses, Evictions uint64
+}
+
+// Cache is a content-addressed on-disk cache of thumbnails. Every entry holds the encoded thumbnail along with the
+// metadata the thumbnailer populated the File with, so hits are served without touching vips or FFmpeg. Entries are
+// written to temporary files and renamed into place, so a crash can't leave a half-written entry behind. The least
+// recently used entries are evicted once the entries exceed the byte budget. A Cache is safe for concurrent use, and
+// multiple processes may share a directory, although each evicts according to its own view of it.
+type Cache struct {
+	config  Config
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	stats   Stats
+	group   *Group
+}
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// metadata is the part of the File populated by creating its thumbnail.
+type metadata struct {
+	Media                      string
+	Width, Height, Orientation int
+	Duration                   time.Duration
+	Title, Artist              string
+	HasVideo, HasAudio         bool
+	ThumbWidth, ThumbHeight    int
+	HasAlpha                   bool
+}
+
+// New opens the Cache in the Config's directory, indexing the entries already in it by their modification times and
+// removing the temporary files left behind by crashes.
+func New(config Config) (*Cache, error) {
+	if config.Create == nil {
+		config.Create = thumbnailer.CreateThumbnailWithContext
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		group:   NewGroup(GroupConfig{Dir: config.Dir, Create: config.Create}),
+	}
+	c.stats.MaxBytes = config.MaxBytes
+	type found struct {
+		entry
+		modTime time.Time
+	}
+	var all []found
+	err := filepath.WalkDir(config.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return os.Remove(path)
+		}
+		if !validKey(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		all = append(all, found{entry{d.Name(), fi.Size()}, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.After(all[j].modTime) })
+	c.mu.Lock()
+	for _, f := range all {
+		c.entries[f.key] = c.lru.PushBack(&entry{f.key, f.size})
+		c.stats.Bytes += f.size
+	}
+	c.stats.Entries = len(c.entries)
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func validKey(key string) bool {
+	if len(key) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.config.Dir, key[:2], key)
+}
+
+// Stats returns the current Stats.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Key returns the cache key of the File: a hash of its input's content and the options of its thumbnail
+// (TargetDimensions, TargetHeight, Mode, FrameTime, Quality and Format). The whole input is read: Files from paths and
+// fs.FSs are read separately, and Files with an io.Seeker are rewound afterwards, while Files with a plain io.Reader
+// are spooled to a temporary file in the Cache's directory, which the File reads from until the returned function is
+// called, restoring its input.
+func (c *Cache) Key(file *thumbnailer.File) (string, func(), error) {
+	in, err := newInput(file, c.config.Dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if in.spool == nil {
+		return in.key, func() {}, nil
+	}
+	reader, seeker, seekEnd, size := file.Reader, file.Seeker, file.SeekEnd, file.Size
+	file.Reader, file.Seeker, file.SeekEnd, file.Size = in.spool, in.spool, true, in.size
+	return in.key, func() {
+		file.Reader, file.Seeker, file.SeekEnd, file.Size = reader, seeker, seekEnd, size
+		in.release()
+	}, nil
+}
+
+// Thumbnail creates the File's thumbnail (which should go through ToWriter or ToPath first) like
+// thumbnailer.CreateThumbnailWithContext, serving it from the Cache if a thumbnail was created from the same content
+// with the same options before, and caching it otherwise. It reports whether the thumbnail was served from the Cache.
+// Concurrent misses for the same key share a single job, like with a Group. Failures to read or write entries are
+// treated as misses, and failures to create thumbnails aren't cached.
+func (c *Cache) Thumbnail(ctx context.Context, file *thumbnailer.File) (hit bool, err error) {
+	in, err := newInput(file, c.config.Dir)
+	if err != nil {
+		return false, err
+	}
+	defer in.release()
+	return c.thumbnail(ctx, in, file)
+}
+
+// ThumbnailKey is like Thumbnail, but keys the thumbnail on the supplied key identifying the File's content instead of
+// a hash of it, e.g. the path of the file along with its size and modification time, so the input is only read on
+// misses. The key must change whenever the content does, otherwise stale thumbnails are served. Keys never collide
+// with the content hashes used by Thumbnail.
+func (c *Cache) ThumbnailKey(ctx context.Context, file *thumbnailer.File, key string) (hit bool, err error) {
+	in, err := keyedInput(file, key)
+	if err != nil {
+		return false, err
+	}
+	return c.thumbnail(ctx, in, file)
+}
+
+func (c *Cache) thumbnail(ctx context.Context, in *input, file *thumbnailer.File) (hit bool, err error) {
+	if hit, err = c.serve(in.key, file); hit || err != nil {
+		return hit, err
+	}
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+	_, err = c.group.thumbnail(ctx, in, file, c.store)
+	return false, err
+}
+
+// serve writes the entry's thumbnail to the File's output and populates the File with its metadata, if the entry
+// exists. Errors reading the entry are treated as misses, while errors writing the output are returned.
+func (c *Cache) serve(key string, file *thumbnailer.File) (bool, error) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+	meta, size, err := readEntry(f)
+	if err != nil {
+		c.remove(key)
+		return false, nil
+	}
+	if err = deliver(file, io.NewSectionReader(f, 0, size)); err != nil {
+		return false, err
+	}
+	meta.apply(file)
+	file.ThumbCreated = true
+	now := time.Now()
+	_ = os.Chtimes(c.path(key), now, now)
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+	}
+	c.stats.Hits++
+	c.mu.Unlock()
+	return true, nil
+}
+
+// deliver copies the thumbnail to the File's output.
+func deliver(file *thumbnailer.File, r io.Reader) error {
+	if file.Thumbnail.Path == "" {
+		if file.Writer == nil {
+			return nil
+		}
+		_, err := io.Copy(file.Writer, r)
+		return err
+	}
+	out, err := os.Create(file.Thumbnail.Path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// readEntry reads the metadata of an entry, which is laid out as the thumbnail, the JSON-encoded metadata and its
+// length as a big-endian uint64, and returns it along with the size of the thumbnail.
+func readEntry(f *os.File) (*metadata, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var trailer [8]byte
+	if fi.Size() < int64(len(trailer)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if _, err = f.ReadAt(trailer[:], fi.Size()-int64(len(trailer))); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.BigEndian.Uint64(trailer[:]))
+	size := fi.Size() - int64(len(trailer)) - n
+	if n <= 0 || size < 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	meta := new(metadata)
+	if err = json.NewDecoder(io.NewSectionReader(f, size, n)).Decode(meta); err != nil {
+		return nil, 0, err
+	}
+	return meta, size, nil
+}
+
+func newMetadata(file *thumbnailer.File) *metadata {
+	return &metadata{
+		Media:       file.Media,
+		Width:       file.Width,
+		Height:      file.Height,
+		Orientation: file.Orientation,
+		Duration:    file.Duration,
+		Title:       file.Title,
+		Artist:      file.Artist,
+		HasVideo:    file.HasVideo,
+		HasAudio:    file.HasAudio,
+		ThumbWidth:  file.Thumbnail.Width,
+		ThumbHeight: file.Thumbnail.Height,
+		HasAlpha:    file.HasAlpha,
+	}
+}
+
+func (m *metadata) apply(file *thumbnailer.File) {
+	file.Media = m.Media
+	file.Width, file.Height, file.Orientation = m.Width, m.Height, m.Orientation
+	file.Duration, file.Title, file.Artist = m.Duration, m.Title, m.Artist
+	file.HasVideo, file.HasAudio = m.HasVideo, m.HasAudio
+	file.Thumbnail.Width, file.Thumbnail.Height = m.ThumbWidth, m.ThumbHeight
+	file.HasAlpha = m.HasAlpha
+}
+
+// store caches the result of a job under the key, unless it doesn't fit in the budget.
+func (c *Cache) store(key string, res *result) {
+	data, err := json.Marshal(res.meta)
+	if err != nil {
+		return
+	}
+	size := int64(len(res.data) + len(data) + 8)
+	if c.config.MaxBytes > 0 && size > c.config.MaxBytes {
+		return
+	}
+	tmp, err := os.CreateTemp(c.config.Dir, tempPrefix)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	data = append(data, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(data[len(data)-8:], uint64(len(data)-8))
+	if _, err = tmp.Write(res.data); err != nil {
+		return
+	}
+	if _, err = tmp.Write(data); err != nil || tmp.Sync() != nil || tmp.Close() != nil {
+		return
+	}
+	path := c.path(key)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return
+	}
+	tmp = nil
+	c.add(key, size)
+}
+
+func (c *Cache) add(key string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.stats.Bytes -= e.Value.(*entry).size
+		c.lru.Remove(e)
+		c.stats.Entries--
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key, size})
+	c.stats.Bytes += size
+	c.stats.Entries++
+	c.evict()
+}
+
+func (c *Cache) remove(key string) {
+	_ = os.Remove(c.path(key))
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.stats.Bytes -= e.Value.(*entry).size
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.stats.Entries--
+	}
+	c.mu.Unlock()
+}
+
+// evict removes the least recently used entries until they fit in the budget.
+func (c *Cache) evict() {
+	for c.config.MaxBytes > 0 && c.stats.Bytes > c.config.MaxBytes {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		ent := e.Value.(*entry)
+		_ = os.Remove(c.path(ent.key))
+		c.lru.Remove(e)
+		delete(c.entries, ent.key)
+		c.stats.Bytes -= ent.size
+		c.stats.Entries--
+		c.stats.Evictions++
+	}
+}
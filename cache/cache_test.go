@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// fakeCreate writes the input's content reversed as the thumbnail, and populates the File's metadata.
+type fakeCreate struct {
+	calls int
+	err   error
+}
+
+func (f *fakeCreate) create(_ context.Context, file *thumbnailer.File) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	var data []byte
+	var err error
+	if file.Path != "" {
+		data, err = os.ReadFile(file.Path)
+	} else {
+		data, err = io.ReadAll(file.Reader)
+	}
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	if file.Thumbnail.Path != "" {
+		err = os.WriteFile(file.Thumbnail.Path, data, 0644)
+	} else {
+		_, err = file.Writer.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	file.Media, file.Width, file.Height, file.Duration, file.Title = "audio", 640, 480, time.Minute, "title"
+	file.Thumbnail.Width, file.Thumbnail.Height, file.ThumbCreated = 64, 48, true
+	return nil
+}
+
+func newCache(t *testing.T, dir string, maxBytes int64) (*Cache, *fakeCreate) {
+	t.Helper()
+	f := new(fakeCreate)
+	c, err := New(Config{Dir: dir, MaxBytes: maxBytes, Create: f.create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, f
+}
+
+func thumbnail(t *testing.T, c *Cache, file *thumbnailer.File, wantHit bool) string {
+	t.Helper()
+	out := new(bytes.Buffer)
+	hit, err := c.Thumbnail(context.Background(), file.ToWriter(out, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit != wantHit {
+		t.Errorf("hit = %v, want %v", hit, wantHit)
+	}
+	if !file.ThumbCreated || file.Media != "audio" || file.Width != 640 || file.Duration != time.Minute ||
+		file.Title != "title" || file.Thumbnail.Width != 64 {
+		t.Errorf("unexpected File metadata: %+v", file)
+	}
+	return out.String()
+}
+
+func TestCache(t *testing.T) {
+	c, f := newCache(t, t.TempDir(), 0)
+	for i, tc := range []struct {
+		name string
+		file func() *thumbnailer.File
+	}{
+		{"ReadSeeker", func() *thumbnailer.File {
+			r := strings.NewReader("abcdef")
+			return &thumbnailer.File{Reader: r, Seeker: r}
+		}},
+		{"Reader", func() *thumbnailer.File { return &thumbnailer.File{Reader: strings.NewReader("ghijkl")} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			first := thumbnail(t, c, tc.file(), false)
+			if second := thumbnail(t, c, tc.file(), true); second != first || first == "" {
+				t.Errorf("cached thumbnail = %q, want %q", second, first)
+			}
+			if f.calls != i+1 {
+				t.Errorf("Create called %d times, want %d", f.calls, i+1)
+			}
+		})
+	}
+	for _, options := range []thumbnailer.Thumbnail{
+		{Quality: 50},
+		{Mode: thumbnailer.ModeCrop},
+		{TargetHeight: 32},
+		{FrameTime: time.Second},
+	} {
+		thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("abcdef"), Thumbnail: options}, false)
+	}
+	if s := c.Stats(); s.Entries != 6 || s.Hits != 2 || s.Misses != 6 {
+		t.Errorf("unexpected Stats: %+v", s)
+	}
+	if _, err := c.Thumbnail(context.Background(), new(thumbnailer.File)); err != ErrNoInput {
+		t.Errorf("err = %v, want %v", err, ErrNoInput)
+	}
+}
+
+func TestCacheThumbnailKey(t *testing.T) {
+	c, f := newCache(t, t.TempDir(), 0)
+	for i, tc := range []struct {
+		content, key, want string
+		hit                bool
+	}{
+		{"abcdef", "a", "fedcba", false},
+		// The key identifies the content, which isn't read on hits.
+		{"ghijkl", "a", "fedcba", true},
+		{"ghijkl", "b", "lkjihg", false},
+	} {
+		r, out := strings.NewReader(tc.content), new(bytes.Buffer)
+		file := &thumbnailer.File{Reader: r}
+		hit, err := c.ThumbnailKey(context.Background(), file.ToWriter(out, 64), tc.key)
+		if err != nil || hit != tc.hit || out.String() != tc.want || !file.ThumbCreated {
+			t.Errorf("%d: hit = %v, thumbnail = %q, err = %v, want %v, %q", i, hit, out, err, tc.hit, tc.want)
+		}
+		if tc.hit && r.Len() != len(tc.content) {
+			t.Errorf("%d: input read on a hit", i)
+		}
+	}
+	// Content hashes are keyed apart from the supplied keys.
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("abcdef")}, false)
+	if f.calls != 3 {
+		t.Errorf("Create called %d times, want 3", f.calls)
+	}
+	if _, err := c.ThumbnailKey(context.Background(), new(thumbnailer.File), "a"); err != ErrNoInput {
+		t.Errorf("err = %v, want %v", err, ErrNoInput)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	c, _ := newCache(t, t.TempDir(), 0)
+	r := strings.NewReader("content")
+	file := &thumbnailer.File{Reader: r, Size: -1}
+	key, release, err := c.Key(file.ToWriter(io.Discard, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Seeker == nil || !file.SeekEnd || file.Size != 7 {
+		t.Errorf("File not spooled: %+v", file)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "content" {
+		t.Errorf("spool = %q, %v", data, err)
+	}
+	release()
+	if file.Reader != r || file.Seeker != nil || file.SeekEnd || file.Size != -1 {
+		t.Errorf("File not restored: %+v", file)
+	}
+	other, release, err := c.Key(&thumbnailer.File{Reader: strings.NewReader("content"), Thumbnail: file.Thumbnail})
+	if err != nil || other != key {
+		t.Errorf("key = %q, %v, want %q", other, err, key)
+	}
+	release()
+}
+
+func TestCachePath(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, f := newCache(t, filepath.Join(dir, "cache"), 0)
+	for i, wantHit := range []bool{false, true} {
+		r, err := os.Open(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := filepath.Join(dir, "output")
+		file := &thumbnailer.File{Reader: r, Seeker: r, Path: input}
+		hit, err := c.Thumbnail(context.Background(), file.ToPath(output, 64))
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != wantHit || f.calls != 1 {
+			t.Errorf("%d: hit = %v, calls = %d", i, hit, f.calls)
+		}
+		if data, err := os.ReadFile(output); err != nil || string(data) != "tnetnoc" {
+			t.Errorf("%d: output = %q, %v", i, data, err)
+		}
+		os.Remove(output)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := newCache(t, dir, 0)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("first")}, false)
+	size := c.Stats().Bytes
+	c, f := newCache(t, dir, 2*size)
+	if s := c.Stats(); s.Entries != 1 || s.Bytes != size {
+		t.Fatalf("unexpected Stats after reopening: %+v", s)
+	}
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("other")}, false)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("first")}, true)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("third")}, false)
+	if s := c.Stats(); s.Entries != 2 || s.Evictions != 1 || s.Bytes > s.MaxBytes {
+		t.Errorf("unexpected Stats: %+v", s)
+	}
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("first")}, true)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("other")}, false)
+	if f.calls != 3 {
+		t.Errorf("Create called %d times, want 3", f.calls)
+	}
+	c, _ = newCache(t, dir, 1)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("first")}, false)
+	if s := c.Stats(); s.Entries != 0 || s.Bytes != 0 {
+		t.Errorf("entries larger than the budget cached: %+v", s)
+	}
+}
+
+func TestCacheRecovery(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := newCache(t, dir, 0)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("content")}, false)
+	file := &thumbnailer.File{Reader: strings.NewReader("content")}
+	key, release, err := c.Key(file.ToWriter(io.Discard, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err = os.WriteFile(c.path(key), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	temp := filepath.Join(dir, tempPrefix+"leftover")
+	if err = os.WriteFile(temp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, f := newCache(t, dir, 0)
+	if _, err = os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("leftover temporary file not removed: %v", err)
+	}
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("content")}, false)
+	thumbnail(t, c, &thumbnailer.File{Reader: strings.NewReader("content")}, true)
+	if f.calls != 1 {
+		t.Errorf("Create called %d times, want 1", f.calls)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tempPrefix) {
+			t.Errorf("temporary file %v left behind", e.Name())
+		}
+	}
+}
+
+func TestCacheFailure(t *testing.T) {
+	c, f := newCache(t, t.TempDir(), 0)
+	f.err = thumbnailer.ErrInvalidData
+	file := &thumbnailer.File{Reader: strings.NewReader("content")}
+	if _, err := c.Thumbnail(context.Background(), file.ToWriter(io.Discard, 64)); err != f.err {
+		t.Errorf("err = %v, want %v", err, f.err)
+	}
+	if s := c.Stats(); s.Entries != 0 {
+		t.Errorf("failure cached: %+v", s)
+	}
+}
@@ -0,0 +1,326 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// GroupConfig stores the configuration of a Group. Dir is the directory for spooling inputs (the default directory for
+// temporary files if empty), and Create the function creating the thumbnails, as in Config.
+type GroupConfig struct {
+	Dir    string
+	Create func(ctx context.Context, file *thumbnailer.File) error
+}
+
+// Group coalesces concurrent thumbnail requests for the same content and options (e.g. a popular file uploaded or
+// requested many times at once) into a single job, whose encoded thumbnail and metadata are handed to every caller
+// waiting for it. Requests only share a job if their Files have the same Limits and Spool, which the job uses. The job
+// is detached from the caller that started it, keeping its context's values but not its cancellation, and is cancelled
+// only once the contexts of all its callers are done. A Group is safe for concurrent use.
+type Group struct {
+	config GroupConfig
+	mu     sync.Mutex
+	calls  map[string]*call
+}
+
+// call is a job shared by the callers waiting for it.
+type call struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	res     *result
+	err     error
+}
+
+// result is the thumbnail created by a job, with the File's metadata.
+type result struct {
+	data    []byte
+	meta    *metadata
+	created bool
+}
+
+// NewGroup returns a Group with the supplied GroupConfig.
+func NewGroup(config GroupConfig) *Group {
+	if config.Create == nil {
+		config.Create = thumbnailer.CreateThumbnailWithContext
+	}
+	return &Group{config: config, calls: make(map[string]*call)}
+}
+
+// Thumbnail creates the File's thumbnail (which should go through ToWriter or ToPath first) like
+// thumbnailer.CreateThumbnailWithContext, sharing the job of a concurrent call with the same content and options if
+// there is one, which it reports. The whole input is read to hash it, and if the File was created from an io.Reader,
+// it's spooled to a temporary file, so the job doesn't depend on the caller that started it. If the context is done
+// first, Thumbnail returns its error without waiting for the job.
+func (g *Group) Thumbnail(ctx context.Context, file *thumbnailer.File) (shared bool, err error) {
+	in, err := newInput(file, g.config.Dir)
+	if err != nil {
+		return false, err
+	}
+	defer in.release()
+	return g.thumbnail(ctx, in, file, nil)
+}
+
+// thumbnail waits for the job of the input's key, starting it if there is none, and delivers its result to the File.
+// A job started here passes its successful result to store before any caller receives it.
+func (g *Group) thumbnail(ctx context.Context, in *input, file *thumbnailer.File,
+	store func(key string, res *result)) (bool, error) {
+	g.mu.Lock()
+	c, shared := g.calls[in.group]
+	if shared {
+		c.waiters++
+		g.mu.Unlock()
+	} else {
+		c = &call{done: make(chan struct{}), waiters: 1}
+		var jobCtx context.Context
+		jobCtx, c.cancel = context.WithCancel(detached{ctx})
+		g.calls[in.group] = c
+		g.mu.Unlock()
+		if err := g.start(jobCtx, c, in, file, store); err != nil {
+			g.finish(in.group, c, nil, err)
+		}
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		g.mu.Lock()
+		if c.waiters--; c.waiters == 0 {
+			c.cancel()
+			if g.calls[in.group] == c {
+				delete(g.calls, in.group)
+			}
+		}
+		g.mu.Unlock()
+		return shared, ctx.Err()
+	}
+	if c.err != nil {
+		return shared, c.err
+	}
+	if c.res.created {
+		if err := deliver(file, bytes.NewReader(c.res.data)); err != nil {
+			return shared, err
+		}
+	}
+	c.res.meta.apply(file)
+	file.ThumbCreated = c.res.created
+	return shared, nil
+}
+
+// start starts the job creating the thumbnail of a copy of the File in memory.
+func (g *Group) start(ctx context.Context, c *call, in *input, file *thumbnailer.File,
+	store func(key string, res *result)) error {
+	work, release, err := in.job(file, g.config.Dir)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	work.Writer = buf
+	go func() {
+		err := g.config.Create(ctx, work)
+		release()
+		res := &result{data: buf.Bytes(), meta: newMetadata(work), created: work.ThumbCreated}
+		if err == nil && res.created && store != nil {
+			store(in.key, res)
+		}
+		g.finish(in.group, c, res, err)
+	}()
+	return nil
+}
+
+func (g *Group) finish(key string, c *call, res *result, err error) {
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	c.res, c.err = res, err
+	close(c.done)
+	c.cancel()
+}
+
+// detached keeps the values of the context of the caller that started a job, but not its cancellation, which is up to
+// all the callers waiting for the job.
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detached) Done() <-chan struct{} { return nil }
+
+func (detached) Err() error { return nil }
+
+// input is the hashed input of a File, spooled to a temporary file if it was read from a plain io.Reader. Its key
+// identifies the thumbnail, and its group key the job creating it, as the File's Limits and Spool decide how a job
+// treats the input, and whether it fails.
+type input struct {
+	key, group string
+	spool      *os.File
+	size       int64
+}
+
+// newInput hashes the File's content and the options of its thumbnail (TargetDimensions, TargetHeight, Mode,
+// FrameTime, Quality and Format) into a key. The whole input is read: Files from paths and fs.FSs are read separately,
+// Files with an io.Seeker are rewound afterwards, and Files with a plain io.Reader are spooled to a temporary file in
+// the directory.
+func newInput(file *thumbnailer.File, dir string) (*input, error) {
+	h, in := sha256.New(), new(input)
+	if err := in.hash(file, h, dir); err != nil {
+		return nil, err
+	}
+	if err := in.setKeys(file, h.Sum(nil)); err != nil {
+		in.release()
+		return nil, err
+	}
+	return in, nil
+}
+
+// keyedInput hashes the key identifying the File's content and the options of its thumbnail into a key, without
+// reading the input, which is left to the job.
+func keyedInput(file *thumbnailer.File, key string) (*input, error) {
+	if fsys, _ := file.FS(); fsys == nil && file.Path == "" && file.Reader == nil {
+		return nil, ErrNoInput
+	}
+	// An extra zero byte follows the hash of a key, where the options following the hash of a content have a digit or a
+	// sign, so the two can't collide.
+	in, sum := new(input), sha256.Sum256([]byte(key))
+	if err := in.setKeys(file, append(sum[:], 0)); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// setKeys sets the input's keys from the identity of its content.
+func (in *input) setKeys(file *thumbnailer.File, content []byte) error {
+	h := sha256.New()
+	h.Write([]byte(keyVersion))
+	h.Write(content)
+	opts := [...]int64{int64(file.TargetDimensions), int64(file.TargetHeight), int64(file.Mode),
+		int64(file.FrameTime), int64(file.Quality), int64(file.Format)}
+	for _, opt := range opts {
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.FormatInt(opt, 10)))
+	}
+	in.key = hex.EncodeToString(h.Sum(nil))
+	settings, err := json.Marshal(struct {
+		Limits *thumbnailer.Limits
+		Spool  *thumbnailer.SpillPolicy
+	}{file.Limits, file.Spool})
+	if err != nil {
+		return err
+	}
+	in.group = in.key + string(settings)
+	return nil
+}
+
+func (in *input) hash(file *thumbnailer.File, h hash.Hash, dir string) error {
+	if fsys, name := file.FS(); fsys != nil {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	}
+	if file.Path != "" {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	}
+	if file.Reader == nil {
+		return ErrNoInput
+	}
+	if file.Seeker != nil {
+		_, err := copyRewind(h, file)
+		return err
+	}
+	spool, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	if in.size, err = io.Copy(io.MultiWriter(h, spool), file.Reader); err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(spool)
+		return err
+	}
+	in.spool = spool
+	return nil
+}
+
+// copyRewind copies the File's io.ReadSeeker from its current offset, and seeks back to it.
+func copyRewind(w io.Writer, file *thumbnailer.File) (int64, error) {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, file.Reader)
+	if err != nil {
+		return n, err
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	return n, err
+}
+
+// job returns a copy of the File for a job, along with a function releasing its input. The copy reads from the
+// input's spool, which the job takes over, or from a new spool of the File's io.Reader (rewound afterwards if it's an
+// io.ReadSeeker), which belongs to the caller, so the job can outlive it. Files from paths and fs.FSs are reopened by
+// the job instead.
+func (in *input) job(file *thumbnailer.File, dir string) (*thumbnailer.File, func(), error) {
+	work := *file
+	work.Writer, work.Thumbnail.Path = nil, ""
+	if fsys, _ := file.FS(); fsys != nil || file.Path != "" {
+		work.Reader, work.Seeker = nil, nil
+		return &work, func() {}, nil
+	}
+	spool := in.spool
+	in.spool = nil
+	if spool == nil {
+		var err error
+		if spool, err = os.CreateTemp(dir, tempPrefix); err != nil {
+			return nil, nil, err
+		}
+		if file.Seeker != nil {
+			in.size, err = copyRewind(spool, file)
+		} else {
+			in.size, err = io.Copy(spool, file.Reader)
+		}
+		if err == nil {
+			_, err = spool.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			removeSpool(spool)
+			return nil, nil, err
+		}
+	}
+	work.Reader, work.Seeker, work.SeekEnd, work.Size = spool, spool, true, in.size
+	return &work, func() { removeSpool(spool) }, nil
+}
+
+// release removes the input's spool, unless a job took it over.
+func (in *input) release() {
+	if in.spool != nil {
+		removeSpool(in.spool)
+		in.spool = nil
+	}
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// blockingCreate creates thumbnails like fakeCreate once released, or fails with the context's error if it's done
+// first.
+type blockingCreate struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+	ctxErr  chan error
+}
+
+func newBlockingCreate() *blockingCreate {
+	return &blockingCreate{
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+		ctxErr:  make(chan error, 16),
+	}
+}
+
+func (b *blockingCreate) create(ctx context.Context, file *thumbnailer.File) error {
+	atomic.AddInt32(&b.calls, 1)
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return new(fakeCreate).create(ctx, file)
+	case <-ctx.Done():
+		b.ctxErr <- ctx.Err()
+		return ctx.Err()
+	}
+}
+
+// waitShared waits until n callers wait for the key's job.
+func waitShared(t *testing.T, g *Group, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		waiters := 0
+		for _, c := range g.calls {
+			waiters += c.waiters
+		}
+		g.mu.Unlock()
+		if waiters == n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d callers", n)
+}
+
+func TestGroup(t *testing.T) {
+	b := newBlockingCreate()
+	g := NewGroup(GroupConfig{Dir: t.TempDir(), Create: b.create})
+	const n = 8
+	var (
+		wg      sync.WaitGroup
+		outputs [n]bytes.Buffer
+		files   [n]*thumbnailer.File
+		shared  [n]bool
+		errs    [n]error
+	)
+	for i := 0; i < n; i++ {
+		files[i] = &thumbnailer.File{Reader: strings.NewReader("content")}
+		if i%2 == 0 {
+			r := strings.NewReader("content")
+			files[i] = &thumbnailer.File{Reader: r, Seeker: r}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shared[i], errs[i] = g.Thumbnail(context.Background(), files[i].ToWriter(&outputs[i], 64))
+		}(i)
+	}
+	<-b.started
+	waitShared(t, g, n)
+	close(b.release)
+	wg.Wait()
+	if calls := atomic.LoadInt32(&b.calls); calls != 1 {
+		t.Errorf("Create called %d times, want 1", calls)
+	}
+	sharedCount := 0
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("%d: %v", i, errs[i])
+		}
+		if shared[i] {
+			sharedCount++
+		}
+		if out := outputs[i].String(); out != "tnetnoc" {
+			t.Errorf("%d: output = %q", i, out)
+		}
+		if f := files[i]; !f.ThumbCreated || f.Media != "audio" || f.Thumbnail.Width != 64 || f.Title != "title" {
+			t.Errorf("%d: unexpected File metadata: %+v", i, f)
+		}
+	}
+	if sharedCount != n-1 {
+		t.Errorf("%d shared calls, want %d", sharedCount, n-1)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("%d calls left behind", len(g.calls))
+	}
+}
+
+func TestGroupCancel(t *testing.T) {
+	b := newBlockingCreate()
+	g := NewGroup(GroupConfig{Dir: t.TempDir(), Create: b.create})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	errs := make(chan error, 2)
+	out := new(bytes.Buffer)
+	go func() {
+		file := &thumbnailer.File{Reader: strings.NewReader("content")}
+		_, err := g.Thumbnail(ctx1, file.ToWriter(io.Discard, 64))
+		errs <- err
+	}()
+	<-b.started
+	go func() {
+		file := &thumbnailer.File{Reader: strings.NewReader("content")}
+		_, err := g.Thumbnail(ctx2, file.ToWriter(out, 64))
+		errs <- err
+	}()
+	waitShared(t, g, 2)
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-b.ctxErr:
+		t.Fatalf("job cancelled with a caller still waiting: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(b.release)
+	if err := <-errs; err != nil || out.String() != "tnetnoc" {
+		t.Fatalf("err = %v, output = %q", err, out)
+	}
+
+	b = newBlockingCreate()
+	g = NewGroup(GroupConfig{Dir: t.TempDir(), Create: b.create})
+	cancels := make([]context.CancelFunc, 2)
+	for i := range cancels {
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		go func() {
+			file := &thumbnailer.File{Reader: strings.NewReader("content")}
+			_, err := g.Thumbnail(ctx, file.ToWriter(io.Discard, 64))
+			errs <- err
+		}()
+		waitShared(t, g, i+1)
+	}
+	<-b.started
+	for _, cancel := range cancels {
+		cancel()
+		if err := <-errs; err != context.Canceled {
+			t.Fatalf("err = %v, want %v", err, context.Canceled)
+		}
+	}
+	if err := <-b.ctxErr; err != context.Canceled {
+		t.Fatalf("job err = %v, want %v", err, context.Canceled)
+	}
+	close(b.release)
+	out.Reset()
+	file := &thumbnailer.File{Reader: strings.NewReader("content")}
+	if shared, err := g.Thumbnail(context.Background(), file.ToWriter(out, 64)); shared || err != nil ||
+		out.String() != "tnetnoc" {
+		t.Errorf("shared = %v, err = %v, output = %q after the job was cancelled", shared, err, out)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	b := newBlockingCreate()
+	g := NewGroup(GroupConfig{Dir: t.TempDir(), Create: b.create})
+	files := []*thumbnailer.File{
+		{Reader: strings.NewReader("content")},
+		{Reader: strings.NewReader("content"), Limits: &thumbnailer.Limits{MaxPixels: 1}},
+		{Reader: strings.NewReader("content"), Spool: &thumbnailer.SpillPolicy{MaxSize: 1}},
+	}
+	var wg sync.WaitGroup
+	for _, file := range files {
+		wg.Add(1)
+		go func(file *thumbnailer.File) {
+			defer wg.Done()
+			if shared, err := g.Thumbnail(context.Background(), file.ToWriter(io.Discard, 64)); shared || err != nil {
+				t.Errorf("Thumbnail() = %v, %v", shared, err)
+			}
+		}(file)
+	}
+	for range files {
+		<-b.started
+	}
+	close(b.release)
+	wg.Wait()
+	if calls := atomic.LoadInt32(&b.calls); calls != int32(len(files)) {
+		t.Errorf("Create called %d times, want %d", calls, len(files))
+	}
+}
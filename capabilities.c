@@ -0,0 +1,54 @@
+#include "capabilities.h"
+
+static void *append_class(VipsForeignClass *class, GString *classes, void *b) {
+    g_string_append(classes, VIPS_OBJECT_CLASS(class)->nickname);
+    g_string_append_c(classes, '\t');
+    if (class->suffs) {
+        for (const char **suff = class->suffs; *suff; suff++) {
+            if (suff != class->suffs) {
+                g_string_append_c(classes, ',');
+            }
+            g_string_append(classes, *suff);
+        }
+    }
+    g_string_append_c(classes, '\n');
+    return NULL;
+}
+
+char *foreign_classes(const char *base) {
+    GString *classes = g_string_new(NULL);
+    vips_foreign_map(base, (VipsSListMap2Fn) append_class, classes, NULL);
+    return g_string_free(classes, FALSE);
+}
+
+// save_palette saves a PNG with a palette, returning whether it has one, or -1 if it fails.
+static int save_palette(void) {
+    VipsImage *image;
+    void *buf = NULL;
+    size_t len = 0;
+    if (vips_black(&image, 1, 1, "bands", 3, NULL)) {
+        return -1;
+    }
+    int err = vips_pngsave_buffer(image, &buf, &len, "palette", TRUE, NULL);
+    g_object_unref(image);
+    if (err) {
+        return -1;
+    }
+    // The colour type in the IHDR chunk, which is 3 for indexed-colour images.
+    int palette = len > 25 && ((unsigned char *) buf)[25] == 3;
+    g_free(buf);
+    return palette;
+}
+
+// palette_supported reports whether PNGs can be saved with palettes, as a call of its own (see begin_call), so the
+// messages of its failures aren't taken by others.
+int palette_supported(void) {
+    guint64 call = begin_call();
+    int palette = save_palette();
+    if (palette < 0) {
+        g_free(call_error(call));
+        palette = 0;
+    }
+    end_call();
+    return palette;
+}
@@ -0,0 +1,178 @@
+package thumbnailer
+
+// #include "capabilities.h"
+import "C"
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/zRedShift/mimemagic"
+)
+
+// VIPSForeign is a vips loader or saver, with the file suffixes it handles and their MediaTypes.
+type VIPSForeign struct {
+	Name                 string
+	Suffixes, MediaTypes []string
+}
+
+// FFmpegDemuxer is an FFmpeg demuxer, with the file extensions it handles and its MediaTypes, either reported by
+// FFmpeg or matched from the extensions.
+type FFmpegDemuxer struct {
+	Name, LongName         string
+	Extensions, MediaTypes []string
+}
+
+// CapabilityInfo describes the linked libvips and FFmpeg builds: their versions, the vips loaders and savers, the
+// FFmpeg demuxers and video decoders, whether the libvpx decoders (the only ones that decode the alpha channel of VP8
+// and VP9 videos) are present, and whether vips was built with libimagequant, which it needs to save palette PNGs.
+type CapabilityInfo struct {
+	VIPSVersion, FFmpegVersion string
+	VIPSLoaders, VIPSSavers    []VIPSForeign
+	FFmpegDemuxers             []FFmpegDemuxer
+	FFmpegDecoders             []string
+	LibVPX, LibImageQuant      bool
+	mediaTypes                 map[string]bool
+}
+
+var capabilities struct {
+	sync.Once
+	*CapabilityInfo
+}
+
+// Capabilities initializes vips and returns the CapabilityInfo of the linked libvips and FFmpeg builds. It's computed
+// once, and must not be modified.
+func Capabilities() *CapabilityInfo {
+	capabilities.Do(func() {
+		initVIPS()
+		c := &CapabilityInfo{
+			VIPSVersion:   C.GoString(C.vips_version_string()),
+			FFmpegVersion: C.GoString(C.av_version_info()),
+			VIPSLoaders:   vipsForeigns("VipsForeignLoad"),
+			VIPSSavers:    vipsForeigns("VipsForeignSave"),
+			LibImageQuant: C.palette_supported() != 0,
+			mediaTypes:    make(map[string]bool),
+		}
+		c.FFmpegDemuxers, c.FFmpegDecoders = ffmpegDemuxers(), ffmpegDecoders()
+		for _, decoder := range c.FFmpegDecoders {
+			if decoder == "libvpx" || decoder == "libvpx-vp9" {
+				c.LibVPX = true
+			}
+		}
+		for _, l := range c.VIPSLoaders {
+			for _, t := range l.MediaTypes {
+				if !strings.HasPrefix(t, "video/") && !strings.HasPrefix(t, "audio/") {
+					c.mediaTypes[t] = true
+				}
+			}
+		}
+		for _, d := range c.FFmpegDemuxers {
+			for _, t := range d.MediaTypes {
+				if strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/") {
+					c.mediaTypes[t] = true
+				}
+			}
+		}
+		capabilities.CapabilityInfo = c
+	})
+	return capabilities.CapabilityInfo
+}
+
+// Supports reports whether a File of the MediaType (as sniffed by the FileFrom functions) can be thumbnailed: by a vips
+// loader if it's neither a video nor an audio file, or by an FFmpeg demuxer otherwise. The MediaType's aliases and
+// parent types are considered too. The media types of the loaders and demuxers are mostly matched from their file
+// suffixes, so this is a good indication for rejecting uploads early, rather than a guarantee.
+func (c *CapabilityInfo) Supports(m mimemagic.MediaType) bool {
+	if c.mediaTypes[m.MediaType()] {
+		return true
+	}
+	for _, types := range [...][]string{m.Alias, m.SubClassOf} {
+		for _, t := range types {
+			if c.mediaTypes[t] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globMediaTypes returns the sorted, deduplicated union of the media types and those matched from the extensions.
+func globMediaTypes(mediaTypes []string, extensions []string) []string {
+	seen, unknown := make(map[string]bool), mimemagic.MatchGlob("").MediaType()
+	for _, t := range mediaTypes {
+		seen[t] = true
+	}
+	for _, ext := range extensions {
+		if t := mimemagic.MatchGlob("file." + strings.TrimPrefix(ext, ".")).MediaType(); t != unknown {
+			seen[t] = true
+		}
+	}
+	types := make([]string, 0, len(seen))
+	for t := range seen {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func splitList(list *C.char) []string {
+	if list == nil {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(C.GoString(list), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func vipsForeigns(base string) []VIPSForeign {
+	cBase := C.CString(base)
+	defer free(unsafe.Pointer(cBase))
+	classes := C.foreign_classes(cBase)
+	defer C.g_free(C.gpointer(classes))
+	var foreigns []VIPSForeign
+	for _, line := range strings.Split(strings.TrimSpace(C.GoString(classes)), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if fields[0] == "" {
+			continue
+		}
+		f := VIPSForeign{Name: fields[0]}
+		if len(fields) == 2 && fields[1] != "" {
+			f.Suffixes = strings.Split(fields[1], ",")
+		}
+		f.MediaTypes = globMediaTypes(nil, f.Suffixes)
+		foreigns = append(foreigns, f)
+	}
+	return foreigns
+}
+
+func ffmpegDemuxers() []FFmpegDemuxer {
+	var demuxers []FFmpegDemuxer
+	var opaque unsafe.Pointer
+	for f := C.av_demuxer_iterate(&opaque); f != nil; f = C.av_demuxer_iterate(&opaque) {
+		d := FFmpegDemuxer{
+			Name:       C.GoString(f.name),
+			LongName:   C.GoString(f.long_name),
+			Extensions: splitList(f.extensions),
+		}
+		d.MediaTypes = globMediaTypes(splitList(f.mime_type), d.Extensions)
+		demuxers = append(demuxers, d)
+	}
+	return demuxers
+}
+
+func ffmpegDecoders() []string {
+	var decoders []string
+	var opaque unsafe.Pointer
+	for c := C.av_codec_iterate(&opaque); c != nil; c = C.av_codec_iterate(&opaque) {
+		if c._type == C.AVMEDIA_TYPE_VIDEO && C.av_codec_is_decoder(c) != 0 {
+			decoders = append(decoders, C.GoString(c.name))
+		}
+	}
+	sort.Strings(decoders)
+	return decoders
+}
@@ -0,0 +1,9 @@
+#include <stdlib.h>
+
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include "vips.h"
+
+char *foreign_classes(const char *base);
+
+int palette_supported(void);
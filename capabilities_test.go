@@ -0,0 +1,64 @@
+package thumbnailer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := Capabilities()
+	if c.VIPSVersion == "" || c.FFmpegVersion == "" {
+		t.Errorf("versions missing: vips %q, ffmpeg %q", c.VIPSVersion, c.FFmpegVersion)
+	}
+	if Capabilities() != c {
+		t.Error("Capabilities() not cached")
+	}
+	find := func(foreigns []VIPSForeign, name, mediaType string) {
+		for _, f := range foreigns {
+			if f.Name != name {
+				continue
+			}
+			for _, m := range f.MediaTypes {
+				if m == mediaType {
+					return
+				}
+			}
+			t.Errorf("%v media types want %v, got %v", name, mediaType, f.MediaTypes)
+			return
+		}
+		t.Errorf("%v missing", name)
+	}
+	find(c.VIPSLoaders, "jpegload", "image/jpeg")
+	find(c.VIPSSavers, "pngsave", "image/png")
+	var mov bool
+	for _, d := range c.FFmpegDemuxers {
+		mov = mov || d.Name == "mov,mp4,m4a,3gp,3g2,mj2"
+	}
+	if !mov {
+		t.Error("mov demuxer missing")
+	}
+	if len(c.FFmpegDecoders) == 0 {
+		t.Error("no video decoders")
+	}
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"Landscape_8.jpg", true},
+		{"trollface.png", true},
+		{"schizo_0.mp4", true},
+		{"dürümpf.mp3", true},
+		{"urandom", false},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			f, err := FileFromPath(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			if got := c.Supports(f.MediaType); got != test.want {
+				t.Errorf("Supports(%v) want = %v, got = %v", f.MediaType.MediaType(), test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Command thumbnail-server serves thumbnails of the files in a directory over HTTP, created on the fly for signed URLs.
+//
+// Usage:
+//
+//	thumbnail-server -root dir [flags]
+//	thumbnail-server -sign WxH/mode/format/source-path
+//
+// The HMAC key is read from the THUMBNAILER_KEY environment variable, or from the file passed with -key-file. With
+// -sign, the signed path of the thumbnail is printed instead of serving, e.g. for
+// "thumbnail-server -sign 256x256/fit/auto/photos/cat.jpg".
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+	"github.com/zRedShift/thumbnailer/cache"
+	"github.com/zRedShift/thumbnailer/server"
+)
+
+func main() {
+	var (
+		addr      = flag.String("addr", ":8080", "the `address` to listen on")
+		root      = flag.String("root", "", "the `directory` of the source files")
+		keyFile   = flag.String("key-file", "", "the `file` holding the signing key, instead of $THUMBNAILER_KEY")
+		cacheDir  = flag.String("cache", "", "the `directory` of the thumbnail cache (no cache if empty)")
+		cacheSize = flag.Int64("cache-size", 1<<30, "the maximum size of the thumbnail cache in `bytes`")
+		maxSize   = flag.Int("max-size", 1024, "the maximum width and height of thumbnails in `pixels`")
+		quality   = flag.Int("quality", 75, "the `quality` of the thumbnails (1-100)")
+		j         = flag.Int("j", runtime.GOMAXPROCS(0), "the maximum `number` of thumbnails created at once")
+		maxAge    = flag.Duration("max-age", 24*time.Hour, "the max-age of the thumbnails' Cache-Control header")
+		toSign    = flag.String("sign", "", "print the signed path of `WxH/mode/format/source-path` and exit")
+	)
+	flag.Parse()
+	key, err := readKey(*keyFile)
+	if err != nil {
+		fatal(err)
+	}
+	if *toSign != "" {
+		path, err := signPath(key, *toSign)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(path)
+		return
+	}
+	if *root == "" || *quality < 1 || *quality > 100 || *j <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	thumbnailer.SetLogger(logger)
+	defer thumbnailer.ShutdownVIPS()
+	t := thumbnailer.New(thumbnailer.Config{MaxConcurrent: *j})
+	defer t.Close()
+	config := server.Config{
+		Key:     key,
+		FS:      os.DirFS(*root),
+		MaxSize: *maxSize,
+		Quality: *quality,
+		MaxAge:  *maxAge,
+		Create:  t.Thumbnail,
+		Logger:  logger,
+	}
+	if *cacheDir != "" {
+		config.Cache, err = cache.New(cache.Config{Dir: *cacheDir, MaxBytes: *cacheSize, Create: t.Thumbnail})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	s, err := server.New(config)
+	if err != nil {
+		fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(server.Prefix, s)
+	srv := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+	logger.Info("serving thumbnails", "addr", *addr, "root", *root)
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		fatal(err)
+	}
+	<-done
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "thumbnail-server:", err)
+	os.Exit(1)
+}
+
+func readKey(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		if key := os.Getenv("THUMBNAILER_KEY"); key != "" {
+			return []byte(key), nil
+		}
+		return nil, errors.New("no signing key: set $THUMBNAILER_KEY or -key-file")
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key = []byte(strings.TrimSpace(string(key))); len(key) == 0 {
+		return nil, errors.New("empty signing key in " + keyFile)
+	}
+	return key, nil
+}
+
+// signPath signs a path of the form WxH/mode/format/source-path.
+func signPath(key []byte, path string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 4)
+	if len(parts) != 4 {
+		return "", errors.New("malformed path: " + path)
+	}
+	dims := strings.SplitN(parts[0], "x", 2)
+	if len(dims) != 2 {
+		return "", errors.New("malformed dimensions: " + parts[0])
+	}
+	width, err := strconv.Atoi(dims[0])
+	if err != nil {
+		return "", err
+	}
+	height, err := strconv.Atoi(dims[1])
+	if err != nil {
+		return "", err
+	}
+	return server.Sign(key, width, height, parts[1], parts[2], parts[3]), nil
+}
@@ -0,0 +1,401 @@
+// Command thumbnailer creates the thumbnails of files, and of the files in directories, in parallel, or probes their
+// metadata.
+//
+// Usage:
+//
+//	thumbnailer [flags] path...
+//
+// Directories are walked recursively, and files reached through several of the paths are processed once, as found
+// through the first of them. The thumbnail of a file is written to the output directory under the file's path relative
+// to the directory it was found in (or its base name if it was passed directly), with the thumbnail's extension
+// appended, e.g. thumbnails/2021/cat.png.jpg for photos/2021/cat.png. Files whose thumbnails are newer than them are
+// skipped, unless -force is set. A JSON line is written to the report for every file, with its metadata, the path of
+// its thumbnail, and the error and its kind if it failed. Files without thumbnails, e.g. audio without cover art, are
+// reported as skipped, without one. The thumbnails fit in a -size box, or a -size by -height one, and are cropped to
+// fill it with -mode crop. Videos are thumbnailed from their most representative frame among the first ones, or from
+// the frame at -frame, if set. With -probe, only the metadata is reported, without creating thumbnails. The exit code
+// is 1 if any file failed.
+//
+// With -watch, the directories are watched (with inotify, on Linux only) and the thumbnail tree is kept up to date
+// until the command is interrupted: thumbnails are created for new and modified files once they're no longer being
+// written, and deleted with their files. Videos that are still being written after -settle get a preliminary
+// thumbnail, created from their beginning. The sizes and modification times of the processed files are kept in a state
+// file, so only the files that changed while the command wasn't running are processed when it's restarted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+type options struct {
+	out, report                string
+	size, quality, concurrency int
+	height                     int
+	format                     thumbnailer.Format
+	mode                       thumbnailer.Mode
+	frame                      time.Duration
+	force, probe, watch        bool
+	timeout, settle            time.Duration
+	state                      string
+}
+
+func main() {
+	o := new(options)
+	flag.StringVar(&o.out, "out", "thumbnails", "the `directory` to write the thumbnails to")
+	flag.StringVar(&o.report, "report", "-", "the `file` to write the JSON-lines report to (- for standard output)")
+	flag.IntVar(&o.size, "size", 256, "the size of the thumbnails' bounding box in `pixels`")
+	flag.IntVar(&o.height, "height", 0, "the height of the thumbnails' bounding box in `pixels` (-size if 0)")
+	mode := flag.String("mode", "fit", "how the thumbnails are fitted to their bounding box: fit or crop")
+	flag.DurationVar(&o.frame, "frame", 0, "the `time` of the frame videos are thumbnailed from (0 for the best)")
+	flag.IntVar(&o.quality, "quality", 75, "the `quality` of the thumbnails (1-100)")
+	flag.IntVar(&o.concurrency, "j", runtime.GOMAXPROCS(0), "the `number` of files processed at once")
+	format := flag.String("format", "auto", "the `format` of the thumbnails: auto, jpeg, png or webp")
+	flag.BoolVar(&o.force, "force", false, "recreate thumbnails newer than their files")
+	flag.BoolVar(&o.probe, "probe", false, "report the files' metadata without creating thumbnails")
+	flag.DurationVar(&o.timeout, "timeout", 0, "the maximum `duration` of processing a file (0 for none)")
+	flag.BoolVar(&o.watch, "watch", false, "keep the thumbnails of the directories up to date until interrupted")
+	flag.StringVar(&o.state, "state", "", "the state `file` of -watch (.state.json in the output directory if empty)")
+	flag.DurationVar(&o.settle, "settle", 2*time.Second, "the `time` without writes after which -watch processes a file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var err error
+	if o.format, err = thumbnailer.ParseFormat(*format); err != nil {
+		fatal(err)
+	}
+	if o.mode, err = thumbnailer.ParseMode(*mode); err != nil {
+		fatal(err)
+	}
+	if flag.NArg() == 0 || o.size <= 0 || o.height < 0 || o.frame < 0 || o.quality < 1 || o.quality > 100 ||
+		o.concurrency <= 0 || o.watch && (o.probe || o.settle <= 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if o.watch {
+		if err = o.watchDirs(ctx, flag.Args()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	failed, err := o.run(ctx, flag.Args())
+	if err != nil {
+		fatal(err)
+	}
+	if failed {
+		stop()
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "thumbnailer:", err)
+	os.Exit(1)
+}
+
+// job is a file to process, with its path relative to the output directory.
+type job struct {
+	path, rel string
+}
+
+// metadata is the metadata of a File, as reported.
+type metadata struct {
+	MediaType   string  `json:"media_type"`
+	Size        int64   `json:"size"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Orientation int     `json:"orientation,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	Title       string  `json:"title,omitempty"`
+	Artist      string  `json:"artist,omitempty"`
+	HasVideo    bool    `json:"has_video,omitempty"`
+	HasAudio    bool    `json:"has_audio,omitempty"`
+}
+
+// thumbnail is the resultant thumbnail, as reported.
+type thumbnail struct {
+	Path     string `json:"path"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	HasAlpha bool   `json:"has_alpha,omitempty"`
+}
+
+// result is the line of the report of a file.
+type result struct {
+	Path string `json:"path"`
+	*metadata
+	Thumbnail *thumbnail `json:"thumbnail,omitempty"`
+	Skipped   bool       `json:"skipped,omitempty"`
+	Partial   bool       `json:"partial,omitempty"`
+	Removed   bool       `json:"removed,omitempty"`
+	Elapsed   float64    `json:"elapsed"`
+	Error     string     `json:"error,omitempty"`
+	Kind      string     `json:"kind,omitempty"`
+}
+
+func newMetadata(file *thumbnailer.File) *metadata {
+	return &metadata{
+		MediaType:   file.MediaType.MediaType(),
+		Size:        file.Size,
+		Width:       file.Width,
+		Height:      file.Height,
+		Orientation: file.Orientation,
+		Duration:    file.Duration.Seconds(),
+		Title:       file.Title,
+		Artist:      file.Artist,
+		HasVideo:    file.HasVideo,
+		HasAudio:    file.HasAudio,
+	}
+}
+
+func (r *result) fail(err error) {
+	r.Error, r.Kind = err.Error(), strings.ReplaceAll(thumbnailer.KindOf(err).String(), " ", "_")
+}
+
+// run processes the files and the files in the directories at the paths with o.concurrency goroutines, and reports
+// whether any of them failed.
+func (o *options) run(ctx context.Context, paths []string) (bool, error) {
+	report, closeReport, err := o.openReport()
+	if err != nil {
+		return false, err
+	}
+	defer closeReport()
+	var t *thumbnailer.Thumbnailer
+	if !o.probe {
+		t = thumbnailer.New(thumbnailer.Config{MaxConcurrent: o.concurrency})
+		defer t.Close()
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int32
+		jobs   = make(chan job)
+		enc    = json.NewEncoder(report)
+		errs   = make(chan error, 1)
+	)
+	wg.Add(o.concurrency)
+	for i := 0; i < o.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				res := o.process(ctx, t, j)
+				if res.Error != "" {
+					atomic.StoreInt32(&failed, 1)
+				}
+				mu.Lock()
+				if err := enc.Encode(res); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	err = o.walk(ctx, paths, jobs)
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return atomic.LoadInt32(&failed) != 0, err
+}
+
+// openReport opens the report, returning a function closing it.
+func (o *options) openReport() (io.Writer, func(), error) {
+	if o.report == "-" {
+		return os.Stdout, func() {}, nil
+	}
+	f, err := os.Create(o.report)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// walk sends the jobs of the files at the paths, walking directories recursively and skipping the output directory.
+// Files reached through several paths are sent once, with the first of them.
+func (o *options) walk(ctx context.Context, paths []string, jobs chan<- job) error {
+	out, err := filepath.Abs(o.out)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	send := func(j job) error {
+		abs, err := filepath.Abs(j.path)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return nil
+		}
+		seen[abs] = true
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, root := range paths {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			if err = send(job{root, filepath.Base(root)}); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if abs, err := filepath.Abs(path); err == nil && abs == out {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			return send(job{path, rel})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extensions returns the possible extensions of the thumbnails in the Format.
+func extensions(format thumbnailer.Format) []string {
+	switch format {
+	case thumbnailer.FormatJPEG:
+		return []string{".jpg"}
+	case thumbnailer.FormatPNG:
+		return []string{".png"}
+	case thumbnailer.FormatWebP:
+		return []string{".webp"}
+	}
+	return []string{".jpg", ".png"}
+}
+
+// upToDate returns the path of the thumbnail of the file, if it exists and is newer than the file.
+func upToDate(path, base string, format thumbnailer.Format) (string, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	for _, ext := range extensions(format) {
+		if out, err := os.Stat(base + ext); err == nil && !out.ModTime().Before(fi.ModTime()) {
+			return base + ext, true
+		}
+	}
+	return "", false
+}
+
+// process probes or creates the thumbnail of the job's file.
+func (o *options) process(ctx context.Context, t *thumbnailer.Thumbnailer, j job) *result {
+	start, res := time.Now(), &result{Path: j.path}
+	defer func() {
+		res.Elapsed = time.Since(start).Seconds()
+	}()
+	base := filepath.Join(o.out, j.rel)
+	if !o.probe && !o.force {
+		if out, ok := upToDate(j.path, base, o.format); ok {
+			res.Thumbnail, res.Skipped = &thumbnail{Path: out}, true
+			return res
+		}
+	}
+	file, err := thumbnailer.FileFromPath(j.path)
+	if err != nil {
+		res.fail(err)
+		return res
+	}
+	o.create(ctx, t, file, base, res)
+	return res
+}
+
+// create probes or creates the thumbnail of the File, with the base path of the thumbnail, recording the outcome in
+// the result.
+func (o *options) create(ctx context.Context, t *thumbnailer.Thumbnailer, file *thumbnailer.File, base string,
+	res *result) {
+	var err error
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.probe {
+		err = thumbnailer.ProbeWithContext(ctx, file)
+	} else if res.Thumbnail, err = o.thumbnail(ctx, t, file, base); err == nil && res.Thumbnail == nil {
+		res.Skipped = true
+	}
+	res.metadata = newMetadata(file)
+	if err != nil {
+		res.fail(err)
+	}
+}
+
+// thumbnail creates the thumbnail of the File in a temporary file, and renames it to the base path with the
+// extension of its format. It returns nil if the File has no thumbnail, e.g. audio without cover art.
+func (o *options) thumbnail(ctx context.Context, t *thumbnailer.Thumbnailer, file *thumbnailer.File,
+	base string) (*thumbnail, error) {
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(base), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	file.ToPath(tmp.Name(), o.size, o.quality).Format = o.format
+	file.Mode, file.TargetHeight, file.FrameTime = o.mode, o.height, o.frame
+	if err = t.Thumbnail(ctx, file); err != nil {
+		return nil, err
+	}
+	if !file.ThumbCreated {
+		return nil, nil
+	}
+	ext := extensions(o.format)[0]
+	if o.format == thumbnailer.FormatAuto && file.HasAlpha {
+		ext = ".png"
+	}
+	if err = os.Rename(tmp.Name(), base+ext); err != nil {
+		return nil, err
+	}
+	return &thumbnail{base + ext, file.Thumbnail.Width, file.Thumbnail.Height, file.HasAlpha}, nil
+}
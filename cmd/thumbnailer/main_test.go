@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+func touch(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir, now := t.TempDir(), time.Now()
+	for _, name := range []string{"a.jpg", "sub/b.png", "sub/deeper/c.mp4", "out/a.jpg.jpg", "single.gif"} {
+		touch(t, filepath.Join(dir, name), now)
+	}
+	o := &options{out: filepath.Join(dir, "out")}
+	jobs := make(chan job)
+	errs := make(chan error, 1)
+	go func() {
+		paths := []string{filepath.Join(dir, "sub"), dir, filepath.Join(dir, "a.jpg")}
+		errs <- o.walk(context.Background(), paths, jobs)
+		close(jobs)
+	}()
+	var got []job
+	for j := range jobs {
+		j.path, _ = filepath.Rel(dir, j.path)
+		got = append(got, j)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].path < got[j].path || got[i].path == got[j].path && got[i].rel < got[j].rel
+	})
+	want := []job{
+		{"a.jpg", "a.jpg"},
+		{"single.gif", "single.gif"},
+		{filepath.Join("sub", "b.png"), "b.png"},
+		{filepath.Join("sub", "deeper", "c.mp4"), filepath.Join("deeper", "c.mp4")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	dir, now := t.TempDir(), time.Now()
+	input, base := filepath.Join(dir, "in.webm"), filepath.Join(dir, "out", "in.webm")
+	touch(t, input, now)
+	if _, ok := upToDate(input, base, thumbnailer.FormatAuto); ok {
+		t.Error("missing thumbnail up to date")
+	}
+	touch(t, base+".png", now.Add(-time.Hour))
+	if _, ok := upToDate(input, base, thumbnailer.FormatAuto); ok {
+		t.Error("stale thumbnail up to date")
+	}
+	touch(t, base+".png", now.Add(time.Hour))
+	for format, want := range map[thumbnailer.Format]bool{
+		thumbnailer.FormatAuto: true,
+		thumbnailer.FormatPNG:  true,
+		thumbnailer.FormatJPEG: false,
+		thumbnailer.FormatWebP: false,
+	} {
+		if out, ok := upToDate(input, base, format); ok != want || ok && out != base+".png" {
+			t.Errorf("%v: upToDate = %v, %v", format, out, ok)
+		}
+	}
+}
+
+func TestProcessNoThumbnail(t *testing.T) {
+	o := &options{out: t.TempDir(), size: 64, quality: 75}
+	tr := thumbnailer.New(thumbnailer.Config{MaxConcurrent: 1})
+	defer tr.Close()
+	path := filepath.Join("..", "..", "fixtures", "dürümpf.mp3")
+	res := o.process(context.Background(), tr, job{path, "dürümpf.mp3"})
+	if res.Error != "" || !res.Skipped || res.Thumbnail != nil || res.metadata == nil {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// op is the operation of a watched event.
+type op int
+
+const (
+	// opWrite is a file being created or written to.
+	opWrite op = iota
+	// opClose is a file being closed after being written to, or moved into a watched directory.
+	opClose
+	// opRemove is a file or directory being deleted, or moved out of a watched directory.
+	opRemove
+	// opDir is a directory being created, or moved into a watched directory.
+	opDir
+	// opOverflow is the loss of events, after which the directories must be rescanned.
+	opOverflow
+)
+
+// event is a change of the file at path.
+type event struct {
+	path string
+	op   op
+}
+
+// notifier reports the changes of the files in the directories added to it, but not in their subdirectories.
+type notifier interface {
+	add(dir string) error
+	// events returns the channel of events, which is closed if the notifier fails.
+	events() <-chan event
+	// err returns the error the notifier failed with.
+	err() error
+	close() error
+}
+
+// entry is the state of a processed file.
+type entry struct {
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Partial   bool   `json:"partial,omitempty"`
+	Failed    bool   `json:"failed,omitempty"`
+}
+
+// state is the persistent state of the watched files, keyed by their paths.
+type state struct {
+	path  string
+	Files map[string]*entry `json:"files"`
+	dirty bool
+}
+
+// loadState loads the state from the file at the path, returning an empty state if it doesn't exist.
+func loadState(path string) (*state, error) {
+	s := &state{path: path, Files: make(map[string]*entry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*entry)
+	}
+	return s, nil
+}
+
+// save atomically writes the state to its file, if it changed.
+func (s *state) save() error {
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err == nil {
+		s.dirty = false
+	}
+	return err
+}
+
+// unchanged reports whether the file was processed with its current size and modification time, and its thumbnail
+// still exists (or it failed, or has no thumbnail).
+func (s *state) unchanged(path string, fi fs.FileInfo) bool {
+	e, ok := s.Files[path]
+	if !ok || e.Partial || e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano() {
+		return false
+	}
+	if e.Failed || e.Thumbnail == "" {
+		return true
+	}
+	_, err := os.Stat(e.Thumbnail)
+	return err == nil
+}
+
+// pending is a file being written.
+type pending struct {
+	first, last     time.Time
+	closed, partial bool
+}
+
+// debouncer tracks the files being written, until they settle: they're closed by their writers, or aren't written to
+// for the settle duration.
+type debouncer struct {
+	settle time.Duration
+	files  map[string]*pending
+}
+
+func newDebouncer(settle time.Duration) *debouncer {
+	return &debouncer{settle: settle, files: make(map[string]*pending)}
+}
+
+func (d *debouncer) get(path string, now time.Time) *pending {
+	p, ok := d.files[path]
+	if !ok {
+		p = &pending{first: now}
+		d.files[path] = p
+	}
+	p.last = now
+	return p
+}
+
+// write records a write to the file.
+func (d *debouncer) write(path string, now time.Time) {
+	d.get(path, now).closed = false
+}
+
+// close records the file being closed by its writer.
+func (d *debouncer) close(path string, now time.Time) {
+	d.get(path, now).closed = true
+}
+
+// remove forgets the file, or the files in the directory.
+func (d *debouncer) remove(path string) {
+	prefix := path + string(filepath.Separator)
+	for p := range d.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(d.files, p)
+		}
+	}
+}
+
+// due returns the settled files, forgetting them, and the files that haven't settled after being written to for the
+// settle duration, which are only returned once.
+func (d *debouncer) due(now time.Time) (settled, growing []string) {
+	for path, p := range d.files {
+		switch {
+		case p.closed || now.Sub(p.last) >= d.settle:
+			settled = append(settled, path)
+			delete(d.files, path)
+		case !p.partial && now.Sub(p.first) >= d.settle:
+			growing = append(growing, path)
+			p.partial = true
+		}
+	}
+	sort.Strings(settled)
+	sort.Strings(growing)
+	return settled, growing
+}
+
+// watchJob is a job of the watcher, which creates a preliminary thumbnail if partial is set, and recreates the
+// thumbnail even if it's newer than the file if force is set.
+type watchJob struct {
+	job
+	partial, force bool
+}
+
+// watchResult is the outcome of a watchJob, with the file's info before it was processed, which is nil if it no
+// longer exists, and a nil result if nothing was done.
+type watchResult struct {
+	watchJob
+	fi  fs.FileInfo
+	res *result
+}
+
+// watcher keeps the thumbnails of directories up to date. All of its fields are owned by the goroutine running
+// watchDirs, except for the options and the notifier.
+type watcher struct {
+	*options
+	roots   []string
+	out     string
+	n       notifier
+	state   *state
+	pending *debouncer
+	// running holds the files being processed, and again those that settled again meanwhile.
+	running, again map[string]bool
+	queue          []watchJob
+	enc            *json.Encoder
+}
+
+// watchDirs watches the directories at the paths, keeping their thumbnails up to date until the context is done.
+func (o *options) watchDirs(ctx context.Context, paths []string) error {
+	w := &watcher{
+		options: o,
+		pending: newDebouncer(o.settle),
+		running: make(map[string]bool),
+		again:   make(map[string]bool),
+	}
+	var err error
+	if w.out, err = filepath.Abs(o.out); err != nil {
+		return err
+	}
+	// The thumbnails' paths are kept in the state, so they must not depend on the working directory.
+	o.out = w.out
+	for _, path := range paths {
+		root, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(root); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return errors.New("not a directory: " + path)
+		}
+		w.roots = append(w.roots, root)
+	}
+	statePath := o.state
+	if statePath == "" {
+		statePath = filepath.Join(o.out, ".state.json")
+	}
+	if w.state, err = loadState(statePath); err != nil {
+		return err
+	}
+	report, closeReport, err := o.openReport()
+	if err != nil {
+		return err
+	}
+	defer closeReport()
+	w.enc = json.NewEncoder(report)
+	if w.n, err = newNotifier(); err != nil {
+		return err
+	}
+	defer w.n.close()
+	if err = w.scanAll(time.Now()); err != nil {
+		return err
+	}
+	t := thumbnailer.New(thumbnailer.Config{MaxConcurrent: o.concurrency})
+	defer t.Close()
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan watchJob)
+		results = make(chan watchResult)
+	)
+	wg.Add(o.concurrency)
+	for i := 0; i < o.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- o.processWatched(ctx, t, j)
+			}
+		}()
+	}
+	tick := o.settle / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+loop:
+	for {
+		var (
+			send chan<- watchJob
+			next watchJob
+		)
+		if len(w.queue) > 0 {
+			send, next = jobs, w.queue[0]
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case ev, ok := <-w.n.events():
+			if !ok {
+				err = w.n.err()
+				break loop
+			}
+			if err = w.handle(ev, time.Now()); err != nil {
+				break loop
+			}
+		case now := <-ticker.C:
+			w.dispatch(now)
+			if err = w.state.save(); err != nil {
+				break loop
+			}
+		case send <- next:
+			w.queue = w.queue[1:]
+			w.running[next.path] = true
+		case r := <-results:
+			w.record(r)
+		}
+	}
+	close(jobs)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for r := range results {
+		w.record(r)
+	}
+	if sErr := w.state.save(); err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// processWatched processes the job, recording the file's info beforehand.
+func (o *options) processWatched(ctx context.Context, t *thumbnailer.Thumbnailer, j watchJob) watchResult {
+	r := watchResult{watchJob: j}
+	if fi, err := os.Stat(j.path); err == nil {
+		r.fi = fi
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return r
+	}
+	switch {
+	case j.partial:
+		r.res = o.partial(ctx, t, j.job)
+	case j.force:
+		forced := *o
+		forced.force = true
+		r.res = forced.process(ctx, t, j.job)
+	default:
+		r.res = o.process(ctx, t, j.job)
+	}
+	return r
+}
+
+// partial creates a preliminary thumbnail of a video that's still being written, from its beginning, as FFmpeg isn't
+// allowed to seek its end. It returns nil if the file isn't a video.
+func (o *options) partial(ctx context.Context, t *thumbnailer.Thumbnailer, j job) *result {
+	start, res := time.Now(), &result{Path: j.path, Partial: true}
+	defer func() {
+		res.Elapsed = time.Since(start).Seconds()
+	}()
+	f, err := os.Open(j.path)
+	if err != nil {
+		res.fail(err)
+		return res
+	}
+	defer f.Close()
+	file, err := thumbnailer.FileFromReadSeeker(f, false, j.path)
+	if err != nil {
+		res.fail(err)
+		return res
+	}
+	if !strings.HasPrefix(file.MediaType.MediaType(), "video/") {
+		return nil
+	}
+	o.create(ctx, t, file, filepath.Join(o.out, j.rel), res)
+	return res
+}
+
+// job returns the job of the file at the path, and whether it's in a watched directory, and not in the output one.
+func (w *watcher) job(path string) (job, bool) {
+	if within(path, w.out) {
+		return job{}, false
+	}
+	for _, root := range w.roots {
+		if within(path, root) && path != root {
+			rel, err := filepath.Rel(root, path)
+			return job{path, rel}, err == nil
+		}
+	}
+	return job{}, false
+}
+
+// within reports whether the path is the directory or in it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// scanAll scans the watched directories, and removes the thumbnails of the files that no longer exist in them.
+func (w *watcher) scanAll(now time.Time) error {
+	seen := make(map[string]bool)
+	for _, root := range w.roots {
+		if err := w.scan(root, now, seen); err != nil {
+			return err
+		}
+	}
+	for path := range w.state.Files {
+		if _, ok := w.job(path); ok && !seen[path] {
+			w.remove(path)
+		}
+	}
+	return nil
+}
+
+// scan watches the directory and its subdirectories, except for the output directory, and marks the files that
+// changed since they were processed as written to, adding them to seen.
+func (w *watcher) scan(dir string, now time.Time, seen map[string]bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path == w.out {
+				return filepath.SkipDir
+			}
+			return w.n.add(path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		seen[path] = true
+		if fi, err := d.Info(); err == nil && !w.state.unchanged(path, fi) && !w.running[path] {
+			w.pending.write(path, now)
+		}
+		return nil
+	})
+}
+
+// handle handles the event.
+func (w *watcher) handle(ev event, now time.Time) error {
+	if ev.op == opOverflow {
+		return w.scanAll(now)
+	}
+	if _, ok := w.job(ev.path); !ok {
+		return nil
+	}
+	switch ev.op {
+	case opWrite:
+		w.pending.write(ev.path, now)
+	case opClose:
+		w.pending.close(ev.path, now)
+	case opRemove:
+		w.pending.remove(ev.path)
+		w.remove(ev.path)
+		// The mirrored directory of a removed directory may be left empty by failed thumbnails.
+		if j, ok := w.job(ev.path); ok {
+			_ = os.Remove(filepath.Join(w.out, j.rel))
+		}
+	case opDir:
+		err := w.scan(ev.path, now, make(map[string]bool))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatch queues the jobs of the settled and growing files. Files being processed are queued again afterwards. The
+// queued preliminary jobs of settled files are dropped, and the jobs of settled files with preliminary thumbnails are
+// forced, as those are usually newer than the files, which would otherwise be skipped as up to date.
+func (w *watcher) dispatch(now time.Time) {
+	settled, growing := w.pending.due(now)
+	for _, path := range settled {
+		if w.running[path] {
+			w.again[path] = true
+			continue
+		}
+		j, ok := w.job(path)
+		if !ok {
+			continue
+		}
+		w.unqueue(path)
+		e := w.state.Files[path]
+		w.queue = append(w.queue, watchJob{job: j, force: e != nil && e.Partial})
+	}
+	for _, path := range growing {
+		if j, ok := w.job(path); ok && !w.running[path] {
+			w.queue = append(w.queue, watchJob{job: j, partial: true})
+		}
+	}
+}
+
+// unqueue drops the queued jobs of the file.
+func (w *watcher) unqueue(path string) {
+	queue := w.queue[:0]
+	for _, j := range w.queue {
+		if j.path != path {
+			queue = append(queue, j)
+		}
+	}
+	w.queue = queue
+}
+
+// record records the result of a job in the state and the report.
+func (w *watcher) record(r watchResult) {
+	delete(w.running, r.path)
+	if w.again[r.path] {
+		delete(w.again, r.path)
+		w.pending.close(r.path, time.Now())
+	}
+	if r.res != nil {
+		_ = w.enc.Encode(r.res)
+	}
+	if _, err := os.Stat(r.path); r.fi == nil || errors.Is(err, fs.ErrNotExist) {
+		w.remove(r.path)
+		return
+	}
+	if r.res == nil || r.res.Kind == thumbnailer.KindCancelled.String() || r.partial && r.res.Thumbnail == nil {
+		return
+	}
+	e := &entry{Size: r.fi.Size(), ModTime: r.fi.ModTime().UnixNano(), Partial: r.partial, Failed: r.res.Error != ""}
+	if r.res.Thumbnail != nil {
+		e.Thumbnail = r.res.Thumbnail.Path
+	}
+	if old, ok := w.state.Files[r.path]; ok && old.Thumbnail != "" && old.Thumbnail != e.Thumbnail {
+		w.removeThumbnail(old.Thumbnail)
+	}
+	w.state.Files[r.path], w.state.dirty = e, true
+}
+
+// remove deletes the thumbnails of the file, or of the files in the directory, and forgets them.
+func (w *watcher) remove(path string) {
+	for p, e := range w.state.Files {
+		if !within(p, path) {
+			continue
+		}
+		if e.Thumbnail != "" {
+			w.removeThumbnail(e.Thumbnail)
+		}
+		delete(w.state.Files, p)
+		w.state.dirty = true
+		_ = w.enc.Encode(&result{Path: p, Removed: true})
+	}
+}
+
+// removeThumbnail deletes the thumbnail, and its parent directories in the output directory that become empty.
+func (w *watcher) removeThumbnail(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	for dir := filepath.Dir(abs); dir != w.out && within(dir, w.out); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ONLYDIR
+
+// inotify is a notifier using inotify(7). Its file descriptor is non-blocking, so that closing f interrupts reads, and
+// must not be obtained with f.Fd, which would make it blocking.
+type inotify struct {
+	fd     int
+	f      *os.File
+	mu     sync.Mutex
+	dirs   map[int32]string
+	ch     chan event
+	closed chan struct{}
+	failed error
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotify{
+		fd:     fd,
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		ch:     make(chan event),
+		closed: make(chan struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotify) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	n.mu.Lock()
+	n.dirs[int32(wd)] = dir
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotify) events() <-chan event {
+	return n.ch
+}
+
+func (n *inotify) err() error {
+	return n.failed
+}
+
+func (n *inotify) close() error {
+	close(n.closed)
+	return n.f.Close()
+}
+
+// read reads the events until the notifier is closed or fails.
+func (n *inotify) read() {
+	defer close(n.ch)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		size, err := n.f.Read(buf)
+		if err != nil {
+			select {
+			case <-n.closed:
+			default:
+				n.failed = err
+			}
+			return
+		}
+		for i := 0; i+syscall.SizeofInotifyEvent <= size; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			name := buf[i+syscall.SizeofInotifyEvent : i+syscall.SizeofInotifyEvent+int(raw.Len)]
+			i += syscall.SizeofInotifyEvent + int(raw.Len)
+			ev, ok := n.event(raw.Wd, raw.Mask, string(bytes.TrimRight(name, "\x00")))
+			if !ok {
+				continue
+			}
+			select {
+			case n.ch <- ev:
+			case <-n.closed:
+				return
+			}
+		}
+	}
+}
+
+// event translates an inotify event, reporting whether it's of interest.
+func (n *inotify) event(wd int32, mask uint32, name string) (event, bool) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return event{op: opOverflow}, true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dir, ok := n.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(n.dirs, wd)
+		return event{}, false
+	}
+	if !ok || name == "" {
+		return event{}, false
+	}
+	ev := event{path: filepath.Join(dir, name)}
+	switch isDir := mask&syscall.IN_ISDIR != 0; {
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		ev.op = opRemove
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		ev.op = opDir
+	case isDir:
+		return event{}, false
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		ev.op = opClose
+	default:
+		ev.op = opWrite
+	}
+	return ev, true
+}
@@ -0,0 +1,60 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotify(t *testing.T) {
+	dir := t.TempDir()
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.add(dir); err != nil {
+		t.Fatal(err)
+	}
+	next := func() event {
+		t.Helper()
+		select {
+		case ev := <-n.events():
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return event{}
+	}
+	file, sub := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "sub")
+	if err = os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []event{{file, opWrite}, {file, opWrite}, {file, opClose}} {
+		if ev := next(); ev != want {
+			t.Fatalf("event = %v, want %v", ev, want)
+		}
+	}
+	if err = os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev != (event{sub, opDir}) {
+		t.Errorf("event = %v, want directory creation", ev)
+	}
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev != (event{file, opRemove}) {
+		t.Errorf("event = %v, want removal", ev)
+	}
+	if err = n.close(); err != nil {
+		t.Fatal(err)
+	}
+	for range n.events() {
+	}
+	if err = n.err(); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
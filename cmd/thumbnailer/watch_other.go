@@ -0,0 +1,10 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// newNotifier fails, as watching directories relies on inotify.
+func newNotifier() (notifier, error) {
+	return nil, errors.New("watching directories is only supported on Linux")
+}
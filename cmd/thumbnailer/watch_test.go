@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeNotifier struct {
+	dirs []string
+}
+
+func (n *fakeNotifier) add(dir string) error {
+	n.dirs = append(n.dirs, dir)
+	return nil
+}
+
+func (n *fakeNotifier) events() <-chan event { return nil }
+func (n *fakeNotifier) err() error           { return nil }
+func (n *fakeNotifier) close() error         { return nil }
+
+func TestDebouncer(t *testing.T) {
+	d, now := newDebouncer(time.Second), time.Now()
+	d.write("closed", now)
+	d.close("closed", now.Add(100*time.Millisecond))
+	d.write("quiet", now)
+	d.write("growing", now)
+	for _, tc := range []struct {
+		at               time.Duration
+		write            bool
+		settled, growing []string
+	}{
+		{200 * time.Millisecond, true, []string{"closed"}, nil},
+		{800 * time.Millisecond, true, nil, nil},
+		{time.Second, true, []string{"quiet"}, []string{"growing"}},
+		{1500 * time.Millisecond, true, nil, nil},
+		{2400 * time.Millisecond, false, nil, nil},
+		{2500 * time.Millisecond, false, []string{"growing"}, nil},
+	} {
+		if tc.write {
+			d.write("growing", now.Add(tc.at))
+		}
+		settled, growing := d.due(now.Add(tc.at))
+		if !reflect.DeepEqual(settled, tc.settled) || !reflect.DeepEqual(growing, tc.growing) {
+			t.Errorf("%v: due = %v, %v, want %v, %v", tc.at, settled, growing, tc.settled, tc.growing)
+		}
+	}
+	d.write("dir/a", now)
+	d.write("dir/b", now)
+	d.write("directory", now)
+	d.remove("dir")
+	if settled, _ := d.due(now.Add(time.Hour)); !reflect.DeepEqual(settled, []string{"directory"}) {
+		t.Errorf("settled after remove = %v", settled)
+	}
+}
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+	s, err := loadState(path)
+	if err != nil || len(s.Files) != 0 {
+		t.Fatalf("loadState = %v, %v", s, err)
+	}
+	s.Files["/src/a.jpg"] = &entry{Size: 1, ModTime: 2, Thumbnail: "/out/a.jpg.jpg"}
+	s.dirty = true
+	if err = s.save(); err != nil || s.dirty {
+		t.Fatalf("save = %v, dirty = %v", err, s.dirty)
+	}
+	loaded, err := loadState(path)
+	if err != nil || !reflect.DeepEqual(loaded.Files, s.Files) {
+		t.Errorf("loaded %v, %v", loaded.Files, err)
+	}
+}
+
+func newTestWatcher(t *testing.T) (*watcher, *fakeNotifier) {
+	t.Helper()
+	root := t.TempDir()
+	n := new(fakeNotifier)
+	out := filepath.Join(root, "out")
+	return &watcher{
+		options: &options{out: out},
+		roots:   []string{root},
+		out:     out,
+		n:       n,
+		state:   &state{path: filepath.Join(out, ".state.json"), Files: make(map[string]*entry)},
+		pending: newDebouncer(time.Second),
+		running: make(map[string]bool),
+		again:   make(map[string]bool),
+		enc:     json.NewEncoder(io.Discard),
+	}, n
+}
+
+func TestWatcher(t *testing.T) {
+	w, n := newTestWatcher(t)
+	root, now := w.roots[0], time.Now()
+	for _, name := range []string{"a.jpg", "sub/b.png", "out/stale.jpg"} {
+		touch(t, filepath.Join(root, name), now)
+	}
+	gone := filepath.Join(w.out, "deep", "gone.jpg.jpg")
+	touch(t, gone, now)
+	w.state.Files[filepath.Join(root, "deep", "gone.jpg")] = &entry{Thumbnail: gone}
+	w.state.Files["/elsewhere/c.jpg"] = &entry{Thumbnail: "/elsewhere/c.jpg.jpg"}
+	if err := w.scanAll(now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{root, filepath.Join(root, "sub")}; !reflect.DeepEqual(n.dirs, want) {
+		t.Errorf("watched %v, want %v", n.dirs, want)
+	}
+	if _, err := os.Stat(filepath.Dir(gone)); !os.IsNotExist(err) {
+		t.Errorf("thumbnail of removed file not deleted: %v", err)
+	}
+	if _, err := os.Stat(w.out); err != nil {
+		t.Errorf("output directory deleted: %v", err)
+	}
+	if _, ok := w.state.Files["/elsewhere/c.jpg"]; !ok || len(w.state.Files) != 1 {
+		t.Errorf("state = %v", w.state.Files)
+	}
+	a, b := filepath.Join(root, "a.jpg"), filepath.Join(root, "sub", "b.png")
+	w.running[b] = true
+	if err := w.handle(event{path: filepath.Join(w.out, "x.jpg"), op: opClose}, now); err != nil {
+		t.Fatal(err)
+	}
+	w.dispatch(now.Add(time.Second))
+	if want := []watchJob{{job: job{a, "a.jpg"}}}; !reflect.DeepEqual(w.queue, want) || !w.again[b] {
+		t.Fatalf("queue = %v, again = %v", w.queue, w.again)
+	}
+	thumb := filepath.Join(w.out, "a.jpg.jpg")
+	touch(t, thumb, now)
+	fi, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.record(watchResult{w.queue[0], fi, &result{Path: a, Thumbnail: &thumbnail{Path: thumb}}})
+	if fi, err = os.Stat(b); err != nil {
+		t.Fatal(err)
+	}
+	w.record(watchResult{watchJob{job: job{b, "sub/b.png"}}, fi, nil})
+	if e := w.state.Files[a]; e == nil || e.Thumbnail != thumb || e.Size != fi.Size() || !w.state.dirty {
+		t.Errorf("entry = %+v", e)
+	}
+	if w.running[b] || w.again[b] {
+		t.Error("result not recorded")
+	}
+	w.queue = nil
+	if err = w.scanAll(now); err != nil {
+		t.Fatal(err)
+	}
+	var pending []string
+	for path := range w.pending.files {
+		pending = append(pending, path)
+	}
+	sort.Strings(pending)
+	if want := []string{b}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("pending = %v, want %v", pending, want)
+	}
+	if err = w.handle(event{path: a, op: opRemove}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(thumb); !os.IsNotExist(err) || w.state.Files[a] != nil {
+		t.Errorf("thumbnail of removed file not deleted: %v", err)
+	}
+}
+
+func TestWatcherPartial(t *testing.T) {
+	w, _ := newTestWatcher(t)
+	root, now := w.roots[0], time.Now()
+	a, b := filepath.Join(root, "a.mp4"), filepath.Join(root, "b.mp4")
+	w.state.Files[a] = &entry{Thumbnail: filepath.Join(w.out, "a.mp4.jpg"), Partial: true}
+	w.queue = []watchJob{{job: job{b, "b.mp4"}, partial: true}}
+	w.pending.close(a, now)
+	w.pending.close(b, now)
+	w.dispatch(now)
+	want := []watchJob{{job: job{a, "a.mp4"}, force: true}, {job: job{b, "b.mp4"}}}
+	if !reflect.DeepEqual(w.queue, want) {
+		t.Errorf("queue = %v, want %v", w.queue, want)
+	}
+}
@@ -0,0 +1,95 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrorKind classifies the errors returned by this package. It implements the error interface, so that a ThumbError
+// (or any error wrapping one) can be matched against a kind with errors.Is, e.g. errors.Is(err, KindCorruptData).
+type ErrorKind int
+
+// Possible values for ErrorKind. KindInternal is used for errors that fit no other kind.
+const (
+	KindInternal ErrorKind = iota
+	KindUnsupportedFormat
+	KindCorruptData
+	KindTooLarge
+	KindCancelled
+	KindIO
+	KindDecoderMissing
+	KindResourceExhausted
+	KindTimeout
+)
+
+var kindNames = [...]string{
+	"internal",
+	"unsupported format",
+	"corrupt data",
+	"too large",
+	"cancelled",
+	"I/O failure",
+	"decoder missing",
+	"resource exhausted",
+	"timeout",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "unknown"
+	}
+	return kindNames[k]
+}
+
+func (k ErrorKind) Error() string { return "thumbnailer: " + k.String() }
+
+// KindOf returns the ErrorKind of a non-nil error returned by this package. Besides ThumbErrors, it classifies
+// exceeding Limits.MaxDecodeTime as KindTimeout, the other LimitErrors and SpillLimitErrors as KindTooLarge, context
+// errors as KindCancelled, and the errors of the io and os packages as KindIO. Anything else is KindInternal.
+func KindOf(err error) ErrorKind {
+	var tErr *ThumbError
+	switch {
+	case errors.As(err, &tErr):
+		return tErr.Kind
+	case errors.Is(err, ErrDecodeTimeout):
+		return KindTimeout
+	case errors.Is(err, ErrTooManyPixels), errors.Is(err, ErrTooManyPages), errors.Is(err, ErrInputTooLarge),
+		errors.Is(err, ErrVideoTooLarge), errors.As(err, new(*SpillLimitError)):
+		return KindTooLarge
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return KindCancelled
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrShortWrite), errors.Is(err, io.ErrClosedPipe),
+		errors.As(err, new(*os.PathError)), errors.As(err, new(*os.SyscallError)):
+		return KindIO
+	}
+	return KindInternal
+}
+
+// ioError wraps an error returned by the File's io.Reader or io.Seeker while a library was reading it.
+func ioError(library string, err error) *ThumbError {
+	kind := KindIO
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		kind = KindCancelled
+	}
+	return &ThumbError{Library: library, Err: err.Error(), Kind: kind, Wrapped: err}
+}
+
+// kind classifies a vips error by the stage of the call that failed, falling back to its domain and message (which
+// calls don't always get, see callError) to tell memory exhaustion and decoding errors apart from the rest.
+func (e vipsError) kind() ErrorKind {
+	domain, msg := strings.ToLower(e.domain), strings.ToLower(e.error)
+	switch {
+	case e.stage == stageUnsupported, strings.Contains(msg, "not a known file format"),
+		strings.Contains(msg, "does not support"):
+		return KindUnsupportedFormat
+	case strings.Contains(msg, "out of memory"), strings.Contains(msg, "unable to allocate"):
+		return KindResourceExhausted
+	case e.stage == stageLoad, strings.Contains(domain, "load"), strings.Contains(domain, "2vips"),
+		strings.Contains(domain, "jpeg"), strings.Contains(domain, "png"):
+		return KindCorruptData
+	}
+	return KindInternal
+}
@@ -0,0 +1,109 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type failingReadSeeker struct {
+	io.ReadSeeker
+	n   int64
+	err error
+}
+
+func (r *failingReadSeeker) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.ReadSeeker.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"InvalidData", ErrInvalidData, KindCorruptData},
+		{"FileFormatNotSupported", ErrFileFormatNotSupported, KindUnsupportedFormat},
+		{"AnimatedWEBPNotSupported", ErrAnimatedWEBPNotSupported, KindUnsupportedFormat},
+		{"DecoderNotFound", avErrorToThumbError(avErrDecoderNotFound), KindDecoderMissing},
+		{"NoMem", avErrorToThumbError(avErrNoMem), KindResourceExhausted},
+		{"TooBig", avErrorToThumbError(errTooBig), KindTooLarge},
+		{"Exit", avErrorToThumbError(avErrExit), KindCancelled},
+		{"MemoryBudget", ErrMemoryBudgetExceeded, KindResourceExhausted},
+		{"Limit", &LimitError{Limit: LimitPixels, Value: 2, Max: 1}, KindTooLarge},
+		{"DecodeTimeout", &LimitError{Limit: LimitDecodeTime, Value: 2, Max: 1}, KindTimeout},
+		{"VIPSUnsupported", vipsErrorToThumbError(vipsError{domain: "thumbnailer", stage: stageUnsupported}),
+			KindUnsupportedFormat},
+		{"VIPSLoad", vipsErrorToThumbError(vipsError{domain: "thumbnailer", stage: stageLoad}), KindCorruptData},
+		{"Spill", &SpillLimitError{MaxSize: 1}, KindTooLarge},
+		{"Context", context.Canceled, KindCancelled},
+		{"PathError", &os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, KindIO},
+		{"Wrapped", ioError("vips", context.DeadlineExceeded), KindCancelled},
+		{"Other", errors.New("other"), KindInternal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := KindOf(test.err); got != test.want {
+				t.Errorf("KindOf() want = %v, got = %v", test.want, got)
+			}
+			if _, ok := test.err.(*ThumbError); ok && !errors.Is(test.err, test.want) {
+				t.Errorf("errors.Is(%v, %v) = false", test.err, test.want)
+			}
+		})
+	}
+	if !errors.Is(&ThumbError{Library: "ffmpeg", Err: ErrInvalidData.Err, Code: ErrInvalidData.Code}, ErrInvalidData) {
+		t.Errorf("errors.Is() with an equal ThumbError = false")
+	}
+	if errors.Is(ErrDecodeTimeout, KindTooLarge) || !errors.Is(ErrDecodeTimeout, KindTimeout) {
+		t.Errorf("errors.Is(%v) matches the wrong kind", ErrDecodeTimeout)
+	}
+}
+
+func TestCreateThumbnailReadError(t *testing.T) {
+	wantErr := errors.New("read error")
+	for _, filename := range []string{"trollface.png", "schizo_0.mp4"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("os.Open() error = %v", err)
+			}
+			defer f.Close()
+			file, err := FileFromReadSeeker(&failingReadSeeker{f, probeSize + 1<<12, wantErr}, true, filename)
+			if err != nil {
+				t.Fatalf("FileFromReadSeeker() error = %v", err)
+			}
+			if err = CreateThumbnail(file.ToWriter(io.Discard, 256)); !errors.Is(err, KindIO) || !errors.Is(err, wantErr) {
+				t.Errorf("CreateThumbnail() error = %v, want = %v of kind %v", err, wantErr, KindIO)
+			}
+		})
+	}
+}
+
+func TestCreateThumbnailCancelled(t *testing.T) {
+	f, err := os.Open(filepath.Join("fixtures", "schizo_0.mp4"))
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	file, err := FileFromReadSeeker(f, true, "schizo_0.mp4")
+	if err != nil {
+		t.Fatalf("FileFromReadSeeker() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = CreateThumbnailWithContext(ctx, file.ToWriter(io.Discard, 256))
+	if !errors.Is(err, KindCancelled) || !errors.Is(err, context.Canceled) || errors.Is(err, KindIO) {
+		t.Errorf("CreateThumbnailWithContext() error = %v, want = %v of kind %v", err, context.Canceled, KindCancelled)
+	}
+}
@@ -142,7 +142,7 @@ static int open_codec(AVCodecContext *codec_ctx, AVCodec *codec) {
     return err;
 }
 
-int create_codec_context(AVStream *video_stream, AVCodecContext **dec_ctx) {
+int create_codec_context(AVStream *video_stream, AVCodecContext **dec_ctx, void *opaque) {
     AVCodec *dec = NULL;
     AVCodecParameters *par = video_stream->codecpar;
     if (par->codec_id == AV_CODEC_ID_VP8) {
@@ -159,12 +159,13 @@ int create_codec_context(AVStream *video_stream, AVCodecContext **dec_ctx) {
     if (par->format == -1) {
         return AVERROR_INVALIDDATA;
     }
-    if (av_get_bits_per_pixel(av_pix_fmt_desc_get(par->format)) * par->height * par->width > 1 << 30) {
+    if ((int64_t) av_get_bits_per_pixel(av_pix_fmt_desc_get(par->format)) * par->height * par->width > 1 << 30) {
         return ERR_TOO_BIG;
     }
     if (!(*dec_ctx = avcodec_alloc_context3(dec))) {
         return AVERROR(ENOMEM);
     }
+    (*dec_ctx)->opaque = opaque;
     int err = avcodec_parameters_to_context(*dec_ctx, par);
     if (err < 0) {
         avcodec_free_context(dec_ctx);
@@ -304,6 +305,40 @@ obtain_next_frame(AVFormatContext *fmt_ctx, AVCodecContext *dec_ctx, int stream_
     return err;
 }
 
+int obtain_frame_at(AVFormatContext *fmt_ctx, AVCodecContext *dec_ctx, int stream_index, int64_t timestamp,
+                    AVPacket *pkt, AVFrame **frame) {
+    AVStream *stream = fmt_ctx->streams[stream_index];
+    int64_t target = av_rescale_q(timestamp, AV_TIME_BASE_Q, stream->time_base);
+    if (stream->start_time != AV_NOPTS_VALUE) {
+        target += stream->start_time;
+    }
+    // Inputs that can't seek are decoded up to the timestamp instead.
+    if (av_seek_frame(fmt_ctx, stream_index, target, AVSEEK_FLAG_BACKWARD) >= 0) {
+        avcodec_flush_buffers(dec_ctx);
+    }
+    AVFrame *last = NULL;
+    while (1) {
+        int err = obtain_next_frame(fmt_ctx, dec_ctx, stream_index, pkt, frame);
+        if (err < 0) {
+            if (err != AVERROR_EOF || !last) {
+                av_frame_free(&last);
+                return err;
+            }
+            // The timestamp is past the last frame, which is used instead.
+            av_frame_free(frame);
+            *frame = last;
+            return 0;
+        }
+        int64_t pts = (*frame)->best_effort_timestamp;
+        av_frame_free(&last);
+        if (pts == AV_NOPTS_VALUE || pts >= target) {
+            return 0;
+        }
+        last = *frame;
+        *frame = NULL;
+    }
+}
+
 int64_t find_duration(AVFormatContext *fmt_ctx) {
     AVPacket pkt = create_packet();
     int err = 0;
@@ -322,27 +357,65 @@ int64_t find_duration(AVFormatContext *fmt_ctx) {
     return err;
 }
 
-ThumbContext *create_thumb_context(AVStream *stream, AVFrame *frame) {
-    ThumbContext *thumb_ctx = av_mallocz(sizeof *thumb_ctx);
-    if (!thumb_ctx) {
-        return thumb_ctx;
+// max_frames returns the number of frames to sample, or 0 if a frame's size is unknown or too big to be decoded.
+static int max_frames(AVStream *stream, const AVPixFmtDescriptor *desc, int width, int height) {
+    int64_t frame_bits = (int64_t) av_get_bits_per_pixel(desc) * height * width;
+    if (frame_bits <= 0 || frame_bits > 1 << 30) {
+        return 0;
     }
-//    thumb_ctx->n = 0;
-    thumb_ctx->desc = av_pix_fmt_desc_get(frame->format);
     int nb_frames = 100;
     if (stream->disposition & AV_DISPOSITION_ATTACHED_PIC) {
         nb_frames = 1;
     } else if (stream->nb_frames && stream->nb_frames < 400) {
         nb_frames = (int) (stream->nb_frames >> 2) + 1;
     }
-    int frames_in_128mb = (1 << 30) / (av_get_bits_per_pixel(thumb_ctx->desc) * frame->height * frame->width);
-    thumb_ctx->max_frames = FFMIN(nb_frames, frames_in_128mb);
-//    thumb_ctx->hist_size = 0;
-//    thumb_ctx->alpha = 0;
+    return FFMIN(nb_frames, (int) ((1 << 30) / frame_bits));
+}
+
+static size_t hist_size(const AVPixFmtDescriptor *desc) {
+    size_t size = 0;
     int i;
-    for (i = 0; i < thumb_ctx->desc->nb_components; i++) {
-        thumb_ctx->hist_size += 1 << thumb_ctx->desc->comp[i].depth;
+    for (i = 0; i < desc->nb_components; i++) {
+        size += 1 << desc->comp[i].depth;
     }
+    return size;
+}
+
+int64_t thumb_memory(AVStream *stream) {
+    int width = stream->codecpar->width, height = stream->codecpar->height;
+    const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(stream->codecpar->format);
+    if (!desc || !av_get_bits_per_pixel(desc)) {
+        desc = av_pix_fmt_desc_get(AV_PIX_FMT_RGBA);
+    }
+    if (width <= 0 || height <= 0) {
+        return 0;
+    }
+    int64_t frame_size = (int64_t) av_get_bits_per_pixel(desc) * width * height / 8;
+    size_t hist = hist_size(desc);
+    int n = max_frames(stream, desc, width, height);
+    if (!n) {
+        // The decoder fails with ERR_TOO_BIG.
+        return 0;
+    }
+    return n * (frame_size + (int64_t) (hist * sizeof(int))) + (int64_t) (hist * sizeof(double)) +
+           (int64_t) 4 * width * height;
+}
+
+int thumb_frames(AVStream *stream, AVFrame *frame) {
+    return max_frames(stream, av_pix_fmt_desc_get(frame->format), frame->width, frame->height);
+}
+
+ThumbContext *create_thumb_context(AVStream *stream, AVFrame *frame) {
+    ThumbContext *thumb_ctx = av_mallocz(sizeof *thumb_ctx);
+    if (!thumb_ctx) {
+        return thumb_ctx;
+    }
+//    thumb_ctx->n = 0;
+    thumb_ctx->desc = av_pix_fmt_desc_get(frame->format);
+    thumb_ctx->max_frames = max_frames(stream, thumb_ctx->desc, frame->width, frame->height);
+//    thumb_ctx->alpha = 0;
+    thumb_ctx->hist_size = hist_size(thumb_ctx->desc);
+    int i;
     thumb_ctx->median = av_mallocz_array(thumb_ctx->hist_size, sizeof(double));
     if (!thumb_ctx->median) {
         av_free(thumb_ctx);
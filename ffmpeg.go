@@ -7,9 +7,12 @@ package thumbnailer
 import "C"
 import (
 	"context"
+	"errors"
 	"io"
+	"os"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -27,12 +30,11 @@ func readCallback(opaque unsafe.Pointer, buf *C.uint8_t, bufSize C.int) C.int {
 	if n > 0 || err == nil {
 		return C.int(n)
 	}
-	switch err {
-	case io.EOF:
+	if err == io.EOF {
 		return C.int(avErrEOF)
-	default:
-		return C.int(avErrUnknown)
 	}
+	ctx.setErr(err)
+	return C.int(avErrorFromGo(err))
 }
 
 ////export writeCallback
@@ -56,7 +58,7 @@ func seekCallback(opaque unsafe.Pointer, offset C.int64_t, whence C.int) C.int64
 		return C.int64_t(avErrUnknown)
 	}
 	if !ctx.file.SeekEnd && whence >= C.SEEK_END {
-		f, ok := ctx.file.Reader.(*seekstream.File)
+		f, ok := unwrapReader(ctx.file.Reader).(*seekstream.File)
 		if !ok || !f.IsDone() {
 			return C.int64_t(avErrUnknown)
 
@@ -69,7 +71,8 @@ func seekCallback(opaque unsafe.Pointer, offset C.int64_t, whence C.int) C.int64
 	}
 	n, err := ctx.file.Seek(int64(offset), int(whence))
 	if err != nil {
-		return C.int64_t(avErrUnknown)
+		ctx.setErr(err)
+		return C.int64_t(avErrorFromGo(err))
 	}
 	return C.int64_t(n)
 }
@@ -79,6 +82,7 @@ func interruptCallback(opaque unsafe.Pointer) C.int {
 	if ctx, ok := ctxMap.context(opaque); ok {
 		select {
 		case <-ctx.context.Done():
+			ctx.setErr(ctx.context.Err())
 			return 1
 		default:
 			return 0
@@ -132,7 +136,37 @@ type avContext struct {
 	codecContext     *C.AVCodecContext
 	thumbContext     *C.ThumbContext
 	frame            *C.AVFrame
+	frames           int
+	decodeSpan       Span
 	durationInFormat bool
+	errMu            sync.Mutex
+	err              error
+}
+
+// setErr records the first error returned by the File's io.Reader or io.Seeker, or the context, to FFmpeg.
+func (ctx *avContext) setErr(err error) {
+	ctx.errMu.Lock()
+	if ctx.err == nil {
+		ctx.err = err
+	}
+	ctx.errMu.Unlock()
+}
+
+// wrapErr replaces an FFmpeg error caused by an error recorded by setErr with a ThumbError wrapping the latter, of
+// KindCancelled if it's a context error (in which case FFmpeg usually reports AVERROR_EXIT), or KindIO otherwise.
+func (ctx *avContext) wrapErr(err error) error {
+	avErr, ok := err.(avError)
+	if !ok {
+		return err
+	}
+	ctx.errMu.Lock()
+	defer ctx.errMu.Unlock()
+	if ctx.err == nil {
+		return err
+	}
+	tErr := ioError("ffmpeg", ctx.err)
+	tErr.Code = int(avErr)
+	return tErr
 }
 
 type avError int
@@ -143,9 +177,68 @@ const (
 	avErrUnknown         = avError(C.AVERROR_UNKNOWN)
 	avErrDecoderNotFound = avError(C.AVERROR_DECODER_NOT_FOUND)
 	avErrInvalidData     = avError(C.AVERROR_INVALIDDATA)
+	avErrPipe            = avError(-C.EPIPE)
+	avErrSPipe           = avError(-C.ESPIPE)
+	avErrIO              = avError(-C.EIO)
+	avErrExit            = avError(C.AVERROR_EXIT)
+	avErrDemuxerNotFound = avError(C.AVERROR_DEMUXER_NOT_FOUND)
+	avErrStreamNotFound  = avError(C.AVERROR_STREAM_NOT_FOUND)
+	avErrPatchWelcome    = avError(C.AVERROR_PATCHWELCOME)
 	errTooBig            = avError(C.ERR_TOO_BIG)
 )
 
+// seekRequired reports whether an error returned by ffmpegThumbnail for a non-seekable input is likely caused by the
+// demuxer needing to seek, e.g. an MP4 or MOV file with the moov atom at the end.
+func seekRequired(err error) bool {
+	switch err {
+	case avErrInvalidData, avErrEOF, avErrPipe, avErrSPipe:
+		return true
+	default:
+		return false
+	}
+}
+
+// avErrorFromGo converts an error returned by the File's io.Reader or io.Seeker into the closest FFmpeg error code,
+// instead of flattening it into AVERROR_UNKNOWN.
+func avErrorFromGo(err error) avError {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return avErrExit
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return avErrEOF
+	case errors.Is(err, os.ErrPermission):
+		return avError(-C.EACCES)
+	case errors.Is(err, os.ErrNotExist):
+		return avError(-C.ENOENT)
+	case os.IsTimeout(err):
+		return avError(-C.ETIMEDOUT)
+	case errors.As(err, &errno):
+		return avError(-int(errno))
+	}
+	return avErrIO
+}
+
+func (e avError) kind() ErrorKind {
+	switch e {
+	case avErrInvalidData, avErrEOF:
+		return KindCorruptData
+	case avErrDecoderNotFound:
+		return KindDecoderMissing
+	case avErrDemuxerNotFound, avErrStreamNotFound, avErrPatchWelcome:
+		return KindUnsupportedFormat
+	case avErrNoMem:
+		return KindResourceExhausted
+	case errTooBig:
+		return KindTooLarge
+	case avErrExit:
+		return KindCancelled
+	case avErrIO, avErrPipe, avErrSPipe, avError(-C.EACCES), avError(-C.ENOENT), avError(-C.ETIMEDOUT):
+		return KindIO
+	}
+	return KindInternal
+}
+
 func (e avError) errorString() string {
 	if e == avErrNoMem {
 		return "cannot allocate memory"
@@ -183,6 +276,7 @@ func (m *contextMap) set(ctx *avContext) {
 }
 
 func (m *contextMap) delete(ctx *avContext) {
+	logFFmpeg(ffmpegLines.flush(unsafe.Pointer(ctx.formatContext)))
 	m.Lock()
 	delete(m.m, ctx.formatContext)
 	m.Unlock()
@@ -234,10 +328,17 @@ func fullDuration(ctx *avContext) error {
 	if ctx.durationInFormat {
 		return nil
 	}
+	report := ctx.file.phase(PhaseDuration)
+	_, span := startSpan(ctx.context, "duration")
 	newDuration := time.Duration(C.find_duration(ctx.formatContext))
 	if newDuration < 0 {
+		span.End(avError(newDuration))
+		report(PhaseEvent{Err: avError(newDuration)})
 		return avError(newDuration)
 	}
+	span.SetAttributes("duration", newDuration)
+	span.End(nil)
+	report(PhaseEvent{})
 	if newDuration > ctx.file.Duration {
 		ctx.file.Duration = newDuration
 	}
@@ -262,8 +363,28 @@ func findStreams(ctx *avContext) error {
 	return nil
 }
 
+// setProbeAttributes annotates the probe span with the streams found.
+func setProbeAttributes(ctx *avContext, span Span) {
+	if ctx.file.Duration > 0 {
+		span.SetAttributes("duration", ctx.file.Duration)
+	}
+	if ctx.file.HasVideo {
+		span.SetAttributes("codec", C.GoString(C.avcodec_get_name(ctx.stream.codecpar.codec_id)),
+			"width", ctx.file.Width, "height", ctx.file.Height)
+	}
+}
+
+// endDecode ends the decode span, if it's still running, annotating it with the number of frames decoded.
+func (ctx *avContext) endDecode(err error) {
+	if ctx.decodeSpan != nil {
+		ctx.decodeSpan.SetAttributes("frames", ctx.frames)
+		ctx.decodeSpan.End(err)
+		ctx.decodeSpan = nil
+	}
+}
+
 func createDecoder(ctx *avContext) error {
-	err := C.create_codec_context(ctx.stream, &ctx.codecContext)
+	err := C.create_codec_context(ctx.stream, &ctx.codecContext, unsafe.Pointer(ctx.formatContext))
 	if err < 0 {
 		return avError(err)
 	}
@@ -290,6 +411,7 @@ func populateHistogram(ctx *avContext, frames <-chan *C.AVFrame) <-chan struct{}
 			n++
 		}
 		ctx.thumbContext.n = n
+		ctx.frames = int(n)
 		done <- struct{}{}
 		close(done)
 	}()
@@ -299,11 +421,19 @@ func populateHistogram(ctx *avContext, frames <-chan *C.AVFrame) <-chan struct{}
 func createThumbContext(ctx *avContext) error {
 	pkt := C.create_packet()
 	var frame *C.AVFrame
-	err := C.obtain_next_frame(ctx.formatContext, ctx.codecContext, ctx.stream.index, &pkt, &frame)
+	var err C.int
+	if frameTime := ctx.file.FrameTime; frameTime > 0 {
+		err = C.obtain_frame_at(ctx.formatContext, ctx.codecContext, ctx.stream.index,
+			C.int64_t(frameTime/time.Microsecond), &pkt, &frame)
+	} else {
+		err = C.obtain_next_frame(ctx.formatContext, ctx.codecContext, ctx.stream.index, &pkt, &frame)
+	}
 	if err >= 0 {
 		incrementDuration(ctx, frame)
-		ctx.thumbContext = C.create_thumb_context(ctx.stream, frame)
-		if ctx.thumbContext == nil {
+		// The decoded frames can be bigger than the stream's parameters claimed.
+		if C.thumb_frames(ctx.stream, frame) == 0 {
+			err = C.ERR_TOO_BIG
+		} else if ctx.thumbContext = C.create_thumb_context(ctx.stream, frame); ctx.thumbContext == nil {
 			err = C.int(avErrNoMem)
 		}
 	}
@@ -317,6 +447,10 @@ func createThumbContext(ctx *avContext) error {
 		return avError(err)
 	}
 	defer C.free_thumb_context(ctx.thumbContext)
+	if ctx.file.FrameTime > 0 {
+		// The selected frame is the only one considered.
+		ctx.thumbContext.max_frames = 1
+	}
 	frames := make(chan *C.AVFrame, ctx.thumbContext.max_frames)
 	done := populateHistogram(ctx, frames)
 	frames <- frame
@@ -350,23 +484,27 @@ func populateThumbContext(ctx *avContext, frames chan *C.AVFrame, done <-chan st
 	if err != 0 && err != C.int(avErrEOF) {
 		return avError(err)
 	}
+	ctx.endDecode(nil)
 	return convertFrameToRGB(ctx)
 }
 
 func convertFrameToRGB(ctx *avContext) error {
+	_, span := startSpan(ctx.context, "select frame")
 	outputFrame := C.convert_frame_to_rgb(C.process_frames(ctx.thumbContext), ctx.thumbContext.alpha)
 	if outputFrame == nil {
+		span.End(avErrNoMem)
 		return avErrNoMem
 	}
 	ctx.frame = outputFrame
 	ctx.file.HasAlpha = ctx.thumbContext.alpha != 0
+	span.End(nil)
 	return nil
 }
 
 func thumbnail(ctx *avContext) <-chan error {
 	errCh := make(chan error)
 	go func() {
-		err := thumbnailFromFFmpeg(ctx.file, ctx.frame.data[0])
+		err := thumbnailFromFFmpeg(ctx.context, ctx.file, ctx.frame.data[0])
 		C.av_frame_free(&ctx.frame)
 		errCh <- err
 		close(errCh)
@@ -374,20 +512,60 @@ func thumbnail(ctx *avContext) <-chan error {
 	return errCh
 }
 
-func ffmpegThumbnail(context context.Context, file *File) error {
-	ctx := &avContext{context: context, file: file}
-	callbackFlags := C.int(readCallbackFlag | interruptCallbackFlag)
+func callbackFlags(file *File) C.int {
+	flags := C.int(readCallbackFlag | interruptCallbackFlag)
 	if file.Seeker != nil {
-		callbackFlags |= seekCallbackFlag
+		flags |= seekCallbackFlag
 	}
-	err := createFormatContext(ctx, callbackFlags)
-	if err != nil {
+	return flags
+}
+
+func ffmpegProbe(context context.Context, file *File) error {
+	ctx := &avContext{context: context, file: file}
+	report := file.phase(PhaseOpen)
+	err := createFormatContext(ctx, callbackFlags(file))
+	if report(PhaseEvent{Err: err}); err != nil {
+		return ctx.wrapErr(err)
+	}
+	freeFormatContext(ctx)
+	return nil
+}
+
+func ffmpegThumbnail(context context.Context, file *File) (err error) {
+	ctx := &avContext{context: context, file: file}
+	defer func() {
+		err = ctx.wrapErr(err)
+	}()
+	report := file.phase(PhaseOpen)
+	_, span := startSpan(context, "probe")
+	err = createFormatContext(ctx, callbackFlags(file))
+	if err == nil {
+		setProbeAttributes(ctx, span)
+	}
+	span.End(err)
+	if report(PhaseEvent{Err: err}); err != nil {
 		return err
 	}
 	if !file.HasVideo {
 		return fullDuration(ctx)
 	}
-	if err = createDecoder(ctx); err == errTooBig || err == avErrDecoderNotFound {
+	width, height, frames := int64(file.Width), int64(file.Height), int64(ctx.stream.nb_frames)
+	if err = file.limits().checkVideo(width, height, frames); err != nil {
+		freeFormatContext(ctx)
+		return err
+	}
+	release, err := budget.reserve(context, int64(C.thumb_memory(ctx.stream)))
+	if err != nil {
+		freeFormatContext(ctx)
+		return err
+	}
+	defer release()
+	report = file.phase(PhaseSample)
+	_, ctx.decodeSpan = startSpan(context, "decode")
+	err = createDecoder(ctx)
+	ctx.endDecode(err)
+	report(PhaseEvent{Frames: ctx.frames, Err: err})
+	if err == errTooBig || err == avErrDecoderNotFound {
 		return fullDuration(ctx)
 	}
 	if err != nil {
@@ -44,7 +44,7 @@ void get_metadata(AVFormatContext *fmt_ctx, char **artist, char **title);
 
 int find_streams(AVFormatContext *fmt_ctx, AVStream **video_stream, int *orientation);
 
-int create_codec_context(AVStream *video_stream, AVCodecContext **dec_ctx);
+int create_codec_context(AVStream *video_stream, AVCodecContext **dec_ctx, void *opaque);
 
 AVFrame *convert_frame_to_rgb(AVFrame *frame, int alpha);
 
@@ -55,8 +55,15 @@ AVPacket create_packet();
 int
 obtain_next_frame(AVFormatContext *fmt_ctx, AVCodecContext *dec_ctx, int stream_index, AVPacket *pkt, AVFrame **frame);
 
+int obtain_frame_at(AVFormatContext *fmt_ctx, AVCodecContext *dec_ctx, int stream_index, int64_t timestamp,
+                    AVPacket *pkt, AVFrame **frame);
+
 int64_t find_duration(AVFormatContext *fmt_ctx);
 
+int64_t thumb_memory(AVStream *stream);
+
+int thumb_frames(AVStream *stream, AVFrame *frame);
+
 ThumbContext *create_thumb_context(AVStream *stream, AVFrame *frame);
 
 void free_thumb_context(ThumbContext *thumb_ctx);
@@ -0,0 +1,366 @@
+// Package freedesktop creates and looks up thumbnails in the shared thumbnail cache of the freedesktop.org Thumbnail
+// Managing Standard, used by Linux desktop file managers.
+package freedesktop
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// Size is the maximum width and height of a thumbnail, as defined by the specification.
+type Size int
+
+// Possible values for Size.
+const (
+	Normal  Size = 128
+	Large   Size = 256
+	XLarge  Size = 512
+	XXLarge Size = 1024
+)
+
+// Sizes lists all the Sizes, from the smallest.
+var Sizes = []Size{Normal, Large, XLarge, XXLarge}
+
+// Dir returns the name of the Size's directory, or an empty string for invalid Sizes.
+func (s Size) Dir() string {
+	switch s {
+	case Normal:
+		return "normal"
+	case Large:
+		return "large"
+	case XLarge:
+		return "x-large"
+	case XXLarge:
+		return "xx-large"
+	}
+	return ""
+}
+
+// Errors returned by Cache.Thumbnail.
+var (
+	ErrInvalidSize = errors.New("freedesktop: invalid thumbnail size")
+	ErrFailed      = errors.New("freedesktop: thumbnailing failed for this version of the file before")
+	ErrNoThumbnail = errors.New("freedesktop: the file has no thumbnail")
+)
+
+// Keys of the PNG text chunks written to thumbnails.
+const (
+	KeyURI         = "Thumb::URI"
+	KeyMTime       = "Thumb::MTime"
+	KeySize        = "Thumb::Size"
+	KeyMime        = "Thumb::Mime"
+	KeyImageWidth  = "Thumb::Image::Width"
+	KeyImageHeight = "Thumb::Image::Height"
+	KeyMovieLength = "Thumb::Movie::Length"
+	KeySoftware    = "Software"
+)
+
+// Config stores the configuration of a Cache. Dir is the root of the thumbnail cache ($XDG_CACHE_HOME/thumbnails, or
+// ~/.cache/thumbnails if unset, if empty), App the name of the application's directory for failures (fail/thumbnailer
+// if empty), Quality the quality of the PNG thumbnails (the thumbnailer's default if 0), and Create the function
+// creating the thumbnails (thumbnailer.CreateThumbnailWithContext if nil).
+type Config struct {
+	Dir, App string
+	Quality  int
+	Create   func(ctx context.Context, file *thumbnailer.File) error
+}
+
+// Cache is a freedesktop.org thumbnail cache. A Cache is safe for concurrent use, as is the thumbnail cache by
+// multiple processes, since thumbnails are written to temporary files and renamed into place.
+type Cache struct {
+	config Config
+}
+
+// New returns a Cache with the supplied Config.
+func New(config Config) (*Cache, error) {
+	if config.Dir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		config.Dir = filepath.Join(dir, "thumbnails")
+	}
+	if config.App == "" {
+		config.App = "thumbnailer"
+	}
+	if config.Create == nil {
+		config.Create = thumbnailer.CreateThumbnailWithContext
+	}
+	return &Cache{config: config}, nil
+}
+
+// URI returns the canonical file URI of the path, made absolute, as hashed into the names of its thumbnails. Bytes
+// outside of the unreserved and path characters are percent-encoded, like GLib's g_filename_to_uri does.
+func URI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	b.WriteString("file://")
+	for i := 0; i < len(abs); i++ {
+		c := abs[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("-_.!~*'()/&=:@+$,", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String(), nil
+}
+
+// Name returns the file name of the thumbnails of the URI: the MD5 hash of the URI in hexadecimal, with a .png
+// extension.
+func Name(uri string) string {
+	sum := md5.Sum([]byte(uri))
+	return hex.EncodeToString(sum[:]) + ".png"
+}
+
+// source is the file a thumbnail is created from.
+type source struct {
+	path, uri, name string
+	mtime, size     int64
+}
+
+func newSource(path string) (*source, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := URI(path)
+	if err != nil {
+		return nil, err
+	}
+	return &source{path: path, uri: uri, name: Name(uri), mtime: fi.ModTime().Unix(), size: fi.Size()}, nil
+}
+
+// valid reports whether the thumbnail at the path was created from the current version of the source.
+func (s *source) valid(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	text, err := ReadText(data)
+	if err != nil || text[KeyURI] != s.uri || text[KeyMTime] != strconv.FormatInt(s.mtime, 10) {
+		return false
+	}
+	size, ok := text[KeySize]
+	return !ok || size == strconv.FormatInt(s.size, 10)
+}
+
+// Path returns the path of the thumbnail of the file at the Size, whether it exists or not.
+func (c *Cache) Path(path string, size Size) (string, error) {
+	if size.Dir() == "" {
+		return "", ErrInvalidSize
+	}
+	uri, err := URI(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.config.Dir, size.Dir(), Name(uri)), nil
+}
+
+func (c *Cache) failPath(s *source) string {
+	return filepath.Join(c.config.Dir, "fail", c.config.App, s.name)
+}
+
+// Lookup returns the path of the thumbnail of the file at the Size, if it exists and is valid: created from a file
+// with the same URI, modification time and size (if recorded).
+func (c *Cache) Lookup(path string, size Size) (string, bool) {
+	if size.Dir() == "" {
+		return "", false
+	}
+	s, err := newSource(path)
+	if err != nil {
+		return "", false
+	}
+	thumb := filepath.Join(c.config.Dir, size.Dir(), s.name)
+	return thumb, s.valid(thumb)
+}
+
+// Failed reports whether creating a thumbnail of the current version of the file failed before.
+func (c *Cache) Failed(path string) bool {
+	s, err := newSource(path)
+	return err == nil && s.valid(c.failPath(s))
+}
+
+// Thumbnail returns the path of the thumbnail of the file at the Size, creating it if there's no valid one. The
+// thumbnail is created as a PNG at most size pixels wide and high, with the text chunks required by the specification
+// (and the dimensions of the image and the length of the video, where they apply), and written atomically with
+// permissions 0600. If the thumbnail can't be created (for a reason other than cancellation, I/O failure or resource
+// exhaustion), or the file has none (ErrNoThumbnail, e.g. for audio without cover art), a failure is recorded in the
+// application's fail directory, and ErrFailed is returned for the same version of the file, until it's modified.
+func (c *Cache) Thumbnail(ctx context.Context, path string, size Size) (string, error) {
+	if size.Dir() == "" {
+		return "", ErrInvalidSize
+	}
+	s, err := newSource(path)
+	if err != nil {
+		return "", err
+	}
+	thumb := filepath.Join(c.config.Dir, size.Dir(), s.name)
+	if s.valid(thumb) {
+		return thumb, nil
+	}
+	if s.valid(c.failPath(s)) {
+		return "", ErrFailed
+	}
+	text, data, err := c.create(ctx, s, size)
+	if err != nil {
+		switch thumbnailer.KindOf(err) {
+		case thumbnailer.KindCancelled, thumbnailer.KindIO, thumbnailer.KindResourceExhausted, thumbnailer.KindTimeout:
+		default:
+			if fail, fErr := failImage(); fErr == nil {
+				_ = writeAtomic(c.failPath(s), fail, text)
+			}
+		}
+		return "", err
+	}
+	if err = writeAtomic(thumb, data, text); err != nil {
+		return "", err
+	}
+	return thumb, nil
+}
+
+// create creates the PNG thumbnail of the source, returning it along with its text chunks, which are returned even
+// if creating it fails.
+func (c *Cache) create(ctx context.Context, s *source, size Size) ([][2]string, []byte, error) {
+	text := [][2]string{
+		{KeyURI, s.uri},
+		{KeyMTime, strconv.FormatInt(s.mtime, 10)},
+		{KeySize, strconv.FormatInt(s.size, 10)},
+		{KeySoftware, "thumbnailer"},
+	}
+	file, err := thumbnailer.FileFromPath(s.path)
+	if err != nil {
+		return text, nil, err
+	}
+	text = append(text, [2]string{KeyMime, file.MediaType.MediaType()})
+	buf := new(bytes.Buffer)
+	if c.config.Quality > 0 {
+		file.ToWriter(buf, int(size), c.config.Quality)
+	} else {
+		file.ToWriter(buf, int(size))
+	}
+	file.Format = thumbnailer.FormatPNG
+	if err = c.config.Create(ctx, file); err != nil {
+		return text, nil, err
+	}
+	if !file.ThumbCreated {
+		return text, nil, ErrNoThumbnail
+	}
+	if file.Width > 0 && file.Height > 0 {
+		text = append(text,
+			[2]string{KeyImageWidth, strconv.Itoa(file.Width)},
+			[2]string{KeyImageHeight, strconv.Itoa(file.Height)})
+	}
+	if file.HasVideo && file.Duration > 0 {
+		text = append(text, [2]string{KeyMovieLength, strconv.FormatInt(int64(file.Duration/time.Second), 10)})
+	}
+	return text, buf.Bytes(), nil
+}
+
+// failImage returns the empty image recorded for failures.
+func failImage() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes(), err
+}
+
+// writeAtomic writes the PNG with the text chunks to a temporary file in the path's directory (created with
+// permissions 0700 if needed), and renames it to the path.
+func writeAtomic(path string, data []byte, text [][2]string) error {
+	data, err := AddText(data, text...)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	errNotPNG    = errors.New("freedesktop: not a PNG")
+)
+
+// AddText returns the PNG with tEXt chunks holding the key-value pairs inserted after its header. Keys and values must
+// be Latin-1, as required by the PNG specification.
+func AddText(data []byte, text ...[2]string) ([]byte, error) {
+	const headerEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < headerEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return nil, errNotPNG
+	}
+	out := make([]byte, 0, len(data)+64*len(text))
+	out = append(out, data[:headerEnd]...)
+	for _, kv := range text {
+		n := len(kv[0]) + 1 + len(kv[1])
+		chunk := make([]byte, 4, 12+n)
+		binary.BigEndian.PutUint32(chunk, uint32(n))
+		chunk = append(chunk, "tEXt"...)
+		chunk = append(chunk, kv[0]...)
+		chunk = append(chunk, 0)
+		chunk = append(chunk, kv[1]...)
+		chunk = append(chunk, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(chunk[8+n:], crc32.ChecksumIEEE(chunk[4:8+n]))
+		out = append(out, chunk...)
+	}
+	return append(out, data[headerEnd:]...), nil
+}
+
+// ReadText returns the key-value pairs of the PNG's tEXt chunks preceding its image data.
+func ReadText(data []byte) (map[string]string, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errNotPNG
+	}
+	text := make(map[string]string)
+	for data = data[len(pngSignature):]; len(data) >= 12; {
+		n := int(binary.BigEndian.Uint32(data))
+		if n < 0 || n > len(data)-12 {
+			return nil, errNotPNG
+		}
+		typ, chunk := string(data[4:8]), data[8:8+n]
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		if typ == "tEXt" {
+			if i := bytes.IndexByte(chunk, 0); i > 0 {
+				text[string(chunk[:i])] = string(chunk[i+1:])
+			}
+		}
+		data = data[12+n:]
+	}
+	return text, nil
+}
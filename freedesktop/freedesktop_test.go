@@ -0,0 +1,191 @@
+package freedesktop
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+func TestURI(t *testing.T) {
+	for _, tc := range []struct{ path, uri string }{
+		{"/home/jens/photos/me.png", "file:///home/jens/photos/me.png"},
+		{"/tmp/a b/c#d?.jpg", "file:///tmp/a%20b/c%23d%3F.jpg"},
+		{"/tmp/dürümpf (1)+x,y;z.mp3", "file:///tmp/d%C3%BCr%C3%BCmpf%20(1)+x,y%3Bz.mp3"},
+	} {
+		if uri, err := URI(tc.path); err != nil || uri != tc.uri {
+			t.Errorf("URI(%q) = %q, %v, want %q", tc.path, uri, err, tc.uri)
+		}
+	}
+	// The example from the specification.
+	if name := Name("file:///home/jens/photos/me.png"); name != "c6ee772d9e49320e97ec29a7eb5b1697.png" {
+		t.Errorf("Name = %v", name)
+	}
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestText(t *testing.T) {
+	data, err := AddText(testPNG(t, 4, 3), [2]string{KeyURI, "file:///a"}, [2]string{KeyMTime, "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid PNG with text chunks: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 3 {
+		t.Errorf("bounds = %v", b)
+	}
+	text, err := ReadText(data)
+	if err != nil || len(text) != 2 || text[KeyURI] != "file:///a" || text[KeyMTime] != "42" {
+		t.Errorf("ReadText = %v, %v", text, err)
+	}
+	if _, err = AddText([]byte("GIF89a")); err != errNotPNG {
+		t.Errorf("err = %v, want %v", err, errNotPNG)
+	}
+}
+
+type fakeCreate struct {
+	calls int
+	err   error
+	png   []byte
+}
+
+func (f *fakeCreate) create(_ context.Context, file *thumbnailer.File) error {
+	f.calls++
+	if file.Format != thumbnailer.FormatPNG || file.TargetDimensions != int(Large) {
+		return os.ErrInvalid
+	}
+	if f.err != nil {
+		return f.err
+	}
+	file.Width, file.Height, file.HasVideo, file.Duration = 640, 480, true, 90*time.Second
+	if f.png == nil {
+		return nil
+	}
+	file.ThumbCreated = true
+	_, err := file.Writer.Write(f.png)
+	return err
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.jpg")
+	if err := os.WriteFile(path, []byte("\xff\xd8\xff\xe0input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCreate{png: testPNG(t, 256, 192)}
+	c, err := New(Config{Dir: filepath.Join(dir, "thumbnails"), App: "test", Create: f.create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Thumbnail(context.Background(), path, 100); err != ErrInvalidSize {
+		t.Errorf("err = %v, want %v", err, ErrInvalidSize)
+	}
+	thumb, err := c.Thumbnail(context.Background(), path, Large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := URI(path)
+	if want := filepath.Join(dir, "thumbnails", "large", Name(uri)); thumb != want {
+		t.Errorf("path = %v, want %v", thumb, want)
+	}
+	fi, err := os.Stat(thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("permissions = %v", fi.Mode().Perm())
+	}
+	src, _ := os.Stat(path)
+	data, _ := os.ReadFile(thumb)
+	text, err := ReadText(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		KeyURI:         uri,
+		KeyMTime:       strconv.FormatInt(src.ModTime().Unix(), 10),
+		KeySize:        strconv.FormatInt(src.Size(), 10),
+		KeyMime:        "image/jpeg",
+		KeyImageWidth:  "640",
+		KeyImageHeight: "480",
+		KeyMovieLength: "90",
+	} {
+		if text[k] != v {
+			t.Errorf("%v = %q, want %q", k, text[k], v)
+		}
+	}
+	if got, ok := c.Lookup(path, Large); !ok || got != thumb {
+		t.Errorf("Lookup = %v, %v", got, ok)
+	}
+	if _, ok := c.Lookup(path, Normal); ok {
+		t.Error("Lookup found a missing size")
+	}
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != nil || f.calls != 1 {
+		t.Errorf("valid thumbnail recreated: %v, %d calls", err, f.calls)
+	}
+
+	mtime := src.ModTime().Add(time.Hour)
+	if err = os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup(path, Large); ok {
+		t.Error("Lookup found a stale thumbnail")
+	}
+	f.err = thumbnailer.ErrInvalidData
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != f.err {
+		t.Errorf("err = %v, want %v", err, f.err)
+	}
+	if !c.Failed(path) {
+		t.Error("failure not recorded")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "thumbnails", "fail", "test", Name(uri))); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != ErrFailed || f.calls != 2 {
+		t.Errorf("err = %v, %d calls, want %v, 2 calls", err, f.calls, ErrFailed)
+	}
+
+	if err = os.Chtimes(path, mtime.Add(time.Hour), mtime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	f.err = context.Canceled
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != f.err || c.Failed(path) {
+		t.Errorf("err = %v, failed = %v after cancellation", err, c.Failed(path))
+	}
+	f.err = nil
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != nil {
+		t.Errorf("err = %v after modification", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "thumbnails", "large"))
+	if len(entries) != 1 {
+		t.Errorf("%d files in the large directory, want 1", len(entries))
+	}
+
+	if err = os.Chtimes(path, mtime.Add(2*time.Hour), mtime.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	f.png, f.calls = nil, 0
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != ErrNoThumbnail || !c.Failed(path) {
+		t.Errorf("err = %v, failed = %v, want %v, true", err, c.Failed(path), ErrNoThumbnail)
+	}
+	if _, err = c.Thumbnail(context.Background(), path, Large); err != ErrFailed || f.calls != 1 {
+		t.Errorf("err = %v, %d calls, want %v, 1 call", err, f.calls, ErrFailed)
+	}
+}
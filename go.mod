@@ -1,6 +1,13 @@
 module github.com/zRedShift/thumbnailer
 
+go 1.21
+
 require (
 	github.com/zRedShift/mimemagic v1.1.0
 	github.com/zRedShift/seekstream v1.0.1
 )
+
+require (
+	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f // indirect
+	golang.org/x/text v0.3.0 // indirect
+)
@@ -0,0 +1,190 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const httpReadAhead = 1 << 18
+
+var (
+	// ErrRangeNotSupported is returned by FileFromURL if the server doesn't respond to range requests with a known
+	// size.
+	ErrRangeNotSupported = errors.New("thumbnailer: server does not support range requests")
+	// ErrContentRangeMismatch is returned by the reads of a File from FileFromURL if the server responds with a range
+	// other than the requested one, or with a different size.
+	ErrContentRangeMismatch = errors.New("thumbnailer: server responded with a mismatched range")
+)
+
+// httpReader is an io.ReadSeeker over an HTTP resource, which translates reads into range requests of at least
+// httpReadAhead bytes and caches the last response. Its size is -1 until the first response. Requests are made with
+// the context of FileFromURL, and cancelled with the one of the thumbnailing call, if it's bound with bindContext.
+type httpReader struct {
+	ctx, callCtx context.Context
+	client       *http.Client
+	url          string
+	size, off    int64
+	buf          []byte
+	bufOff       int64
+	readAhead    int64
+	requests     int
+}
+
+func (r *httpReader) fetch(off, n int64) error {
+	if n < r.readAhead {
+		n = r.readAhead
+	}
+	if r.size >= 0 && off+n > r.size {
+		n = r.size - off
+	}
+	ctx := r.ctx
+	if r.callCtx != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(r.callCtx)
+		defer cancel()
+		defer context.AfterFunc(r.ctx, cancel)()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(off+n-1, 10))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	r.requests++
+	start, size := contentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case off == 0 && (resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && size == 0 ||
+		resp.StatusCode == http.StatusOK && resp.ContentLength == 0):
+		// Ranges can't be satisfied for empty resources.
+		r.size, r.buf, r.bufOff = 0, r.buf[:0], 0
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		return ErrRangeNotSupported
+	case resp.StatusCode != http.StatusPartialContent:
+		return errors.New("thumbnailer: unexpected HTTP status: " + resp.Status)
+	case size <= 0:
+		return ErrRangeNotSupported
+	case start != off || r.size >= 0 && size != r.size:
+		return ErrContentRangeMismatch
+	}
+	r.size = size
+	if int64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+	m, err := io.ReadFull(resp.Body, r.buf[:n])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	r.buf, r.bufOff = r.buf[:m], off
+	return err
+}
+
+// contentRange returns the first byte position and the complete length from a Content-Range header, or -1 for those
+// that are missing or unknown.
+func contentRange(contentRange string) (start, size int64) {
+	start, size = -1, -1
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return start, size
+	}
+	contentRange = contentRange[len("bytes "):]
+	i := strings.IndexByte(contentRange, '/')
+	if i < 0 {
+		return start, size
+	}
+	if n, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+		size = n
+	}
+	if j := strings.IndexByte(contentRange[:i], '-'); j >= 0 {
+		if n, err := strconv.ParseInt(contentRange[:j], 10, 64); err == nil {
+			start = n
+		}
+	}
+	return start, size
+}
+
+// bindContext makes the requests of an httpReader underlying the File's Reader be cancelled with the context, until the
+// returned function is called.
+func bindContext(ctx context.Context, file *File) func() {
+	r, ok := unwrapReader(file.Reader).(*httpReader)
+	if !ok {
+		return func() {}
+	}
+	prev := r.callCtx
+	r.callCtx = ctx
+	return func() { r.callCtx = prev }
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.off < r.bufOff || r.off >= r.bufOff+int64(len(r.buf)) {
+		if err := r.fetch(r.off, int64(len(p))); err != nil {
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, r.buf[r.off-r.bufOff:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *httpReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("thumbnailer: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("thumbnailer: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// FileFromURL takes a context, the URL of an HTTP resource and an optional http.Client (http.DefaultClient if nil), and
+// returns a File ready for supplying a thumbnail output via ToWriter or ToPath. Instead of downloading the whole
+// resource, the File reads and seeks with range requests, each fetching a read-ahead window that's cached until the
+// next one, and the size (used by FFmpeg for seeking relative to the end) is taken from the Content-Range. The server
+// must support range requests, otherwise ErrRangeNotSupported is returned. The context applies to all the requests
+// made by the File, which are also cancelled with the context of the call thumbnailing or probing it.
+func FileFromURL(ctx context.Context, rawURL string, client *http.Client) (*File, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r := &httpReader{ctx: ctx, client: client, url: rawURL, size: -1, readAhead: httpReadAhead}
+	if err = r.fetch(0, probeSize); err != nil {
+		return nil, err
+	}
+	data := r.buf
+	if len(data) > probeSize {
+		data = data[:probeSize]
+	}
+	return &File{
+		Reader:    r,
+		Seeker:    r,
+		SeekEnd:   true,
+		Size:      r.size,
+		MediaType: sniff(data, path.Base(u.Path)),
+	}, nil
+}
@@ -0,0 +1,187 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileFromURL(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("fixtures")))
+	defer ts.Close()
+	// A File reads each read-ahead window of the resource once, except for a few windows revisited when seeking.
+	tests := []struct {
+		filename, wantMediaType string
+		maxRevisits             int
+	}{
+		{"trollface.png", "image/png", 1},
+		{"macabre.mp4", "video/mp4", 3},
+		{"alpha-webm.webm", "video/webm", 3},
+		{"spszut pszek.mp3", "audio/mpeg", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			fi, err := os.Stat(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("os.Stat() error = %v", err)
+			}
+			f, err := FileFromURL(context.Background(), ts.URL+"/"+test.filename, ts.Client())
+			if err != nil {
+				t.Fatalf("FileFromURL() error = %v", err)
+			}
+			if f.MediaType.MediaType() != test.wantMediaType {
+				t.Errorf("MediaType want = %v, got = %v", test.wantMediaType, f.MediaType.MediaType())
+			}
+			if f.Size != fi.Size() {
+				t.Errorf("Size want = %v, got = %v", fi.Size(), f.Size)
+			}
+			if err = CreateThumbnail(f.ToWriter(ioutil.Discard, 256)); err != nil {
+				t.Errorf("CreateThumbnail() error = %v", err)
+			}
+			if !f.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", true, f.ThumbCreated)
+			}
+			windows := int((f.Size + httpReadAhead - 1) / httpReadAhead)
+			if n := f.Reader.(*httpReader).requests; n < 1 || n > windows+test.maxRevisits {
+				t.Errorf("%d range requests for %d read-ahead windows, want at most %d", n, windows,
+					windows+test.maxRevisits)
+			}
+		})
+	}
+}
+
+func TestHTTPReader(t *testing.T) {
+	path := filepath.Join("fixtures", "sample.tif")
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile() error = %v", err)
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir("fixtures")))
+	defer ts.Close()
+	f, err := FileFromURL(context.Background(), ts.URL+"/sample.tif", nil)
+	if err != nil {
+		t.Fatalf("FileFromURL() error = %v", err)
+	}
+	r := f.Reader.(*httpReader)
+	r.readAhead, r.buf = 1000, nil
+	offsets := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{-100, io.SeekEnd, int64(len(want)) - 100},
+		{1 << 12, io.SeekStart, 1 << 12},
+		{-10, io.SeekCurrent, 1<<12 + 40},
+	}
+	for _, o := range offsets {
+		n, err := r.Seek(o.offset, o.whence)
+		if err != nil || n != o.want {
+			t.Fatalf("Seek() = %v, %v, want = %v", n, err, o.want)
+		}
+		got := make([]byte, 50)
+		if _, err = io.ReadFull(r, got); err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+		if string(got) != string(want[n:n+50]) {
+			t.Errorf("Read() at %d returned the wrong data", n)
+		}
+	}
+	// The first request was made by FileFromURL, and the last read was served from the cached window.
+	if r.requests != 3 {
+		t.Errorf("requests want = %v, got = %v", 3, r.requests)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("ReadAll() returned the wrong data")
+	}
+}
+
+func TestFileFromURLRangeNotSupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("no ranges here"))
+	}))
+	defer ts.Close()
+	if _, err := FileFromURL(context.Background(), ts.URL, nil); err != ErrRangeNotSupported {
+		t.Errorf("FileFromURL() error = %v, want = %v", err, ErrRangeNotSupported)
+	}
+}
+
+func TestFileFromURLEmpty(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "empty.png", time.Time{}, strings.NewReader(""))
+	}))
+	defer ts.Close()
+	f, err := FileFromURL(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatalf("FileFromURL() error = %v", err)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read() = %v, %v, want = 0, %v", n, err, io.EOF)
+	}
+}
+
+func TestHTTPReaderContentRange(t *testing.T) {
+	data := strings.Repeat("0123456789", 1000)
+	var shift int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		start += shift
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, data[start:end+1])
+	}))
+	defer ts.Close()
+	f, err := FileFromURL(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatalf("FileFromURL() error = %v", err)
+	}
+	r := f.Reader.(*httpReader)
+	r.readAhead, r.buf, shift = 100, nil, 10
+	if _, err = r.Seek(5000, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if _, err = r.Read(make([]byte, 10)); err != ErrContentRangeMismatch {
+		t.Errorf("Read() error = %v, want = %v", err, ErrContentRangeMismatch)
+	}
+}
+
+func TestHTTPReaderCallContext(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("fixtures")))
+	defer ts.Close()
+	f, err := FileFromURL(context.Background(), ts.URL+"/trollface.png", nil)
+	if err != nil {
+		t.Fatalf("FileFromURL() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	unbind := bindContext(ctx, f)
+	if _, err = f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if _, err = f.Read(make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() error = %v, want = %v", err, context.Canceled)
+	}
+	unbind()
+	if _, err = f.Read(make([]byte, 10)); err != nil {
+		t.Errorf("Read() after unbinding error = %v", err)
+	}
+}
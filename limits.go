@@ -0,0 +1,167 @@
+package thumbnailer
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits protects against decompression bombs and other hostile inputs. MaxPixels caps the width times the height of
+// images (of a single page) and videos, MaxPages caps the number of pages (or frames) of images and the number of
+// frames of videos (if the container reports it), MaxInputBytes caps the size of the input, MaxDecodeTime caps the
+// time spent creating a thumbnail, and MaxVideoDimensions caps the width and height of videos separately. Zero values
+// mean no limit. All but MaxDecodeTime and MaxInputBytes (for inputs of unknown size) are checked against the headers,
+// before any decoding.
+type Limits struct {
+	MaxPixels, MaxInputBytes int64
+	MaxPages                 int
+	MaxDecodeTime            time.Duration
+	MaxVideoDimensions       Dimensions
+}
+
+// LimitError is returned when an input violates one of the Limits. Its Limit is one of the Limit* constants, and the
+// errors.Is function matches it against the corresponding Err* variable. For LimitDecodeTime, the Value and Max are in
+// milliseconds.
+type LimitError struct {
+	Limit      string
+	Value, Max int64
+}
+
+// Possible values of LimitError.Limit.
+const (
+	LimitPixels          = "pixels"
+	LimitPages           = "pages"
+	LimitInputBytes      = "input bytes"
+	LimitDecodeTime      = "decode time"
+	LimitVideoDimensions = "video dimensions"
+)
+
+// LimitErrors for use with errors.Is.
+var (
+	ErrTooManyPixels = &LimitError{Limit: LimitPixels}
+	ErrTooManyPages  = &LimitError{Limit: LimitPages}
+	ErrInputTooLarge = &LimitError{Limit: LimitInputBytes}
+	ErrDecodeTimeout = &LimitError{Limit: LimitDecodeTime}
+	ErrVideoTooLarge = &LimitError{Limit: LimitVideoDimensions}
+)
+
+func (e *LimitError) Error() string {
+	if e.Max == 0 {
+		return "thumbnailer: " + e.Limit + " limit exceeded"
+	}
+	return "thumbnailer: " + e.Limit + " limit exceeded: " + strconv.FormatInt(e.Value, 10) + " > " +
+		strconv.FormatInt(e.Max, 10)
+}
+
+// Is reports whether the target is a LimitError for the same limit, or its ErrorKind: KindTimeout for LimitDecodeTime
+// and KindTooLarge for the rest.
+func (e *LimitError) Is(target error) bool {
+	if kind, ok := target.(ErrorKind); ok {
+		if e.Limit == LimitDecodeTime {
+			return kind == KindTimeout
+		}
+		return kind == KindTooLarge
+	}
+	t, ok := target.(*LimitError)
+	return ok && t.Limit == e.Limit
+}
+
+var limits = struct {
+	sync.RWMutex
+	Limits
+}{}
+
+// SetLimits sets the Limits applied to Files without their own. There are no limits by default.
+func SetLimits(l Limits) {
+	limits.Lock()
+	limits.Limits = l
+	limits.Unlock()
+}
+
+func (f *File) limits() Limits {
+	if f.Limits != nil {
+		return *f.Limits
+	}
+	limits.RLock()
+	defer limits.RUnlock()
+	return limits.Limits
+}
+
+func (l Limits) checkSize(size int64) error {
+	if l.MaxInputBytes > 0 && size > l.MaxInputBytes {
+		return &LimitError{Limit: LimitInputBytes, Value: size, Max: l.MaxInputBytes}
+	}
+	return nil
+}
+
+func (l Limits) checkVideo(width, height, frames int64) error {
+	if l.MaxVideoDimensions.Width > 0 && width > int64(l.MaxVideoDimensions.Width) {
+		return &LimitError{Limit: LimitVideoDimensions, Value: width, Max: int64(l.MaxVideoDimensions.Width)}
+	}
+	if l.MaxVideoDimensions.Height > 0 && height > int64(l.MaxVideoDimensions.Height) {
+		return &LimitError{Limit: LimitVideoDimensions, Value: height, Max: int64(l.MaxVideoDimensions.Height)}
+	}
+	if l.MaxPixels > 0 && width*height > l.MaxPixels {
+		return &LimitError{Limit: LimitPixels, Value: width * height, Max: l.MaxPixels}
+	}
+	if l.MaxPages > 0 && frames > int64(l.MaxPages) {
+		return &LimitError{Limit: LimitPages, Value: frames, Max: int64(l.MaxPages)}
+	}
+	return nil
+}
+
+// limitedInput fails reads past MaxInputBytes, keeping track of the offset through seeks.
+type limitedInput struct {
+	io.Reader
+	io.Seeker
+	off, max int64
+	err      error
+}
+
+func (r *limitedInput) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.Reader.Read(p)
+	r.off += int64(n)
+	if r.off > r.max {
+		r.err = &LimitError{Limit: LimitInputBytes, Value: r.off, Max: r.max}
+		return 0, r.err
+	}
+	return n, err
+}
+
+func (r *limitedInput) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.Seeker.Seek(offset, whence)
+	if err == nil {
+		r.off = n
+	}
+	return n, err
+}
+
+func (r *limitedInput) unwrap() io.Reader { return r.Reader }
+
+// unwrapReader returns the io.Reader underneath the package's wrappers of the File's input, such as limitedInput.
+func unwrapReader(r io.Reader) io.Reader {
+	for {
+		w, ok := r.(interface{ unwrap() io.Reader })
+		if !ok {
+			return r
+		}
+		r = w.unwrap()
+	}
+}
+
+// limitInput wraps the File's input in a limitedInput, and returns it along with a function restoring the input.
+func limitInput(file *File, max int64) (*limitedInput, func()) {
+	reader, seeker := file.Reader, file.Seeker
+	r := &limitedInput{Reader: reader, Seeker: seeker, max: max}
+	file.Reader = r
+	if seeker != nil {
+		file.Seeker = r
+	}
+	return r, func() {
+		file.Reader, file.Seeker = reader, seeker
+	}
+}
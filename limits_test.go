@@ -0,0 +1,74 @@
+package thumbnailer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name, filename string
+		fromReader     bool
+		limits         Limits
+		wantErr        error
+	}{
+		{"Pixels", "trollface.png", false, Limits{MaxPixels: 1 << 20}, ErrTooManyPixels},
+		{"InputBytes", "trollface.png", false, Limits{MaxInputBytes: 1 << 10}, ErrInputTooLarge},
+		{"InputBytesReader", "trollface.png", true, Limits{MaxInputBytes: 1 << 10}, ErrInputTooLarge},
+		{"VideoDimensions", "schizo_0.mp4", false, Limits{MaxVideoDimensions: Dimensions{Width: 320}}, ErrVideoTooLarge},
+		{"VideoPixels", "schizo_0.mp4", false, Limits{MaxPixels: 1 << 16}, ErrTooManyPixels},
+		{"WithinLimits", "trollface.png", true, Limits{MaxPixels: 1 << 25, MaxInputBytes: 1 << 30}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join("fixtures", test.filename)
+			var file *File
+			var err error
+			if test.fromReader {
+				f, oErr := os.Open(path)
+				if oErr != nil {
+					t.Fatalf("os.Open() error = %v", oErr)
+				}
+				defer f.Close()
+				file, err = FileFromReader(f, test.filename)
+			} else {
+				file, err = FileFromPath(path)
+			}
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			file.Limits = &test.limits
+			err = CreateThumbnail(file.ToWriter(ioutil.Discard, 256))
+			if test.wantErr == nil {
+				if err != nil {
+					t.Errorf("CreateThumbnail() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("CreateThumbnail() error = %v, want = %v", err, test.wantErr)
+			}
+			if file.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", false, file.ThumbCreated)
+			}
+		})
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	err := error(&LimitError{Limit: LimitPixels, Value: 200, Max: 100})
+	if !errors.Is(err, ErrTooManyPixels) || errors.Is(err, ErrTooManyPages) {
+		t.Errorf("errors.Is() mismatch for %v", err)
+	}
+	if want := "thumbnailer: pixels limit exceeded: 200 > 100"; err.Error() != want {
+		t.Errorf("Error() want = %v, got = %v", want, err.Error())
+	}
+	r := &limitedInput{Reader: strings.NewReader(strings.Repeat("x", 100)), max: 50}
+	if _, err = ioutil.ReadAll(r); !errors.Is(err, ErrInputTooLarge) {
+		t.Errorf("ReadAll() error = %v, want = %v", err, ErrInputTooLarge)
+	}
+}
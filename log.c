@@ -0,0 +1,52 @@
+#include "log.h"
+
+static const char *glib_domains[] = {"VIPS", "GLib", "GLib-GObject", "GLib-GIO"};
+static guint glib_handlers[sizeof glib_domains / sizeof *glib_domains];
+
+static void *log_opaque(void *avcl, const AVClass *class) {
+    if (!strcmp(class->class_name, "AVFormatContext")) {
+        return avcl;
+    }
+    if (!strcmp(class->class_name, "AVCodecContext")) {
+        return ((AVCodecContext *) avcl)->opaque;
+    }
+    if (!strcmp(class->class_name, "AVIOContext")) {
+        return ((AVIOContext *) avcl)->opaque;
+    }
+    return NULL;
+}
+
+static void av_log_callback(void *avcl, int level, const char *fmt, va_list vl) {
+    if (level > av_log_get_level()) {
+        return;
+    }
+    char line[LOG_LINE_SIZE];
+    vsnprintf(line, sizeof line, fmt, vl);
+    const char *component = NULL;
+    void *opaque = NULL;
+    const AVClass *class = avcl ? *(AVClass **) avcl : NULL;
+    if (class) {
+        component = class->item_name ? class->item_name(avcl) : class->class_name;
+        opaque = log_opaque(avcl, class);
+    }
+    ffmpegLogCallback(avcl, opaque, level, (char *) component, line);
+}
+
+static void glib_log_handler(const gchar *domain, GLogLevelFlags level, const gchar *message, gpointer data) {
+    glibLogCallback((char *) domain, level, (char *) message);
+}
+
+void set_log_callbacks(int enable) {
+    size_t i;
+    av_log_set_callback(enable ? av_log_callback : av_log_default_callback);
+    for (i = 0; i < sizeof glib_domains / sizeof *glib_domains; i++) {
+        if (glib_handlers[i]) {
+            g_log_remove_handler(glib_domains[i], glib_handlers[i]);
+            glib_handlers[i] = 0;
+        }
+        if (enable) {
+            glib_handlers[i] = g_log_set_handler(glib_domains[i], G_LOG_LEVEL_MASK | G_LOG_FLAG_FATAL |
+                                                 G_LOG_FLAG_RECURSION, glib_log_handler, NULL);
+        }
+    }
+}
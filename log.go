@@ -0,0 +1,176 @@
+package thumbnailer
+
+// #include "log.h"
+import "C"
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Logger receives the log messages of FFmpeg, vips and GLib. *slog.Logger implements it. Every message carries the
+// attributes "library" ("ffmpeg", "vips" or "glib") and "component" (the FFmpeg demuxer, decoder or context name, or
+// the GLib log domain). FFmpeg messages emitted while working on a File are logged with the context passed to
+// CreateThumbnailWithContext (or ProbeWithContext), along with the File's "path", if it has one. The rest are logged
+// with context.Background().
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+var logger = struct {
+	sync.RWMutex
+	Logger
+}{}
+
+// SetLogger routes the log messages of FFmpeg, vips and GLib to the supplied Logger, instead of stderr. A nil Logger
+// restores the default behaviour. FFmpeg messages are still filtered by the level set by SetFFmpegLogLevel, and those
+// FFmpeg logs in fragments are joined into a single message once their line is complete.
+func SetLogger(l Logger) {
+	logger.Lock()
+	logger.Logger = l
+	logger.Unlock()
+	enable := C.int(0)
+	if l != nil {
+		enable = 1
+	}
+	C.set_log_callbacks(enable)
+}
+
+func currentLogger() Logger {
+	logger.RLock()
+	defer logger.RUnlock()
+	return logger.Logger
+}
+
+func ffmpegLevel(level C.int) slog.Level {
+	switch {
+	case level <= C.AV_LOG_ERROR:
+		return slog.LevelError
+	case level <= C.AV_LOG_WARNING:
+		return slog.LevelWarn
+	case level <= C.AV_LOG_INFO:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+func glibLevel(level C.int) slog.Level {
+	switch {
+	case level&(C.G_LOG_LEVEL_ERROR|C.G_LOG_LEVEL_CRITICAL) != 0:
+		return slog.LevelError
+	case level&C.G_LOG_LEVEL_WARNING != 0:
+		return slog.LevelWarn
+	case level&(C.G_LOG_LEVEL_MESSAGE|C.G_LOG_LEVEL_INFO) != 0:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// logLine is an FFmpeg log line, possibly still missing fragments.
+type logLine struct {
+	opaque    unsafe.Pointer
+	level     slog.Level
+	component string
+	text      strings.Builder
+}
+
+// maxLogLines bounds the number of incomplete lines kept by logLines.
+const maxLogLines = 64
+
+// logLines buffers the fragments of FFmpeg log lines, which are logged by several av_log calls with the same logging
+// context, until a newline completes them.
+type logLines struct {
+	sync.Mutex
+	m map[unsafe.Pointer]*logLine
+}
+
+// add adds a fragment logged with a logging context, returning the lines that are complete.
+func (l *logLines) add(avcl, opaque unsafe.Pointer, level slog.Level, component, fragment string) []*logLine {
+	l.Lock()
+	defer l.Unlock()
+	line, ok := l.m[avcl]
+	if !ok {
+		line = &logLine{opaque: opaque, level: level, component: component}
+	} else if level > line.level {
+		line.level = level
+	}
+	line.text.WriteString(fragment)
+	if strings.HasSuffix(fragment, "\n") || line.text.Len() >= C.LOG_LINE_SIZE {
+		delete(l.m, avcl)
+		return []*logLine{line}
+	}
+	if !ok && len(l.m) >= maxLogLines {
+		lines := l.take(func(*logLine) bool { return true })
+		l.m[avcl] = line
+		return lines
+	}
+	l.m[avcl] = line
+	return nil
+}
+
+// flush returns the incomplete lines logged while working on a File, once it's done.
+func (l *logLines) flush(opaque unsafe.Pointer) []*logLine {
+	l.Lock()
+	defer l.Unlock()
+	return l.take(func(line *logLine) bool { return line.opaque == opaque })
+}
+
+func (l *logLines) take(match func(*logLine) bool) []*logLine {
+	var lines []*logLine
+	for avcl, line := range l.m {
+		if match(line) {
+			lines = append(lines, line)
+			delete(l.m, avcl)
+		}
+	}
+	return lines
+}
+
+var ffmpegLines = logLines{m: make(map[unsafe.Pointer]*logLine)}
+
+//export ffmpegLogCallback
+func ffmpegLogCallback(avcl, opaque unsafe.Pointer, level C.int, component, message *C.char) {
+	if currentLogger() == nil {
+		return
+	}
+	logFFmpeg(ffmpegLines.add(avcl, opaque, ffmpegLevel(level), C.GoString(component), C.GoString(message)))
+}
+
+func logFFmpeg(lines []*logLine) {
+	l := currentLogger()
+	if l == nil {
+		return
+	}
+	for _, line := range lines {
+		msg := strings.TrimSpace(line.text.String())
+		if msg == "" {
+			continue
+		}
+		ctx, args := context.Background(), []interface{}{"library", "ffmpeg", "component", line.component}
+		if avCtx, ok := ctxMap.context(line.opaque); ok {
+			ctx = avCtx.context
+			if avCtx.file.Path != "" {
+				args = append(args, "path", avCtx.file.Path)
+			}
+		}
+		l.Log(ctx, line.level, msg, args...)
+	}
+}
+
+//export glibLogCallback
+func glibLogCallback(domain *C.char, level C.int, message *C.char) {
+	l := currentLogger()
+	if l == nil {
+		return
+	}
+	component, library := C.GoString(domain), "glib"
+	if component == "VIPS" {
+		library = "vips"
+	}
+	l.Log(context.Background(), glibLevel(level), strings.TrimSpace(C.GoString(message)), "library", library,
+		"component", component)
+}
@@ -0,0 +1,15 @@
+#include <stdarg.h>
+#include <stdio.h>
+#include <string.h>
+
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include <vips/vips.h>
+
+#define LOG_LINE_SIZE 1024
+
+void set_log_callbacks(int enable);
+
+extern void ffmpegLogCallback(void *avcl, void *opaque, int level, char *component, char *message);
+
+extern void glibLogCallback(char *domain, int level, char *message);
@@ -0,0 +1,110 @@
+package thumbnailer
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+type logKey struct{}
+
+type logRecord struct {
+	ctx   context.Context
+	level slog.Level
+	msg   string
+	attrs map[string]interface{}
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) Log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	attrs := make(map[string]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+	l.Lock()
+	l.records = append(l.records, logRecord{ctx, level, msg, attrs})
+	l.Unlock()
+}
+
+func TestSetLogger(t *testing.T) {
+	level := logLevel()
+	l := new(recordingLogger)
+	SetLogger(l)
+	SetFFmpegLogLevel(AVLogDebug)
+	defer func() {
+		SetLogger(nil)
+		SetFFmpegLogLevel(level)
+	}()
+	path := filepath.Join("fixtures", "schizo_0.mp4")
+	file, err := FileFromPath(path)
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	ctx := context.WithValue(context.Background(), logKey{}, "schizo")
+	if err = CreateThumbnailWithContext(ctx, file.ToWriter(ioutil.Discard, 256)); err != nil {
+		t.Fatalf("CreateThumbnailWithContext() error = %v", err)
+	}
+	l.Lock()
+	defer l.Unlock()
+	var associated int
+	for _, r := range l.records {
+		if _, ok := r.attrs["component"]; !ok {
+			t.Errorf("component missing from %v for %q", r.attrs, r.msg)
+		}
+		if r.attrs["library"] != "ffmpeg" {
+			continue
+		}
+		if r.ctx.Value(logKey{}) == "schizo" {
+			associated++
+			if r.attrs["path"] != path {
+				t.Errorf("path want = %v, got = %v", path, r.attrs["path"])
+			}
+		}
+	}
+	if associated == 0 {
+		t.Errorf("no messages associated with the call out of %v", len(l.records))
+	}
+}
+
+func TestLogLines(t *testing.T) {
+	l := logLines{m: make(map[unsafe.Pointer]*logLine)}
+	a, b, opaque := unsafe.Pointer(new(int)), unsafe.Pointer(new(int)), unsafe.Pointer(new(int))
+	for _, test := range []struct {
+		avcl, opaque unsafe.Pointer
+		level        slog.Level
+		fragment     string
+		want         []string
+	}{
+		{a, opaque, slog.LevelInfo, "Stream #0:0", nil},
+		{b, nil, slog.LevelInfo, "other ", nil},
+		{a, opaque, slog.LevelWarn, ": Video: h264", nil},
+		{a, opaque, slog.LevelInfo, ", 256x256\n", []string{"Stream #0:0: Video: h264, 256x256\n"}},
+		{a, opaque, slog.LevelInfo, "incomplete", nil},
+	} {
+		var got []string
+		for _, line := range l.add(test.avcl, test.opaque, test.level, "h264", test.fragment) {
+			got = append(got, line.text.String())
+			if line.level != slog.LevelWarn {
+				t.Errorf("level want = %v, got = %v", slog.LevelWarn, line.level)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("add(%q) want = %q, got = %q", test.fragment, test.want, got)
+		}
+	}
+	if lines := l.flush(opaque); len(lines) != 1 || lines[0].text.String() != "incomplete" {
+		t.Errorf("flush() got = %v lines", len(lines))
+	}
+	if len(l.m) != 1 {
+		t.Errorf("lines left want = 1, got = %v", len(l.m))
+	}
+}
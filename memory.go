@@ -0,0 +1,151 @@
+package thumbnailer
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// ErrMemoryBudgetExceeded is returned when a thumbnail's estimated memory usage doesn't fit in the MemoryBudget, either
+// because it's larger than the whole budget, or because the budget is exhausted and FailFast is set.
+var ErrMemoryBudgetExceeded = &ThumbError{
+	Library: "thumbnailer",
+	Err:     "memory budget exceeded",
+	Kind:    KindResourceExhausted,
+}
+
+// MemoryBudget caps the memory used by all concurrent thumbnail creations combined. Before decoding, every job
+// reserves an estimate of its peak memory usage: for videos, the frames buffered for picking the thumbnail (computed
+// from the probed dimensions, pixel format and frame count, exactly as the decoder sizes its buffers), plus the RGB
+// frame handed to vips; for images, the size of the uncompressed first page, which is decoded whole whatever the target
+// size, as images are loaded before being shrunk rather than shrunk on load. Jobs that don't fit wait for others to
+// release their reservations in FIFO order (or until their context is done), unless FailFast is set, in which case
+// they fail immediately with ErrMemoryBudgetExceeded. Jobs with an estimate larger than Max always fail. A Max of zero
+// disables the budget.
+type MemoryBudget struct {
+	Max      int64
+	FailFast bool
+}
+
+// MemoryStats is a snapshot of the MemoryBudget's state, along with the memory actually tracked by vips, for comparing
+// the estimates against the real usage. Reserved and HighWater are the current and peak sums of the reserved
+// estimates, Jobs is the number of jobs holding a reservation, and Waiting the number of jobs waiting for one.
+type MemoryStats struct {
+	Max, Reserved, HighWater int64
+	Jobs, Waiting            int
+	VIPS                     VIPSMemoryProfile
+}
+
+type memoryWaiter struct {
+	size  int64
+	ready chan struct{}
+}
+
+type memoryBudget struct {
+	sync.Mutex
+	MemoryBudget
+	reserved, highWater int64
+	jobs                int
+	waiters             list.List
+}
+
+var budget memoryBudget
+
+// SetMemoryBudget sets the global MemoryBudget. Jobs already holding a reservation keep it, while waiting jobs are
+// admitted if they fit in the new budget. There is no budget by default.
+func SetMemoryBudget(b MemoryBudget) {
+	budget.Lock()
+	budget.MemoryBudget = b
+	budget.admit()
+	budget.Unlock()
+}
+
+// MemoryUsage returns the current MemoryStats.
+func MemoryUsage() MemoryStats {
+	budget.Lock()
+	stats := MemoryStats{
+		Max:       budget.Max,
+		Reserved:  budget.reserved,
+		HighWater: budget.highWater,
+		Jobs:      budget.jobs,
+		Waiting:   budget.waiters.Len(),
+	}
+	budget.Unlock()
+	stats.VIPS = VIPSMemory()
+	return stats
+}
+
+func (b *memoryBudget) fits(size int64) bool {
+	return b.Max <= 0 || b.reserved+size <= b.Max
+}
+
+func (b *memoryBudget) take(size int64) {
+	b.reserved += size
+	b.jobs++
+	if b.reserved > b.highWater {
+		b.highWater = b.reserved
+	}
+}
+
+// admit hands reservations to the waiting jobs in order, until one doesn't fit.
+func (b *memoryBudget) admit() {
+	for e := b.waiters.Front(); e != nil; e = b.waiters.Front() {
+		w := e.Value.(*memoryWaiter)
+		if !b.fits(w.size) {
+			return
+		}
+		b.take(w.size)
+		b.waiters.Remove(e)
+		close(w.ready)
+	}
+}
+
+func (b *memoryBudget) release(size int64) {
+	b.Lock()
+	b.reserved -= size
+	b.jobs--
+	b.admit()
+	b.Unlock()
+}
+
+// reserve reserves size bytes, blocking until they're available or the context is done, and returns a function
+// releasing them.
+func (b *memoryBudget) reserve(ctx context.Context, size int64) (func(), error) {
+	var once sync.Once
+	release := func() {
+		once.Do(func() { b.release(size) })
+	}
+	b.Lock()
+	if b.Max > 0 && size > b.Max {
+		b.Unlock()
+		return nil, ErrMemoryBudgetExceeded
+	}
+	if b.waiters.Len() == 0 && b.fits(size) {
+		b.take(size)
+		b.Unlock()
+		return release, nil
+	}
+	if b.FailFast {
+		b.Unlock()
+		return nil, ErrMemoryBudgetExceeded
+	}
+	w := &memoryWaiter{size: size, ready: make(chan struct{})}
+	e := b.waiters.PushBack(w)
+	b.Unlock()
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	b.Lock()
+	select {
+	case <-w.ready:
+		b.Unlock()
+		release()
+	default:
+		b.waiters.Remove(e)
+		b.admit()
+		b.Unlock()
+	}
+	return nil, ctx.Err()
+}
@@ -0,0 +1,100 @@
+package thumbnailer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := &memoryBudget{MemoryBudget: MemoryBudget{Max: 100}}
+	if _, err := b.reserve(context.Background(), 101); err != ErrMemoryBudgetExceeded {
+		t.Errorf("reserve() error = %v, want = %v", err, ErrMemoryBudgetExceeded)
+	}
+	release, err := b.reserve(context.Background(), 60)
+	if err != nil {
+		t.Fatalf("reserve() error = %v", err)
+	}
+	b.FailFast = true
+	if _, err = b.reserve(context.Background(), 60); err != ErrMemoryBudgetExceeded {
+		t.Errorf("reserve() error = %v, want = %v", err, ErrMemoryBudgetExceeded)
+	}
+	b.FailFast = false
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = b.reserve(ctx, 60); err != context.DeadlineExceeded {
+		t.Errorf("reserve() error = %v, want = %v", err, context.DeadlineExceeded)
+	}
+	if b.waiters.Len() != 0 {
+		t.Errorf("waiters want = %v, got = %v", 0, b.waiters.Len())
+	}
+	done := make(chan error)
+	go func() {
+		r, err := b.reserve(context.Background(), 60)
+		if err == nil {
+			r()
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	release()
+	if err = <-done; err != nil {
+		t.Errorf("reserve() error = %v", err)
+	}
+	if b.reserved != 0 || b.jobs != 0 || b.highWater != 60 {
+		t.Errorf("reserved, jobs, highWater want = 0, 0, 60, got = %v, %v, %v", b.reserved, b.jobs, b.highWater)
+	}
+}
+
+func TestCreateThumbnailMemoryEstimate(t *testing.T) {
+	defer SetMemoryBudget(MemoryBudget{})
+	for _, tc := range []struct {
+		filename string
+		estimate int64
+	}{
+		{"trollface.png", 5000 * 4068 * 4},
+		{"Landscape_8.jpg", 1800 * 1200 * 3},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			file, err := FileFromPath(filepath.Join("fixtures", tc.filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			// The estimate is the uncompressed size of the image, however small the thumbnail.
+			SetMemoryBudget(MemoryBudget{Max: tc.estimate - 1, FailFast: true})
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 64)); err != ErrMemoryBudgetExceeded {
+				t.Errorf("CreateThumbnail() error = %v, want = %v", err, ErrMemoryBudgetExceeded)
+			}
+			SetMemoryBudget(MemoryBudget{Max: tc.estimate, FailFast: true})
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 64)); err != nil {
+				t.Errorf("CreateThumbnail() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateThumbnailMemoryBudget(t *testing.T) {
+	defer SetMemoryBudget(MemoryBudget{})
+	for _, filename := range []string{"trollface.png", "schizo_0.mp4"} {
+		t.Run(filename, func(t *testing.T) {
+			SetMemoryBudget(MemoryBudget{Max: 1 << 10, FailFast: true})
+			file, err := FileFromPath(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 256)); err != ErrMemoryBudgetExceeded {
+				t.Errorf("CreateThumbnail() error = %v, want = %v", err, ErrMemoryBudgetExceeded)
+			}
+			SetMemoryBudget(MemoryBudget{Max: 1 << 30})
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 256)); err != nil {
+				t.Errorf("CreateThumbnail() error = %v", err)
+			}
+			if stats := MemoryUsage(); stats.Reserved != 0 || stats.HighWater == 0 {
+				t.Errorf("MemoryUsage() = %+v, want no reservations and a high water mark", stats)
+			}
+		})
+	}
+}
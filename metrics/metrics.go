@@ -0,0 +1,331 @@
+// Package metrics exposes the thumbnailer's Observer notifications and memory usage in the Prometheus text exposition
+// format, without depending on the Prometheus client libraries.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the duration histograms' buckets used by New when none are
+// supplied.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Collector is a thumbnailer.Observer that aggregates the phases and jobs it's notified of into counters and
+// histograms, and an http.Handler serving them, along with gauges of thumbnailer.MemoryUsage(), in the Prometheus text
+// exposition format. Durations are labelled by the top-level media type ("image", "video", "audio" and so on) and
+// failures by the thumbnailer.ErrorKind of the error. Install it with thumbnailer.SetObserver.
+type Collector struct {
+	mu          sync.Mutex
+	buckets     []float64
+	phases      map[phaseKey]*histogram
+	failures    map[failureKey]uint64
+	jobs        map[jobKey]uint64
+	jobDuration map[string]*histogram
+	counters    map[counterKey]int64
+	memory      func() thumbnailer.MemoryStats
+}
+
+type phaseKey struct{ phase, media string }
+
+type failureKey struct{ phase, kind string }
+
+type jobKey struct{ media, outcome string }
+
+type counterKey struct{ name, media string }
+
+// Names of the byte and frame counters.
+const (
+	sniffedBytes = "thumbnailer_sniffed_bytes_total"
+	spooledBytes = "thumbnailer_spooled_bytes_total"
+	inputBytes   = "thumbnailer_input_bytes_total"
+	readBytes    = "thumbnailer_read_bytes_total"
+	outputBytes  = "thumbnailer_output_bytes_total"
+	frames       = "thumbnailer_frames_sampled_total"
+)
+
+var counterHelp = map[string]string{
+	sniffedBytes: "Bytes read while sniffing MIME types.",
+	spooledBytes: "Bytes spooled to memory or temporary files.",
+	inputBytes:   "Sizes of the inputs of thumbnail jobs, when known.",
+	readBytes:    "Bytes read from the inputs of thumbnail jobs.",
+	outputBytes:  "Bytes of thumbnails written.",
+	frames:       "Video frames sampled for picking thumbnails.",
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// New returns a Collector with duration histograms using the supplied bucket upper bounds in seconds, or
+// DefaultBuckets if there are none.
+func New(buckets ...float64) *Collector {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Collector{
+		buckets:     buckets,
+		phases:      make(map[phaseKey]*histogram),
+		failures:    make(map[failureKey]uint64),
+		jobs:        make(map[jobKey]uint64),
+		jobDuration: make(map[string]*histogram),
+		counters:    make(map[counterKey]int64),
+		memory:      thumbnailer.MemoryUsage,
+	}
+}
+
+func (c *Collector) newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(c.buckets))}
+}
+
+func media(mediaType string) string {
+	if mediaType == "" {
+		return "unknown"
+	}
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		return mediaType[:i]
+	}
+	return mediaType
+}
+
+func kind(err error) string {
+	return strings.ReplaceAll(thumbnailer.KindOf(err).String(), " ", "_")
+}
+
+// ObservePhase implements thumbnailer.Observer.
+func (c *Collector) ObservePhase(_ context.Context, event thumbnailer.PhaseEvent) {
+	m := media(event.MediaType)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := phaseKey{event.Phase.String(), m}
+	h := c.phases[key]
+	if h == nil {
+		h = c.newHistogram()
+		c.phases[key] = h
+	}
+	h.observe(c.buckets, event.Duration.Seconds())
+	if event.Err != nil {
+		c.failures[failureKey{key.phase, kind(event.Err)}]++
+	}
+	switch event.Phase {
+	case thumbnailer.PhaseSniff:
+		c.counters[counterKey{sniffedBytes, m}] += event.Bytes
+	case thumbnailer.PhaseSpool:
+		c.counters[counterKey{spooledBytes, m}] += event.Bytes
+	}
+}
+
+// ObserveJob implements thumbnailer.Observer.
+func (c *Collector) ObserveJob(_ context.Context, event thumbnailer.JobEvent) {
+	m, outcome := media(event.MediaType), "ok"
+	if event.Err != nil {
+		outcome = kind(event.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs[jobKey{m, outcome}]++
+	h := c.jobDuration[m]
+	if h == nil {
+		h = c.newHistogram()
+		c.jobDuration[m] = h
+	}
+	h.observe(c.buckets, event.Duration.Seconds())
+	c.counters[counterKey{inputBytes, m}] += event.InputSize
+	c.counters[counterKey{readBytes, m}] += event.BytesRead
+	c.counters[counterKey{outputBytes, m}] += event.OutputBytes
+	c.counters[counterKey{frames, m}] += int64(event.Frames)
+}
+
+// ServeHTTP implements http.Handler, serving the metrics.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the metrics to the io.Writer in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{Writer: w}
+	bw := bufio.NewWriter(cw)
+	c.mu.Lock()
+	c.writePhases(bw)
+	c.writeJobs(bw)
+	c.writeCounters(bw)
+	c.mu.Unlock()
+	writeMemory(bw, c.memory())
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (c *Collector) writePhases(w *bufio.Writer) {
+	keys := make([]phaseKey, 0, len(c.phases))
+	for k := range c.phases {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].phase < keys[j].phase || keys[i].phase == keys[j].phase && keys[i].media < keys[j].media
+	})
+	name := "thumbnailer_phase_duration_seconds"
+	header(w, name, "histogram", "Durations of the phases of thumbnail jobs.")
+	for _, k := range keys {
+		c.writeHistogram(w, name, labels("phase", k.phase, "media", k.media), c.phases[k])
+	}
+	failures := make([]failureKey, 0, len(c.failures))
+	for k := range c.failures {
+		failures = append(failures, k)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		a, b := failures[i], failures[j]
+		return a.phase < b.phase || a.phase == b.phase && a.kind < b.kind
+	})
+	name = "thumbnailer_phase_failures_total"
+	header(w, name, "counter", "Failed phases of thumbnail jobs by error kind.")
+	for _, k := range failures {
+		sample(w, name, labels("phase", k.phase, "kind", k.kind), float64(c.failures[k]))
+	}
+}
+
+func (c *Collector) writeJobs(w *bufio.Writer) {
+	keys := make([]jobKey, 0, len(c.jobs))
+	for k := range c.jobs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].media < keys[j].media || keys[i].media == keys[j].media && keys[i].outcome < keys[j].outcome
+	})
+	name := "thumbnailer_jobs_total"
+	header(w, name, "counter", `Finished thumbnail jobs by outcome ("ok" or the error kind).`)
+	for _, k := range keys {
+		sample(w, name, labels("media", k.media, "outcome", k.outcome), float64(c.jobs[k]))
+	}
+	mediaTypes := make([]string, 0, len(c.jobDuration))
+	for m := range c.jobDuration {
+		mediaTypes = append(mediaTypes, m)
+	}
+	sort.Strings(mediaTypes)
+	name = "thumbnailer_job_duration_seconds"
+	header(w, name, "histogram", "Durations of thumbnail jobs.")
+	for _, m := range mediaTypes {
+		c.writeHistogram(w, name, labels("media", m), c.jobDuration[m])
+	}
+}
+
+func (c *Collector) writeCounters(w *bufio.Writer) {
+	keys := make([]counterKey, 0, len(c.counters))
+	for k := range c.counters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name || keys[i].name == keys[j].name && keys[i].media < keys[j].media
+	})
+	for i, k := range keys {
+		if i == 0 || keys[i-1].name != k.name {
+			header(w, k.name, "counter", counterHelp[k.name])
+		}
+		sample(w, k.name, labels("media", k.media), float64(c.counters[k]))
+	}
+}
+
+func writeMemory(w *bufio.Writer, stats thumbnailer.MemoryStats) {
+	gauges := []struct {
+		name, help string
+		value      int64
+	}{
+		{"thumbnailer_vips_memory_bytes", "Memory tracked by vips.", stats.VIPS.Memory},
+		{"thumbnailer_vips_memory_highwater_bytes", "Peak memory tracked by vips.", stats.VIPS.MemoryHighWater},
+		{"thumbnailer_vips_allocations", "Allocations tracked by vips.", int64(stats.VIPS.Allocations)},
+		{"thumbnailer_vips_open_files", "Files opened by vips.", int64(stats.VIPS.Files)},
+		{"thumbnailer_memory_budget_bytes", "The memory budget, or zero if there is none.", stats.Max},
+		{"thumbnailer_memory_reserved_bytes", "Memory reserved from the memory budget.", stats.Reserved},
+		{"thumbnailer_memory_waiting_jobs", "Jobs waiting for a memory reservation.", int64(stats.Waiting)},
+	}
+	for _, g := range gauges {
+		header(w, g.name, "gauge", g.help)
+		sample(w, g.name, "", float64(g.value))
+	}
+}
+
+func (c *Collector) writeHistogram(w *bufio.Writer, name, labels string, h *histogram) {
+	prefix := labels[:len(labels)-1] + ","
+	for i, b := range c.buckets {
+		sample(w, name+"_bucket", prefix+`le="`+formatFloat(b)+`"}`, float64(h.counts[i]))
+	}
+	sample(w, name+"_bucket", prefix+`le="+Inf"}`, float64(h.count))
+	sample(w, name+"_sum", labels, h.sum)
+	sample(w, name+"_count", labels, float64(h.count))
+}
+
+func header(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats the name-value pairs as a label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		labelEscaper.WriteString(&b, pairs[i+1])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
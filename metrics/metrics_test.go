@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+func TestCollector(t *testing.T) {
+	c := New(0.1, 1)
+	c.memory = func() thumbnailer.MemoryStats {
+		return thumbnailer.MemoryStats{Reserved: 42, VIPS: thumbnailer.VIPSMemoryProfile{Memory: 1024}}
+	}
+	ctx := context.Background()
+	c.ObservePhase(ctx, thumbnailer.PhaseEvent{Phase: thumbnailer.PhaseOpen, MediaType: "video/mp4",
+		Duration: 50 * time.Millisecond})
+	c.ObservePhase(ctx, thumbnailer.PhaseEvent{Phase: thumbnailer.PhaseOpen, MediaType: "video/webm",
+		Duration: 500 * time.Millisecond, Err: thumbnailer.ErrInvalidData})
+	c.ObservePhase(ctx, thumbnailer.PhaseEvent{Phase: thumbnailer.PhaseSpool, MediaType: "image/jpeg",
+		Duration: 2 * time.Second, Bytes: 1000})
+	c.ObserveJob(ctx, thumbnailer.JobEvent{MediaType: "video/mp4", Duration: time.Second, BytesRead: 10, Frames: 5})
+	c.ObserveJob(ctx, thumbnailer.JobEvent{MediaType: "video/webm", Duration: time.Second, Err: context.Canceled})
+	c.ObserveJob(ctx, thumbnailer.JobEvent{MediaType: "", Err: errors.New("other")})
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %v", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE thumbnailer_phase_duration_seconds histogram",
+		`thumbnailer_phase_duration_seconds_bucket{phase="open",media="video",le="0.1"} 1`,
+		`thumbnailer_phase_duration_seconds_bucket{phase="open",media="video",le="1"} 2`,
+		`thumbnailer_phase_duration_seconds_bucket{phase="open",media="video",le="+Inf"} 2`,
+		`thumbnailer_phase_duration_seconds_count{phase="open",media="video"} 2`,
+		`thumbnailer_phase_duration_seconds_bucket{phase="spool",media="image",le="1"} 0`,
+		`thumbnailer_phase_failures_total{phase="open",kind="corrupt_data"} 1`,
+		`thumbnailer_jobs_total{media="video",outcome="ok"} 1`,
+		`thumbnailer_jobs_total{media="video",outcome="cancelled"} 1`,
+		`thumbnailer_jobs_total{media="unknown",outcome="internal"} 1`,
+		`thumbnailer_job_duration_seconds_sum{media="video"} 2`,
+		`thumbnailer_spooled_bytes_total{media="image"} 1000`,
+		`thumbnailer_read_bytes_total{media="video"} 10`,
+		`thumbnailer_frames_sampled_total{media="video"} 5`,
+		"# TYPE thumbnailer_vips_memory_bytes gauge",
+		"thumbnailer_vips_memory_bytes 1024",
+		"thumbnailer_memory_reserved_bytes 42",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if got, want := labels("a", `x"y\z`+"\n"), `{a="x\"y\\z\n"}`; got != want {
+		t.Errorf("labels() want = %v, got = %v", want, got)
+	}
+}
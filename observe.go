@@ -0,0 +1,236 @@
+package thumbnailer
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zRedShift/mimemagic"
+)
+
+// Phase is a stage of creating a thumbnail, as reported to an Observer. PhaseSniff is the MIME sniffing done by the
+// FileFrom functions, PhaseSpool is the spooling of non-seekable input to memory or a temporary file, PhaseOpen is
+// FFmpeg opening the container and probing its streams, PhaseSample is FFmpeg decoding frames and picking the most
+// representative one, and PhaseDuration is FFmpeg reading the whole input for its duration (when the container doesn't
+// report it). PhaseResize is vips loading the image's header (or the picked frame) and setting up the resize, and
+// PhaseEncode is vips encoding the thumbnail, which is when the pixels are actually decoded and resized, as vips
+// evaluates lazily.
+type Phase int
+
+// Possible values for Phase.
+const (
+	PhaseSniff Phase = iota
+	PhaseSpool
+	PhaseOpen
+	PhaseSample
+	PhaseDuration
+	PhaseResize
+	PhaseEncode
+)
+
+var phaseNames = [...]string{"sniff", "spool", "open", "sample", "duration", "resize", "encode"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// PhaseEvent describes a finished Phase of a File with the supplied MediaType, which took Duration from Start. Bytes
+// is the number of bytes sniffed or spooled, Frames the number of frames sampled, and Err the error the Phase failed
+// with, if any.
+type PhaseEvent struct {
+	Phase     Phase
+	MediaType string
+	Start     time.Time
+	Duration  time.Duration
+	Bytes     int64
+	Frames    int
+	Err       error
+}
+
+// JobEvent describes a finished call to CreateThumbnailWithContext for a File with the supplied MediaType and
+// InputSize (zero if unknown), which took Duration from Start. BytesRead is the number of bytes read from the File's
+// io.Reader (zero for Files read by path), OutputBytes the size of the thumbnail, Frames the number of frames sampled,
+// and Err the returned error.
+type JobEvent struct {
+	MediaType                         string
+	Start                             time.Time
+	Duration                          time.Duration
+	InputSize, BytesRead, OutputBytes int64
+	Frames                            int
+	Err                               error
+}
+
+// Observer is notified of every finished Phase and call to CreateThumbnailWithContext, with the context passed to it
+// (context.Background() for PhaseSniff). Its methods may be called concurrently, and shouldn't block.
+type Observer interface {
+	ObservePhase(ctx context.Context, event PhaseEvent)
+	ObserveJob(ctx context.Context, event JobEvent)
+}
+
+var observer = struct {
+	sync.RWMutex
+	Observer
+}{}
+
+// SetObserver sets the Observer notified of all thumbnail jobs. A nil Observer disables the notifications.
+func SetObserver(o Observer) {
+	observer.Lock()
+	observer.Observer = o
+	observer.Unlock()
+}
+
+func currentObserver() Observer {
+	observer.RLock()
+	defer observer.RUnlock()
+	return observer.Observer
+}
+
+// observation is the state of an observed call to CreateThumbnailWithContext.
+type observation struct {
+	Observer
+	ctx           context.Context
+	start         time.Time
+	read, written int64
+	frames        int
+	reader        io.Reader
+	writer        io.Writer
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+func (r countingReader) unwrap() io.Reader { return r.Reader }
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// observe starts observing the File's job if there's an Observer, returning nil otherwise.
+func (f *File) observe(ctx context.Context) *observation {
+	o := currentObserver()
+	if o == nil {
+		return nil
+	}
+	obs := &observation{Observer: o, ctx: ctx, start: time.Now()}
+	f.obs = obs
+	return obs
+}
+
+// count counts the bytes read and written through the File, and returns a function restoring its io.Reader and
+// io.Writer.
+func (obs *observation) count(f *File) func() {
+	if obs == nil {
+		return func() {}
+	}
+	reader, writer := f.Reader, f.Writer
+	if reader != nil {
+		f.Reader = countingReader{reader, &obs.read}
+	}
+	if writer != nil {
+		f.Writer = countingWriter{writer, &obs.written}
+	}
+	return func() {
+		f.Reader, f.Writer = reader, writer
+	}
+}
+
+// done notifies the Observer of the File's finished job.
+func (obs *observation) done(f *File, err error) {
+	if obs == nil {
+		return
+	}
+	f.obs = nil
+	written := atomic.LoadInt64(&obs.written)
+	if f.Thumbnail.Path != "" && f.ThumbCreated {
+		if fi, sErr := os.Stat(f.Thumbnail.Path); sErr == nil {
+			written = fi.Size()
+		}
+	}
+	obs.ObserveJob(obs.ctx, JobEvent{
+		MediaType:   f.MediaType.MediaType(),
+		Start:       obs.start,
+		Duration:    time.Since(obs.start),
+		InputSize:   f.Size,
+		BytesRead:   atomic.LoadInt64(&obs.read),
+		OutputBytes: written,
+		Frames:      obs.frames,
+		Err:         err,
+	})
+}
+
+// phase starts timing a Phase of the File's job, and returns a function notifying the Observer (if the job is
+// observed) of the finished Phase, filling in the rest of the supplied PhaseEvent.
+func (f *File) phase(phase Phase) func(event PhaseEvent) {
+	obs := f.obs
+	if obs == nil {
+		return func(PhaseEvent) {}
+	}
+	start := time.Now()
+	return func(event PhaseEvent) {
+		if phase == PhaseSample {
+			obs.frames = event.Frames
+		}
+		f.reportPhase(phase, start, time.Since(start), event)
+	}
+}
+
+// reportPhase notifies the Observer of a Phase of the File's job timed elsewhere.
+func (f *File) reportPhase(phase Phase, start time.Time, duration time.Duration, event PhaseEvent) {
+	if obs := f.obs; obs != nil {
+		event.Phase, event.MediaType, event.Start, event.Duration = phase, f.MediaType.MediaType(), start, duration
+		obs.ObservePhase(obs.ctx, event)
+	}
+}
+
+// sniff matches the data's MediaType, notifying the Observer of the PhaseSniff.
+func sniff(data []byte, name string) mimemagic.MediaType {
+	start := time.Now()
+	mediaType := mimemagic.Match(data, name, mimemagic.Magic)
+	observeSniff(start, mediaType, int64(len(data)))
+	return mediaType
+}
+
+// sniffReader matches the MediaType of the first probeSize bytes of the io.Reader, notifying the Observer of the
+// PhaseSniff.
+func sniffReader(r io.Reader, name string) (mimemagic.MediaType, error) {
+	var n int64
+	start := time.Now()
+	mediaType, err := mimemagic.MatchReader(countingReader{r, &n}, name, probeSize, mimemagic.Magic)
+	observeSniff(start, mediaType, n)
+	return mediaType, err
+}
+
+func observeSniff(start time.Time, mediaType mimemagic.MediaType, n int64) {
+	if o := currentObserver(); o != nil {
+		o.ObservePhase(context.Background(), PhaseEvent{
+			Phase:     PhaseSniff,
+			MediaType: mediaType.MediaType(),
+			Start:     start,
+			Duration:  time.Since(start),
+			Bytes:     n,
+		})
+	}
+}
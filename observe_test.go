@@ -0,0 +1,127 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type recordingObserver struct {
+	sync.Mutex
+	phases []PhaseEvent
+	jobs   []JobEvent
+}
+
+func (o *recordingObserver) ObservePhase(_ context.Context, event PhaseEvent) {
+	o.Lock()
+	o.phases = append(o.phases, event)
+	o.Unlock()
+}
+
+func (o *recordingObserver) ObserveJob(_ context.Context, event JobEvent) {
+	o.Lock()
+	o.jobs = append(o.jobs, event)
+	o.Unlock()
+}
+
+func TestSetObserver(t *testing.T) {
+	tests := []struct {
+		filename string
+		reader   bool
+		phases   []Phase
+		frames   bool
+	}{
+		{"Landscape_8.jpg", true, []Phase{PhaseSniff, PhaseSpool, PhaseResize, PhaseEncode}, false},
+		{"schizo_0.mp4", false, []Phase{PhaseSniff, PhaseOpen, PhaseSample, PhaseResize, PhaseEncode}, true},
+	}
+	o := new(recordingObserver)
+	SetObserver(o)
+	defer SetObserver(nil)
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			o.Lock()
+			o.phases, o.jobs = nil, nil
+			o.Unlock()
+			path := filepath.Join("fixtures", test.filename)
+			var (
+				file *File
+				err  error
+			)
+			if test.reader {
+				f, oErr := os.Open(path)
+				if oErr != nil {
+					t.Fatal(oErr)
+				}
+				defer f.Close()
+				file, err = FileFromReader(f, test.filename)
+			} else {
+				file, err = FileFromPath(path)
+			}
+			if err != nil {
+				t.Fatalf("FileFrom() error = %v", err)
+			}
+			buf := new(bytes.Buffer)
+			if err = CreateThumbnail(file.ToWriter(buf, 256)); err != nil {
+				t.Fatalf("CreateThumbnail() error = %v", err)
+			}
+			o.Lock()
+			defer o.Unlock()
+			var phases []Phase
+			for _, event := range o.phases {
+				phases = append(phases, event.Phase)
+				if event.Err != nil {
+					t.Errorf("phase %v error = %v", event.Phase, event.Err)
+				}
+				if event.MediaType != file.MediaType.MediaType() {
+					t.Errorf("phase %v media type want = %v, got = %v", event.Phase, file.MediaType.MediaType(),
+						event.MediaType)
+				}
+				if event.Phase == PhaseSample && event.Frames == 0 {
+					t.Errorf("no frames sampled")
+				}
+			}
+			if !reflect.DeepEqual(phases, test.phases) {
+				t.Errorf("phases want = %v, got = %v", test.phases, phases)
+			}
+			if len(o.jobs) != 1 {
+				t.Fatalf("jobs want = 1, got = %v", len(o.jobs))
+			}
+			job := o.jobs[0]
+			if job.Err != nil || job.OutputBytes != int64(buf.Len()) || (job.Frames > 0) != test.frames {
+				t.Errorf("unexpected job %+v, output %v bytes", job, buf.Len())
+			}
+			if test.reader && job.BytesRead == 0 {
+				t.Errorf("no bytes read")
+			}
+		})
+	}
+}
+
+func TestObserverFailure(t *testing.T) {
+	o := new(recordingObserver)
+	SetObserver(o)
+	defer SetObserver(nil)
+	file, err := FileFromPath(filepath.Join("fixtures", "schizo_0.mp4"))
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = CreateThumbnailWithContext(ctx, file.ToWriter(ioutil.Discard, 256))
+	if err == nil {
+		t.Fatal("CreateThumbnailWithContext() error = nil")
+	}
+	o.Lock()
+	defer o.Unlock()
+	if len(o.jobs) != 1 || o.jobs[0].Err != err {
+		t.Errorf("job errors want = [%v], got = %+v", err, o.jobs)
+	}
+	if n := len(o.phases); n == 0 || o.phases[n-1].Err == nil {
+		t.Errorf("last phase didn't fail: %+v", o.phases)
+	}
+}
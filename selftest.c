@@ -0,0 +1,350 @@
+#include "selftest.h"
+
+static unsigned char pattern(int x, int y, int width, int height, int band, int n) {
+    switch (band) {
+        case 0:
+            return (unsigned char) (255 * x / width);
+        case 1:
+            return (unsigned char) (255 * y / height);
+        case 2:
+            return (unsigned char) (64 * n + 32);
+        default:
+            return (unsigned char) (x < width / 2 ? 255 : 96);
+    }
+}
+
+int synth_image(int format, int width, int height, int bands, int orientation, void **buf, size_t *len,
+                guint64 call, char **error) {
+    size_t size = (size_t) width * height * bands;
+    unsigned char *pixels = g_malloc(size);
+    for (int y = 0; y < height; y++) {
+        for (int x = 0; x < width; x++) {
+            for (int b = 0; b < bands; b++) {
+                pixels[(y * width + x) * bands + b] = pattern(x, y, width, height, b, 0);
+            }
+        }
+    }
+    VipsImage *tmp = vips_image_new_from_memory_copy(pixels, size, width, height, bands, VIPS_FORMAT_UCHAR);
+    g_free(pixels);
+    if (!tmp) {
+        *error = call_error(call);
+        return -1;
+    }
+    VipsImage *image;
+    int err = vips_copy(tmp, &image, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+    g_object_unref(tmp);
+    if (err) {
+        *error = call_error(call);
+        return -1;
+    }
+    if (orientation > 1) {
+        vips_image_set_int(image, VIPS_META_ORIENTATION, orientation);
+    }
+    switch (format) {
+        case FORMAT_PNG:
+            err = vips_pngsave_buffer(image, buf, len, NULL);
+            break;
+        case FORMAT_WEBP:
+            err = vips_webpsave_buffer(image, buf, len, "Q", 90, NULL);
+            break;
+        default:
+            err = vips_jpegsave_buffer(image, buf, len, "Q", 90, NULL);
+    }
+    g_object_unref(image);
+    if (err) {
+        *error = call_error(call);
+        return -1;
+    }
+    return 0;
+}
+
+typedef struct Buffer {
+    uint8_t *data;
+    int64_t size, capacity, pos;
+} Buffer;
+
+static int write_buffer(void *opaque, uint8_t *buf, int size) {
+    Buffer *b = opaque;
+    if (b->pos + size > b->capacity) {
+        int64_t capacity = FFMAX(2 * b->capacity, b->pos + size);
+        uint8_t *data = av_realloc(b->data, capacity);
+        if (!data) {
+            return AVERROR(ENOMEM);
+        }
+        b->data = data;
+        b->capacity = capacity;
+    }
+    memcpy(b->data + b->pos, buf, size);
+    b->pos += size;
+    b->size = FFMAX(b->size, b->pos);
+    return size;
+}
+
+static int64_t seek_buffer(void *opaque, int64_t offset, int whence) {
+    Buffer *b = opaque;
+    switch (whence & ~AVSEEK_FORCE) {
+        case SEEK_SET:
+            break;
+        case SEEK_CUR:
+            offset += b->pos;
+            break;
+        case SEEK_END:
+            offset += b->size;
+            break;
+        case AVSEEK_SIZE:
+            return b->size;
+        default:
+            return AVERROR(EINVAL);
+    }
+    if (offset < 0 || offset > b->size) {
+        return AVERROR(EINVAL);
+    }
+    return b->pos = offset;
+}
+
+static int open_muxer(const char *format, AVFormatContext **fmt_ctx, Buffer *buf) {
+    int err = avformat_alloc_output_context2(fmt_ctx, NULL, format, NULL);
+    if (err < 0) {
+        return err;
+    }
+    uint8_t *avio_buffer = av_malloc(SYNTH_BUFFER_SIZE);
+    if (!avio_buffer) {
+        return AVERROR(ENOMEM);
+    }
+    if (!((*fmt_ctx)->pb = avio_alloc_context(avio_buffer, SYNTH_BUFFER_SIZE, 1, buf, NULL, write_buffer,
+                                              seek_buffer))) {
+        av_free(avio_buffer);
+        return AVERROR(ENOMEM);
+    }
+    return 0;
+}
+
+static void free_muxer(AVFormatContext *fmt_ctx) {
+    if (!fmt_ctx) {
+        return;
+    }
+    if (fmt_ctx->pb) {
+        av_freep(&fmt_ctx->pb->buffer);
+        avio_context_free(&fmt_ctx->pb);
+    }
+    avformat_free_context(fmt_ctx);
+}
+
+static int encode(AVFormatContext *fmt_ctx, AVCodecContext *enc, AVStream *stream, AVFrame *frame, AVPacket *pkt) {
+    int err = avcodec_send_frame(enc, frame);
+    if (err < 0) {
+        return err;
+    }
+    while ((err = avcodec_receive_packet(enc, pkt)) >= 0) {
+        av_packet_rescale_ts(pkt, enc->time_base, stream->time_base);
+        pkt->stream_index = stream->index;
+        if ((err = av_interleaved_write_frame(fmt_ctx, pkt)) < 0) {
+            return err;
+        }
+    }
+    return err == AVERROR(EAGAIN) || err == AVERROR_EOF ? 0 : err;
+}
+
+static AVCodecContext *open_encoder(AVFormatContext *fmt_ctx, enum AVCodecID codec_id, AVStream **stream, int *err) {
+    const AVCodec *codec = avcodec_find_encoder(codec_id);
+    if (!codec) {
+        *err = AVERROR_ENCODER_NOT_FOUND;
+        return NULL;
+    }
+    AVCodecContext *enc = avcodec_alloc_context3(codec);
+    if (!enc || !(*stream = avformat_new_stream(fmt_ctx, NULL))) {
+        avcodec_free_context(&enc);
+        *err = AVERROR(ENOMEM);
+        return NULL;
+    }
+    if (fmt_ctx->oformat->flags & AVFMT_GLOBALHEADER) {
+        enc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+    }
+    if (codec->type == AVMEDIA_TYPE_VIDEO) {
+        enc->pix_fmt = codec->pix_fmts ? codec->pix_fmts[0] : AV_PIX_FMT_YUV420P;
+    } else {
+        enc->sample_fmt = codec->sample_fmts ? codec->sample_fmts[0] : AV_SAMPLE_FMT_S16;
+    }
+    *err = 0;
+    return enc;
+}
+
+static int start_encoder(AVCodecContext *enc, AVStream *stream) {
+    int err = avcodec_open2(enc, enc->codec, NULL);
+    if (err < 0) {
+        return err;
+    }
+    stream->time_base = enc->time_base;
+    return avcodec_parameters_from_context(stream->codecpar, enc);
+}
+
+static AVFrame *alloc_frame(int format, int width, int height, int nb_samples, int sample_rate) {
+    AVFrame *frame = av_frame_alloc();
+    if (!frame) {
+        return NULL;
+    }
+    frame->format = format;
+    frame->width = width;
+    frame->height = height;
+    if (nb_samples) {
+        frame->nb_samples = nb_samples;
+        frame->sample_rate = sample_rate;
+        frame->channel_layout = AV_CH_LAYOUT_MONO;
+    }
+    if (av_frame_get_buffer(frame, 0) < 0) {
+        av_frame_free(&frame);
+    }
+    return frame;
+}
+
+static void fill_rgb(AVFrame *frame, int n) {
+    for (int y = 0; y < frame->height; y++) {
+        for (int x = 0; x < frame->width; x++) {
+            for (int b = 0; b < 3; b++) {
+                frame->data[0][y * frame->linesize[0] + 3 * x + b] = pattern(x, y, frame->width, frame->height, b, n);
+            }
+        }
+    }
+}
+
+static int finish(AVFormatContext *fmt_ctx, Buffer *buf, uint8_t **data, int *size) {
+    int err = av_write_trailer(fmt_ctx);
+    if (err < 0) {
+        return err;
+    }
+    avio_flush(fmt_ctx->pb);
+    *data = buf->data;
+    *size = (int) buf->size;
+    buf->data = NULL;
+    return 0;
+}
+
+int synth_video(const char *format, enum AVCodecID codec_id, int width, int height, int frames, int rotation,
+                uint8_t **data, int *size) {
+    AVFormatContext *fmt_ctx = NULL;
+    AVCodecContext *enc = NULL;
+    AVStream *stream = NULL;
+    AVFrame *rgb = NULL, *frame = NULL;
+    AVPacket *pkt = NULL;
+    struct SwsContext *sws_ctx = NULL;
+    Buffer buf = {0};
+    int err = open_muxer(format, &fmt_ctx, &buf);
+    if (err < 0 || !(enc = open_encoder(fmt_ctx, codec_id, &stream, &err))) {
+        goto end;
+    }
+    enc->width = width;
+    enc->height = height;
+    enc->time_base = (AVRational) {1, 10};
+    if ((err = start_encoder(enc, stream)) < 0) {
+        goto end;
+    }
+    if (rotation) {
+        int32_t *matrix = (int32_t *) av_stream_new_side_data(stream, AV_PKT_DATA_DISPLAYMATRIX, 9 * sizeof(int32_t));
+        if (!matrix) {
+            err = AVERROR(ENOMEM);
+            goto end;
+        }
+        av_display_rotation_set(matrix, -rotation);
+    }
+    if (!(rgb = alloc_frame(AV_PIX_FMT_RGB24, width, height, 0, 0)) ||
+        !(frame = alloc_frame(enc->pix_fmt, width, height, 0, 0)) || !(pkt = av_packet_alloc()) ||
+        !(sws_ctx = sws_getContext(width, height, AV_PIX_FMT_RGB24, width, height, enc->pix_fmt, SWS_BILINEAR, NULL,
+                                   NULL, NULL))) {
+        err = AVERROR(ENOMEM);
+        goto end;
+    }
+    if ((err = avformat_write_header(fmt_ctx, NULL)) < 0) {
+        goto end;
+    }
+    for (int i = 0; i < frames; i++) {
+        fill_rgb(rgb, i);
+        if ((err = av_frame_make_writable(frame)) < 0) {
+            goto end;
+        }
+        sws_scale(sws_ctx, (const uint8_t *const *) rgb->data, rgb->linesize, 0, height, frame->data, frame->linesize);
+        frame->pts = i;
+        if ((err = encode(fmt_ctx, enc, stream, frame, pkt)) < 0) {
+            goto end;
+        }
+    }
+    if ((err = encode(fmt_ctx, enc, stream, NULL, pkt)) >= 0) {
+        err = finish(fmt_ctx, &buf, data, size);
+    }
+end:
+    sws_freeContext(sws_ctx);
+    av_packet_free(&pkt);
+    av_frame_free(&frame);
+    av_frame_free(&rgb);
+    avcodec_free_context(&enc);
+    free_muxer(fmt_ctx);
+    av_free(buf.data);
+    return err;
+}
+
+int synth_audio(const uint8_t *cover, int cover_size, int cover_width, int cover_height, const char *title,
+                uint8_t **data, int *size) {
+    AVFormatContext *fmt_ctx = NULL;
+    AVCodecContext *enc = NULL;
+    AVStream *stream = NULL, *picture = NULL;
+    AVFrame *frame = NULL;
+    AVPacket *pkt = NULL;
+    Buffer buf = {0};
+    int err = open_muxer("flac", &fmt_ctx, &buf);
+    if (err < 0 || !(enc = open_encoder(fmt_ctx, AV_CODEC_ID_FLAC, &stream, &err))) {
+        goto end;
+    }
+    enc->sample_rate = 8000;
+    enc->channels = 1;
+    enc->channel_layout = AV_CH_LAYOUT_MONO;
+    enc->time_base = (AVRational) {1, enc->sample_rate};
+    if ((err = start_encoder(enc, stream)) < 0) {
+        goto end;
+    }
+    if (!(picture = avformat_new_stream(fmt_ctx, NULL)) || !(pkt = av_packet_alloc())) {
+        err = AVERROR(ENOMEM);
+        goto end;
+    }
+    picture->disposition = AV_DISPOSITION_ATTACHED_PIC;
+    picture->codecpar->codec_type = AVMEDIA_TYPE_VIDEO;
+    picture->codecpar->codec_id = AV_CODEC_ID_MJPEG;
+    picture->codecpar->width = cover_width;
+    picture->codecpar->height = cover_height;
+    av_dict_set(&fmt_ctx->metadata, "title", title, 0);
+    if ((err = avformat_write_header(fmt_ctx, NULL)) < 0 || (err = av_new_packet(pkt, cover_size)) < 0) {
+        goto end;
+    }
+    memcpy(pkt->data, cover, cover_size);
+    pkt->stream_index = picture->index;
+    pkt->flags |= AV_PKT_FLAG_KEY;
+    if ((err = av_interleaved_write_frame(fmt_ctx, pkt)) < 0) {
+        goto end;
+    }
+    int nb_samples = enc->frame_size > 0 ? enc->frame_size : 1024;
+    if (!(frame = alloc_frame(enc->sample_fmt, 0, 0, nb_samples, enc->sample_rate))) {
+        err = AVERROR(ENOMEM);
+        goto end;
+    }
+    for (int64_t pts = 0; pts < enc->sample_rate; pts += nb_samples) {
+        if ((err = av_frame_make_writable(frame)) < 0) {
+            goto end;
+        }
+        int16_t *samples = (int16_t *) frame->data[0];
+        for (int i = 0; i < nb_samples; i++) {
+            samples[i] = (int16_t) (((pts + i) * 440 * 64 / enc->sample_rate) % 64 * 256 - 8192);
+        }
+        frame->pts = pts;
+        if ((err = encode(fmt_ctx, enc, stream, frame, pkt)) < 0) {
+            goto end;
+        }
+    }
+    if ((err = encode(fmt_ctx, enc, stream, NULL, pkt)) >= 0) {
+        err = finish(fmt_ctx, &buf, data, size);
+    }
+end:
+    av_packet_free(&pkt);
+    av_frame_free(&frame);
+    avcodec_free_context(&enc);
+    free_muxer(fmt_ctx);
+    av_free(buf.data);
+    return err;
+}
@@ -0,0 +1,248 @@
+package thumbnailer
+
+// #include "selftest.h"
+import "C"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/zRedShift/mimemagic"
+)
+
+const (
+	selfTestWidth, selfTestHeight = 64, 48
+	selfTestTitle                 = "thumbnailer self-test"
+)
+
+// Possible values for SelfTestResult.Stage.
+const (
+	StageSynthesize = "synthesize"
+	StageThumbnail  = "thumbnail"
+	StageVerify     = "verify"
+)
+
+// SelfTestResult is the outcome of one of the inputs of SelfTest: its Name ("jpeg", "png", "webp", "gif", "video" or
+// "audio"), sniffed MediaType, and the time it took. A failed input has an Err and the Stage it failed at:
+// StageSynthesize if the input couldn't be encoded (usually a missing vips saver or FFmpeg encoder or muxer, which
+// says more about the build than about thumbnailing), StageThumbnail if CreateThumbnailWithContext failed, or
+// StageVerify if the resulting File or thumbnail didn't look as expected.
+type SelfTestResult struct {
+	Name, MediaType, Stage string
+	Duration               time.Duration
+	Err                    error
+}
+
+// SelfTestReport holds the SelfTestResult of every input of SelfTest.
+type SelfTestReport []SelfTestResult
+
+// Err returns an error naming the failed inputs along with their errors, or nil if all of them passed.
+func (r SelfTestReport) Err() error {
+	var failed []string
+	for _, res := range r {
+		if res.Err != nil {
+			failed = append(failed, res.Name+" ("+res.Stage+"): "+res.Err.Error())
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.New("thumbnailer: self-test failed: " + strings.Join(failed, "; "))
+}
+
+type selfTestCase struct {
+	name, filename, mediaType string
+	synthesize                func() ([]byte, error)
+	alpha, av                 bool
+	orientation               int
+	title                     string
+}
+
+// SelfTest verifies the linked libraries actually work, e.g. before a new build takes traffic. It synthesizes small
+// inputs in memory through the vips savers and FFmpeg encoders: a JPEG with an EXIF orientation, a PNG and a WebP
+// with alpha, an animated GIF, an MPEG-4 video with rotation metadata, and a FLAC file with cover art and a title. It
+// then thumbnails each with CreateThumbnailWithContext, and verifies the sniffed media type, dimensions, orientation,
+// alpha, duration and metadata of the File, and the format and aspect ratio of the thumbnail. The inputs are tested
+// in order, until the context is done.
+func SelfTest(ctx context.Context) SelfTestReport {
+	initVIPS()
+	cases := []selfTestCase{
+		{name: "jpeg", filename: "self-test.jpg", mediaType: "image/jpeg", orientation: 6,
+			synthesize: func() ([]byte, error) { return synthImage(FormatJPEG, 3, 6) }},
+		{name: "png", filename: "self-test.png", mediaType: "image/png", alpha: true,
+			synthesize: func() ([]byte, error) { return synthImage(FormatPNG, 4, 1) }},
+		{name: "webp", filename: "self-test.webp", mediaType: "image/webp", alpha: true,
+			synthesize: func() ([]byte, error) { return synthImage(FormatWebP, 4, 1) }},
+		{name: "gif", filename: "self-test.gif", mediaType: "image/gif",
+			synthesize: func() ([]byte, error) { return synthVideo("gif", C.AV_CODEC_ID_GIF, 3, 0) }},
+		{name: "video", filename: "self-test.mp4", mediaType: "video/mp4", av: true, orientation: 6,
+			synthesize: func() ([]byte, error) { return synthVideo("mp4", C.AV_CODEC_ID_MPEG4, 10, 90) }},
+		{name: "audio", filename: "self-test.flac", mediaType: "audio/flac", av: true, title: selfTestTitle,
+			synthesize: func() ([]byte, error) {
+				cover, err := synthImage(FormatJPEG, 3, 1)
+				if err != nil {
+					return nil, err
+				}
+				return synthAudio(cover)
+			}},
+	}
+	report := make(SelfTestReport, 0, len(cases))
+	for _, c := range cases {
+		if err := ctx.Err(); err != nil {
+			report = append(report, SelfTestResult{Name: c.name, Stage: StageThumbnail, Err: err})
+			continue
+		}
+		start := time.Now()
+		res := c.run(ctx)
+		res.Name, res.Duration = c.name, time.Since(start)
+		report = append(report, res)
+	}
+	return report
+}
+
+func (c selfTestCase) run(ctx context.Context) SelfTestResult {
+	data, err := c.synthesize()
+	if err != nil {
+		return SelfTestResult{Stage: StageSynthesize, Err: err}
+	}
+	file, err := FileFromReadSeeker(bytes.NewReader(data), true, c.filename)
+	if err != nil {
+		return SelfTestResult{Stage: StageThumbnail, Err: err}
+	}
+	res := SelfTestResult{MediaType: file.MediaType.MediaType(), Stage: StageThumbnail}
+	output := new(bytes.Buffer)
+	if res.Err = CreateThumbnailWithContext(ctx, file.ToWriter(output, selfTestWidth/2)); res.Err != nil {
+		return res
+	}
+	res.Stage, res.Err = StageVerify, c.verify(file, output.Bytes())
+	if res.Err == nil {
+		res.Stage = ""
+	}
+	return res
+}
+
+func selfTestError(what string, want, got interface{}) error {
+	return errors.New("thumbnailer: unexpected " + what + ": want " + selfTestString(want) + ", got " +
+		selfTestString(got))
+}
+
+func selfTestString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case Dimensions:
+		return strconv.Itoa(v.Width) + "x" + strconv.Itoa(v.Height)
+	}
+	return "?"
+}
+
+// selfTestShape names the shape of an image by whether it's landscape.
+func selfTestShape(landscape bool) string {
+	if landscape {
+		return "landscape"
+	}
+	return "portrait"
+}
+
+func (c selfTestCase) verify(file *File, output []byte) error {
+	width, height := selfTestWidth, selfTestHeight
+	orientation := c.orientation
+	if orientation == 0 {
+		orientation = 1
+	}
+	if orientation > 4 {
+		width, height = height, width
+	}
+	thumbType, thumbLandscape := "image/jpeg", file.Thumbnail.Width > file.Thumbnail.Height
+	if c.alpha {
+		thumbType = "image/png"
+	}
+	switch {
+	case file.MediaType.MediaType() != c.mediaType:
+		return selfTestError("media type", c.mediaType, file.MediaType.MediaType())
+	case file.Dimensions != Dimensions{width, height}:
+		return selfTestError("dimensions", Dimensions{width, height}, file.Dimensions)
+	case file.Orientation != orientation:
+		return selfTestError("orientation", orientation, file.Orientation)
+	case file.HasAlpha != c.alpha:
+		return selfTestError("alpha", c.alpha, file.HasAlpha)
+	case c.av && file.Duration <= 0:
+		return errors.New("thumbnailer: missing duration")
+	case file.Title != c.title:
+		return selfTestError("title", c.title, file.Title)
+	case !file.ThumbCreated || len(output) == 0:
+		return errors.New("thumbnailer: thumbnail not created")
+	case mimemagic.MatchMagic(output).MediaType() != thumbType:
+		return selfTestError("thumbnail media type", thumbType, mimemagic.MatchMagic(output).MediaType())
+	case thumbLandscape != (width > height):
+		return selfTestError("thumbnail orientation", selfTestShape(width > height), selfTestShape(thumbLandscape))
+	}
+	return nil
+}
+
+// synthImage encodes a test pattern with vips, with an alpha channel if it has 4 bands.
+func synthImage(format Format, bands, orientation int) ([]byte, error) {
+	runtime.LockOSThread()
+	defer func() {
+		C.vips_thread_shutdown()
+		runtime.UnlockOSThread()
+	}()
+	var (
+		buf     unsafe.Pointer
+		size    C.size_t
+		capture *C.char
+	)
+	call := C.begin_call()
+	defer C.end_call()
+	if C.synth_image(C.int(format), selfTestWidth, selfTestHeight, C.int(bands), C.int(orientation), &buf, &size,
+		call, &capture) != 0 {
+		if capture == nil {
+			return nil, thumbError(vipsError{domain: "thumbnailer", error: "failed to synthesize an image"})
+		}
+		return nil, thumbError(capturedError(&capture))
+	}
+	defer C.g_free(C.gpointer(buf))
+	return C.GoBytes(buf, C.int(size)), nil
+}
+
+// synthVideo encodes frames of a test pattern with FFmpeg, rotated by the supplied degrees clockwise.
+func synthVideo(format string, codec C.enum_AVCodecID, frames, rotation int) ([]byte, error) {
+	cFormat := C.CString(format)
+	defer free(unsafe.Pointer(cFormat))
+	var (
+		data *C.uint8_t
+		size C.int
+	)
+	if err := C.synth_video(cFormat, codec, selfTestWidth, selfTestHeight, C.int(frames), C.int(rotation), &data,
+		&size); err < 0 {
+		return nil, thumbError(avError(err))
+	}
+	defer C.av_free(unsafe.Pointer(data))
+	return C.GoBytes(unsafe.Pointer(data), size), nil
+}
+
+// synthAudio encodes a second of a tone as FLAC, with the JPEG as its cover art.
+func synthAudio(cover []byte) ([]byte, error) {
+	cCover, title := C.CBytes(cover), C.CString(selfTestTitle)
+	defer free(cCover)
+	defer free(unsafe.Pointer(title))
+	var (
+		data *C.uint8_t
+		size C.int
+	)
+	if err := C.synth_audio((*C.uint8_t)(cCover), C.int(len(cover)), selfTestWidth, selfTestHeight, title, &data,
+		&size); err < 0 {
+		return nil, thumbError(avError(err))
+	}
+	defer C.av_free(unsafe.Pointer(data))
+	return C.GoBytes(unsafe.Pointer(data), size), nil
+}
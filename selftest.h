@@ -0,0 +1,20 @@
+#include <string.h>
+
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include <libavutil/display.h>
+#include <libavutil/channel_layout.h>
+#include <libswscale/swscale.h>
+
+#include "vips.h"
+
+#define SYNTH_BUFFER_SIZE 1 << 12
+
+int synth_image(int format, int width, int height, int bands, int orientation, void **buf, size_t *len,
+                guint64 call, char **error);
+
+int synth_video(const char *format, enum AVCodecID codec_id, int width, int height, int frames, int rotation,
+                uint8_t **data, int *size);
+
+int synth_audio(const uint8_t *cover, int cover_size, int cover_width, int cover_height, const char *title,
+                uint8_t **data, int *size);
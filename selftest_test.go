@@ -0,0 +1,65 @@
+package thumbnailer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zRedShift/mimemagic"
+)
+
+func TestSelfTest(t *testing.T) {
+	report := SelfTest(context.Background())
+	if len(report) != 6 {
+		t.Fatalf("results want = 6, got = %v", len(report))
+	}
+	for _, res := range report {
+		if res.Err != nil {
+			t.Errorf("%v failed at %v: %v", res.Name, res.Stage, res.Err)
+		}
+	}
+	if err := report.Err(); (err != nil) != t.Failed() {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestSelfTestCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := SelfTest(ctx)
+	for _, res := range report {
+		if res.Err != context.Canceled {
+			t.Errorf("%v error want = %v, got = %v", res.Name, context.Canceled, res.Err)
+		}
+	}
+	if report.Err() == nil {
+		t.Error("Err() = nil")
+	}
+}
+
+func TestSelfTestVerify(t *testing.T) {
+	output := []byte("\xff\xd8\xff\xe0jpeg")
+	for _, tc := range []struct {
+		orientation int
+		thumbnail   Dimensions
+		want        string
+	}{
+		{1, Dimensions{32, 24}, ""},
+		{1, Dimensions{24, 32}, `thumbnailer: unexpected thumbnail orientation: want "landscape", got "portrait"`},
+		{6, Dimensions{24, 32}, ""},
+		{6, Dimensions{32, 24}, `thumbnailer: unexpected thumbnail orientation: want "portrait", got "landscape"`},
+	} {
+		c := selfTestCase{mediaType: "image/jpeg", orientation: tc.orientation}
+		file := &File{MediaType: mimemagic.MatchMagic(output), Orientation: tc.orientation}
+		if file.Dimensions = (Dimensions{selfTestWidth, selfTestHeight}); tc.orientation > 4 {
+			file.Dimensions = Dimensions{selfTestHeight, selfTestWidth}
+		}
+		file.Thumbnail.Dimensions, file.ThumbCreated = tc.thumbnail, true
+		got := ""
+		if err := c.verify(file, output); err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("verify(%d, %v) error = %q, want = %q", tc.orientation, tc.thumbnail, got, tc.want)
+		}
+	}
+}
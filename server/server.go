@@ -0,0 +1,325 @@
+// Package server serves thumbnails of the files in an fs.FS over HTTP, created on the fly for signed URLs of the form
+// /thumb/{signature}/{width}x{height}/{mode}/{format}/{source-path}.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+	"github.com/zRedShift/thumbnailer/cache"
+)
+
+// Prefix is the path prefix of the thumbnail URLs.
+const Prefix = "/thumb/"
+
+// Modes of thumbnails. ModeFit shrinks the thumbnail to fit in the requested dimensions, keeping its aspect ratio,
+// while ModeCrop shrinks it to fill them, cropping the centre of the image to their aspect ratio.
+const (
+	ModeFit  = "fit"
+	ModeCrop = "crop"
+)
+
+// ErrNoKey is returned by New without a signing key.
+var ErrNoKey = errors.New("server: no signing key")
+
+// Config stores the configuration of a Server. Key is the HMAC-SHA256 key URLs are signed with, FS the root of the
+// source files (e.g. os.DirFS), MaxSize the maximum width and height of thumbnails (1024 if not positive), Quality
+// their quality (the thumbnailer's default if 0), and MaxAge the max-age of their Cache-Control header (no header if
+// not positive). Thumbnails are created through Cache if it's not nil, keyed on the path, size and modification time of
+// the source rather than its content, so hits don't read it, or with Create otherwise
+// (thumbnailer.CreateThumbnailWithContext if nil). Logger receives the errors of requests failing with 5xx statuses.
+type Config struct {
+	Key              []byte
+	FS               fs.FS
+	MaxSize, Quality int
+	MaxAge           time.Duration
+	Cache            *cache.Cache
+	Create           func(ctx context.Context, file *thumbnailer.File) error
+	Logger           thumbnailer.Logger
+}
+
+// Server is an http.Handler serving thumbnails. The source files are stat'ed on every request, and the thumbnails'
+// ETags are derived from the URL, the negotiated format, and the size and modification time of the source, so
+// conditional requests are answered without creating thumbnails. With the "auto" format, WebP is served to clients
+// accepting it, and JPEG (or PNG for transparent thumbnails) to the rest. Sources without a thumbnail, e.g. audio
+// without cover art, are answered with 404 Not Found. Thumbnailing is cancelled if the client goes away.
+type Server struct {
+	config Config
+}
+
+// New returns a Server with the supplied Config.
+func New(config Config) (*Server, error) {
+	if len(config.Key) == 0 {
+		return nil, ErrNoKey
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1024
+	}
+	if config.Create == nil {
+		config.Create = thumbnailer.CreateThumbnailWithContext
+	}
+	return &Server{config: config}, nil
+}
+
+func sign(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the signed path of the thumbnail of the source file, with the width and height in pixels, the mode
+// (ModeFit or ModeCrop) and the format ("auto", "jpeg", "png" or "webp"). The source path's segments are escaped.
+func Sign(key []byte, width, height int, mode, format, source string) string {
+	params := strconv.Itoa(width) + "x" + strconv.Itoa(height) + "/" + mode + "/" + format + "/"
+	segments := strings.Split(source, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return Prefix + sign(key, params+source) + "/" + params + strings.Join(segments, "/")
+}
+
+// request is a parsed thumbnail request.
+type request struct {
+	params, source string
+	width, height  int
+	mode           thumbnailer.Mode
+	format         thumbnailer.Format
+	vary           bool
+}
+
+// statusError is an error with the HTTP status it's served with.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func badRequest(msg string) error {
+	return &statusError{http.StatusBadRequest, msg}
+}
+
+// parse verifies the signature of the path and parses it.
+func (s *Server) parse(r *http.Request) (*request, error) {
+	rest := strings.TrimPrefix(r.URL.Path, Prefix)
+	if len(rest) == len(r.URL.Path) {
+		return nil, &statusError{http.StatusNotFound, "not found"}
+	}
+	i := strings.IndexByte(rest, '/')
+	if i < 0 || !hmac.Equal([]byte(rest[:i]), []byte(sign(s.config.Key, rest[i+1:]))) {
+		return nil, &statusError{http.StatusForbidden, "invalid signature"}
+	}
+	req := &request{params: rest[i+1:]}
+	parts := strings.SplitN(req.params, "/", 4)
+	if len(parts) != 4 {
+		return nil, badRequest("malformed path")
+	}
+	dims, mode, format, source := parts[0], parts[1], parts[2], parts[3]
+	i = strings.IndexByte(dims, 'x')
+	if i < 0 {
+		return nil, badRequest("malformed dimensions")
+	}
+	width, wErr := strconv.Atoi(dims[:i])
+	height, hErr := strconv.Atoi(dims[i+1:])
+	switch {
+	case wErr != nil || hErr != nil || width <= 0 || height <= 0:
+		return nil, badRequest("malformed dimensions")
+	case width > s.config.MaxSize || height > s.config.MaxSize:
+		return nil, badRequest("dimensions exceed " + strconv.Itoa(s.config.MaxSize))
+	case !fs.ValidPath(source) || source == ".":
+		return nil, badRequest("invalid source path")
+	}
+	switch mode {
+	case ModeFit:
+		req.mode = thumbnailer.ModeFit
+	case ModeCrop:
+		req.mode = thumbnailer.ModeCrop
+	default:
+		return nil, badRequest("unsupported mode")
+	}
+	req.width, req.height, req.source = width, height, source
+	f, err := thumbnailer.ParseFormat(format)
+	if err != nil {
+		return nil, badRequest("unsupported format")
+	}
+	if req.format = f; f == thumbnailer.FormatAuto {
+		req.vary = true
+		if accepts(r.Header.Get("Accept"), "image/webp") {
+			req.format = thumbnailer.FormatWebP
+		}
+	}
+	return req, nil
+}
+
+// accepts reports whether the Accept header explicitly accepts the media type.
+func accepts(accept, mediaType string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		for _, p := range params[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// etag returns the ETag of the thumbnail of the request for the source.
+func (req *request) etag(fi fs.FileInfo) string {
+	h := sha256.New()
+	h.Write([]byte(req.params))
+	h.Write([]byte{0})
+	h.Write([]byte(req.format.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(version(fi)))
+	return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// version identifies the version of a source by its size and modification time.
+func version(fi fs.FileInfo) string {
+	return strconv.FormatInt(fi.Size(), 10) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+}
+
+// noneMatch reports whether the If-None-Match header doesn't match the ETag.
+func noneMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return true
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return false
+		}
+	}
+	return true
+}
+
+// status returns the HTTP status errors are served with.
+func status(err error) int {
+	var sErr *statusError
+	switch {
+	case errors.As(err, &sErr):
+		return sErr.status
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	switch thumbnailer.KindOf(err) {
+	case thumbnailer.KindUnsupportedFormat, thumbnailer.KindDecoderMissing:
+		return http.StatusUnsupportedMediaType
+	case thumbnailer.KindCorruptData, thumbnailer.KindTooLarge:
+		return http.StatusUnprocessableEntity
+	case thumbnailer.KindCancelled, thumbnailer.KindResourceExhausted, thumbnailer.KindTimeout:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) error(w http.ResponseWriter, r *http.Request, err error) {
+	code := status(err)
+	msg := http.StatusText(code)
+	if code < 500 {
+		msg = err.Error()
+	} else if s.config.Logger != nil {
+		s.config.Logger.Log(r.Context(), slog.LevelError, "thumbnail request failed", "path", r.URL.Path,
+			"error", err)
+	}
+	http.Error(w, msg, code)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := s.parse(r)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	fi, err := fs.Stat(s.config.FS, req.source)
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	etag := req.etag(fi)
+	h := w.Header()
+	h.Set("ETag", etag)
+	if req.vary {
+		h.Set("Vary", "Accept")
+	}
+	if s.config.MaxAge > 0 {
+		h.Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(s.config.MaxAge/time.Second), 10))
+	}
+	if !noneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	buf, file, err := s.thumbnail(r.Context(), req, fi)
+	if err != nil {
+		h.Del("ETag")
+		h.Del("Cache-Control")
+		s.error(w, r, err)
+		return
+	}
+	format := req.format
+	if format == thumbnailer.FormatAuto {
+		format = thumbnailer.FormatJPEG
+		if file.HasAlpha {
+			format = thumbnailer.FormatPNG
+		}
+	}
+	h.Set("Content-Type", "image/"+format.String())
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+// thumbnail creates the thumbnail of the request for the source in memory.
+func (s *Server) thumbnail(ctx context.Context, req *request, fi fs.FileInfo) (*bytes.Buffer, *thumbnailer.File,
+	error) {
+	file, err := thumbnailer.FileFromFS(s.config.FS, req.source)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := new(bytes.Buffer)
+	if s.config.Quality > 0 {
+		file.ToWriter(buf, req.width, s.config.Quality)
+	} else {
+		file.ToWriter(buf, req.width)
+	}
+	file.TargetHeight, file.Mode, file.Format = req.height, req.mode, req.format
+	if s.config.Cache != nil {
+		_, err = s.config.Cache.ThumbnailKey(ctx, file, req.source+"\x00"+version(fi))
+	} else {
+		err = s.config.Create(ctx, file)
+	}
+	if err == nil && !file.ThumbCreated {
+		err = &statusError{http.StatusNotFound, "the source has no thumbnail"}
+	}
+	return buf, file, err
+}
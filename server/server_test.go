@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/zRedShift/thumbnailer"
+	"github.com/zRedShift/thumbnailer/cache"
+)
+
+var testKey = []byte("secret")
+
+type fakeCreate struct {
+	calls  int
+	format thumbnailer.Format
+	mode   thumbnailer.Mode
+	size   int
+	height int
+	err    error
+}
+
+func (f *fakeCreate) create(ctx context.Context, file *thumbnailer.File) error {
+	f.calls++
+	f.format, f.mode, f.size, f.height = file.Format, file.Mode, file.TargetDimensions, file.TargetHeight
+	if f.err != nil {
+		return f.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if file.Media == "audio" {
+		return nil
+	}
+	file.HasAlpha = strings.HasSuffix(file.MediaType.MediaType(), "png")
+	file.ThumbCreated = true
+	_, err := file.Writer.Write([]byte("thumbnail"))
+	return err
+}
+
+func newServer(t *testing.T, config Config) (*Server, *fakeCreate) {
+	t.Helper()
+	f := new(fakeCreate)
+	config.Key = testKey
+	config.FS = fstest.MapFS{
+		"photos/cat 1.jpg": {Data: []byte("\xff\xd8\xff\xe0cat"), ModTime: time.Unix(1, 0)},
+		"logo.png":         {Data: []byte("\x89PNG\r\n\x1a\nlogo"), ModTime: time.Unix(1, 0)},
+		"song.mp3":         {Data: []byte("ID3\x03\x00\x00\x00\x00\x00\x00song"), ModTime: time.Unix(1, 0)},
+		"dir/.keep":        {},
+	}
+	if config.Create == nil {
+		config.Create = f.create
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func get(s *Server, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServer(t *testing.T) {
+	s, f := newServer(t, Config{MaxAge: time.Hour})
+	if _, err := New(Config{}); err != ErrNoKey {
+		t.Errorf("err = %v, want %v", err, ErrNoKey)
+	}
+	path := Sign(testKey, 128, 128, ModeFit, "auto", "photos/cat 1.jpg")
+	if !strings.Contains(path, "/128x128/fit/auto/photos/cat%201.jpg") {
+		t.Errorf("Sign = %v", path)
+	}
+	w := get(s, path)
+	h := w.Header()
+	if w.Code != http.StatusOK || w.Body.String() != "thumbnail" || h.Get("Content-Type") != "image/jpeg" ||
+		h.Get("Vary") != "Accept" || h.Get("Cache-Control") != "public, max-age=3600" || h.Get("ETag") == "" {
+		t.Fatalf("unexpected response: %d %v %q", w.Code, h, w.Body)
+	}
+	if f.size != 128 || f.height != 128 || f.mode != thumbnailer.ModeFit || f.format != thumbnailer.FormatAuto {
+		t.Errorf("size = %dx%d, mode = %v, format = %v", f.size, f.height, f.mode, f.format)
+	}
+	etag := h.Get("ETag")
+	if w = get(s, path, "If-None-Match", `"other", `+etag); w.Code != http.StatusNotModified || f.calls != 1 {
+		t.Errorf("conditional request: %d, %d calls", w.Code, f.calls)
+	}
+	w = get(s, path, "Accept", "image/avif,image/webp,*/*;q=0.8")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/webp" || f.format != thumbnailer.FormatWebP {
+		t.Errorf("negotiated response: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("same ETag for different formats")
+	}
+	if w = get(s, path, "Accept", "image/webp;q=0"); w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("WebP served when refused: %v", w.Header())
+	}
+	w = get(s, Sign(testKey, 64, 64, ModeFit, "png", "logo.png"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Vary") != "" {
+		t.Errorf("png response: %d %v", w.Code, w.Header())
+	}
+	w = get(s, Sign(testKey, 160, 90, ModeCrop, "jpeg", "photos/cat 1.jpg"))
+	if w.Code != http.StatusOK || f.size != 160 || f.height != 90 || f.mode != thumbnailer.ModeCrop {
+		t.Errorf("crop response: %d, size = %dx%d, mode = %v", w.Code, f.size, f.height, f.mode)
+	}
+	r := httptest.NewRequest(http.MethodHead, path, nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "9" {
+		t.Errorf("HEAD response: %d %v %q", w.Code, w.Header(), w.Body)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s, f := newServer(t, Config{MaxSize: 256})
+	valid := Sign(testKey, 128, 128, ModeFit, "auto", "photos/cat 1.jpg")
+	for _, tc := range []struct {
+		name, path string
+		status     int
+	}{
+		{"prefix", "/other/path", http.StatusNotFound},
+		{"signature", strings.Replace(valid, "128x128", "129x129", 1), http.StatusForbidden},
+		{"other key", Sign([]byte("other"), 128, 128, ModeFit, "auto", "photos/cat 1.jpg"), http.StatusForbidden},
+		{"no signature", Prefix + "128x128/fit/auto/logo.png", http.StatusForbidden},
+		{"dimensions", Sign(testKey, 0, 128, ModeFit, "auto", "logo.png"), http.StatusBadRequest},
+		{"max size", Sign(testKey, 512, 512, ModeFit, "auto", "logo.png"), http.StatusBadRequest},
+		{"max height", Sign(testKey, 128, 512, ModeCrop, "auto", "logo.png"), http.StatusBadRequest},
+		{"mode", Sign(testKey, 128, 128, "fill", "auto", "logo.png"), http.StatusBadRequest},
+		{"format", Sign(testKey, 128, 128, ModeFit, "gif", "logo.png"), http.StatusBadRequest},
+		{"traversal", Sign(testKey, 128, 128, ModeFit, "auto", "../logo.png"), http.StatusBadRequest},
+		{"missing", Sign(testKey, 128, 128, ModeFit, "auto", "missing.png"), http.StatusNotFound},
+		{"directory", Sign(testKey, 128, 128, ModeFit, "auto", "dir"), http.StatusNotFound},
+	} {
+		if w := get(s, tc.path); w.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+	if f.calls != 0 {
+		t.Errorf("Create called %d times for invalid requests", f.calls)
+	}
+	r := httptest.NewRequest(http.MethodPost, valid, nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d", w.Code)
+	}
+	for err, status := range map[error]int{
+		thumbnailer.ErrInvalidData:   http.StatusUnprocessableEntity,
+		context.Canceled:             http.StatusServiceUnavailable,
+		thumbnailer.ErrTooManyPixels: http.StatusUnprocessableEntity,
+		thumbnailer.ErrDecodeTimeout: http.StatusServiceUnavailable,
+	} {
+		f.err = err
+		if w = get(s, valid); w.Code != status || w.Header().Get("ETag") != "" {
+			t.Errorf("%v: status = %d, want %d, headers %v", err, w.Code, status, w.Header())
+		}
+	}
+	f.err = nil
+	if w = get(s, Sign(testKey, 128, 128, ModeFit, "auto", "song.mp3")); w.Code != http.StatusNotFound ||
+		w.Header().Get("ETag") != "" {
+		t.Errorf("no thumbnail: status = %d, headers %v", w.Code, w.Header())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, valid, nil).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("cancelled request status = %d", w.Code)
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	f := new(fakeCreate)
+	c, err := cache.New(cache.Config{Dir: t.TempDir(), Create: f.create})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newServer(t, Config{Cache: c})
+	path := Sign(testKey, 128, 128, ModeFit, "auto", "logo.png")
+	logo := s.config.FS.(fstest.MapFS)["logo.png"]
+	for i, change := range []func(){
+		func() {},
+		// Thumbnails are keyed on the size and modification time of the source, not its content.
+		func() { logo.Data = []byte("\x89PNG\r\n\x1a\nLOGO") },
+		func() { logo.ModTime = time.Unix(2, 0) },
+	} {
+		change()
+		w := get(s, path)
+		if w.Code != http.StatusOK || w.Body.String() != "thumbnail" || w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("%d: unexpected response: %d %v %q", i, w.Code, w.Header(), w.Body)
+		}
+	}
+	if f.calls != 2 {
+		t.Errorf("Create called %d times, want 2", f.calls)
+	}
+}
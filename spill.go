@@ -0,0 +1,177 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// SpillPolicy configures how a non-seekable input is spilled to make it seekable. Up to MemoryThreshold bytes are
+// buffered in memory, after which everything is moved to a temporary file in Dir (os.TempDir() if empty), whose name
+// starts with Prefix. A positive MaxSize caps the total number of bytes spilled, and exceeding it aborts the
+// thumbnailing with a *SpillLimitError.
+type SpillPolicy struct {
+	Dir, Prefix              string
+	MaxSize, MemoryThreshold int64
+}
+
+// SpillLimitError is returned when spilling an input would exceed the SpillPolicy's MaxSize.
+type SpillLimitError struct {
+	MaxSize int64
+}
+
+func (e *SpillLimitError) Error() string {
+	return "thumbnailer: input exceeds the maximum spill size of " + strconv.FormatInt(e.MaxSize, 10) + " bytes"
+}
+
+// Is reports whether the target is KindTooLarge.
+func (e *SpillLimitError) Is(target error) bool {
+	return target == KindTooLarge
+}
+
+var spillPolicy = struct {
+	sync.RWMutex
+	SpillPolicy
+}{}
+
+// SetSpillPolicy sets the SpillPolicy used for images read from an io.Reader, unless the File's Spool overrides it.
+// The default policy spills everything to os.TempDir() with no size limit.
+func SetSpillPolicy(policy SpillPolicy) {
+	spillPolicy.Lock()
+	spillPolicy.SpillPolicy = policy
+	spillPolicy.Unlock()
+}
+
+func (f *File) spillPolicy() SpillPolicy {
+	if f.Spool != nil {
+		return *f.Spool
+	}
+	if f.spill != nil {
+		return *f.spill
+	}
+	spillPolicy.RLock()
+	defer spillPolicy.RUnlock()
+	return spillPolicy.SpillPolicy
+}
+
+type spill struct {
+	policy SpillPolicy
+	buf    bytes.Buffer
+	file   *os.File
+	size   int64
+}
+
+func newSpill(policy SpillPolicy) *spill {
+	return &spill{policy: policy}
+}
+
+func (s *spill) Write(p []byte) (n int, err error) {
+	if s.policy.MaxSize > 0 && s.size+int64(len(p)) > s.policy.MaxSize {
+		return 0, &SpillLimitError{MaxSize: s.policy.MaxSize}
+	}
+	if s.file == nil && s.size+int64(len(p)) > s.policy.MemoryThreshold {
+		if s.file, err = ioutil.TempFile(s.policy.Dir, s.policy.Prefix); err != nil {
+			return 0, err
+		}
+		if _, err = s.buf.WriteTo(s.file); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *spill) readSeeker() (io.ReadSeeker, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spill) Close() error {
+	if s.file == nil {
+		s.buf = bytes.Buffer{}
+		return nil
+	}
+	err := s.file.Close()
+	if rErr := os.Remove(s.file.Name()); err == nil {
+		err = rErr
+	}
+	s.file = nil
+	return err
+}
+
+// contextReader fails reads once the context is done.
+type contextReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// spoolReader records everything read from the io.Reader into the spill, until the spill refuses more data.
+type spoolReader struct {
+	io.Reader
+	spill *spill
+	err   error
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.spill.Write(p[:n])
+	}
+	return n, err
+}
+
+// spoolFFmpegThumbnail runs ffmpegThumbnail on a non-seekable file while spooling the input as it's read. If FFmpeg
+// fails in a way that suggests it needed to seek, the rest of the input is spooled and FFmpeg is retried with seeking
+// enabled.
+func spoolFFmpegThumbnail(ctx context.Context, file *File) (err error) {
+	s := newSpill(*file.Spool)
+	r, seekEnd := &spoolReader{Reader: file.Reader, spill: s}, file.SeekEnd
+	file.Reader = r
+	defer func() {
+		file.Reader, file.Seeker, file.SeekEnd = r.Reader, nil, seekEnd
+		if cErr := s.Close(); err == nil {
+			err = cErr
+		}
+	}()
+	if err = ffmpegThumbnail(ctx, file); !seekRequired(err) || file.ThumbCreated {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	report := file.phase(PhaseSpool)
+	_, span := startSpan(ctx, "spool")
+	_, err = io.Copy(s, contextReader{r.Reader, ctx})
+	span.SetAttributes("bytes", s.size)
+	span.End(err)
+	if report(PhaseEvent{Bytes: s.size, Err: err}); err != nil {
+		return err
+	}
+	rs, err := s.readSeeker()
+	if err != nil {
+		return err
+	}
+	file.Reader, file.Seeker, file.SeekEnd, file.Size, file.Duration = rs, rs, true, s.size, 0
+	return ffmpegThumbnail(ctx, file)
+}
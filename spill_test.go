@@ -0,0 +1,80 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpill(t *testing.T) {
+	data := bytes.Repeat([]byte("thumbnailer"), 100)
+	tests := []struct {
+		name     string
+		policy   SpillPolicy
+		wantFile bool
+		wantErr  bool
+	}{
+		{"Memory", SpillPolicy{MemoryThreshold: 1 << 20}, false, false},
+		{"File", SpillPolicy{Dir: "tmp", Prefix: "spill_", MemoryThreshold: 100}, true, false},
+		{"NoThreshold", SpillPolicy{Dir: "tmp"}, true, false},
+		{"TooBig", SpillPolicy{MaxSize: 1000, MemoryThreshold: 1 << 20}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSpill(test.policy)
+			for i := 0; i < len(data); i += 64 {
+				end := i + 64
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := s.Write(data[i:end]); err != nil {
+					if lErr, ok := err.(*SpillLimitError); !ok || !test.wantErr || lErr.MaxSize != test.policy.MaxSize {
+						t.Fatalf("Write() error = %v, wantErr = %v", err, test.wantErr)
+					}
+					break
+				}
+			}
+			if test.wantErr {
+				if s.size > test.policy.MaxSize {
+					t.Errorf("spilled size = %v, want <= %v", s.size, test.policy.MaxSize)
+				}
+				return
+			}
+			if (s.file != nil) != test.wantFile {
+				t.Errorf("spilled to file want = %v, got = %v", test.wantFile, s.file != nil)
+			}
+			var name string
+			if s.file != nil {
+				name = s.file.Name()
+				if filepath.Dir(name) != test.policy.Dir {
+					t.Errorf("Dir want = %v, got = %v", test.policy.Dir, filepath.Dir(name))
+				}
+				if !strings.HasPrefix(filepath.Base(name), test.policy.Prefix) {
+					t.Errorf("Prefix want = %v, got = %v", test.policy.Prefix, filepath.Base(name))
+				}
+			}
+			rs, err := s.readSeeker()
+			if err != nil {
+				t.Fatalf("readSeeker() error = %v", err)
+			}
+			got, err := ioutil.ReadAll(rs)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("spilled data differs from the written data")
+			}
+			if err = s.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+			if name != "" {
+				if _, err = os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("os.Stat() error = %v, want = not exist", err)
+				}
+			}
+		})
+	}
+}
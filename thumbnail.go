@@ -1,14 +1,18 @@
 // Package thumbnailer provides a lightning fast and memory usage efficient thumbnailer via libvips and ffmpeg
 // C bindings, with (external) MIME sniffing, and streaming I/O support. The formats available depend on the way libvips
-// and ffmpeg are compiled.
+// and ffmpeg are compiled, which Capabilities reports at runtime.
 package thumbnailer
 
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,41 +30,143 @@ const (
 // disables FFmpeg from seeking the end, which enables partial file reading in "semi-streaming" files (incomplete files
 // that block until more data is available but have seeking capabilities) without blocking until the file is complete.
 // HasVideo and HasAudio indicates that the file has video and/or audio streams, but having a video stream does not
-// guarantee a thumbnail. Orientation corresponds to the EXIF orientation of the input file.
+// guarantee a thumbnail. Orientation corresponds to the EXIF orientation of the input file. Setting Spool opts a
+// video or audio file without an io.Seeker into being spooled according to the SpillPolicy as it's read, and retried
+// with seeking enabled if FFmpeg fails in a way that suggests it needed to seek (e.g. MP4s with the moov atom at the
+// end). Images read from an io.Reader are always spilled, according to Spool if set, or SetSpillPolicy otherwise.
+// Limits, if set, overrides the Limits set by SetLimits.
 type File struct {
 	io.Reader
 	io.Seeker
 	Thumbnail
 	mimemagic.MediaType
 	Dimensions
+	Spool                       *SpillPolicy
+	Limits                      *Limits
 	Orientation                 int
 	Size                        int64
 	Duration                    time.Duration
 	Title, Artist, Path         string
 	HasVideo, HasAudio, SeekEnd bool
+	fsys                        fs.FS
+	fsName                      string
+	obs                         *observation
+	// spill is the SpillPolicy of a Thumbnailer's Config, used for images if Spool isn't set.
+	spill *SpillPolicy
 }
 
 // Thumbnail stores the io.Writer to which to write the thumbnail, or creates it at the given path (preference to the
-// path), its resultant dimensions, target Quality (both for JPEG and lossy PNG output), and the size of the bounding
-// box to which the thumbnail is shrunk (TargetDimensions). HasAlpha indicates the image is a transparent PNG, JPEG if
-// false. ThumbCreated indicates the thumbnail was created successfully.
+// path), its resultant dimensions, target Quality (for JPEG, WebP and lossy PNG output), the size of the bounding box
+// to which the thumbnail is shrunk (TargetDimensions, or TargetDimensions wide and TargetHeight high if TargetHeight is
+// positive), how it's fitted to it (Mode) and its Format. FrameTime, if positive, selects the frame of a video to
+// thumbnail: the first one at or after that time, instead of the most representative of the first frames. HasAlpha
+// indicates the thumbnail is transparent, which with FormatAuto means it's a PNG, and a JPEG otherwise. ThumbCreated
+// indicates the thumbnail was created successfully.
 type Thumbnail struct {
 	io.Writer
 	Dimensions
+	Format                    Format
+	Mode                      Mode
 	Quality, TargetDimensions int
+	TargetHeight              int
+	FrameTime                 time.Duration
 	Path                      string
 	HasAlpha, ThumbCreated    bool
 }
 
+// Mode is how a thumbnail is fitted to its bounding box.
+type Mode int
+
+// Possible values for Mode. ModeFit shrinks the thumbnail to fit in the bounding box, keeping its aspect ratio, while
+// ModeCrop shrinks it to fill the bounding box, cropping the centre of the image to the box's aspect ratio.
+const (
+	ModeFit Mode = iota
+	ModeCrop
+)
+
+var modeNames = [...]string{"fit", "crop"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return "Mode(" + strconv.Itoa(int(m)) + ")"
+	}
+	return modeNames[m]
+}
+
+// ParseMode returns the Mode with the given name (as returned by Mode.String).
+func ParseMode(name string) (Mode, error) {
+	name = strings.ToLower(name)
+	for i, n := range modeNames {
+		if n == name {
+			return Mode(i), nil
+		}
+	}
+	return ModeFit, errors.New("thumbnailer: unknown mode: " + name)
+}
+
+// Format is the encoding of the thumbnail.
+type Format int
+
+// Possible values for Format. FormatAuto encodes transparent thumbnails as PNG and the rest as JPEG, while forcing JPEG
+// flattens transparent thumbnails against a white background.
+const (
+	FormatAuto Format = iota
+	FormatJPEG
+	FormatPNG
+	FormatWebP
+)
+
+var formatNames = [...]string{"auto", "jpeg", "png", "webp"}
+
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+	return formatNames[f]
+}
+
+// ParseFormat returns the Format with the given name (as returned by Format.String, with "jpg" accepted as well).
+func ParseFormat(name string) (Format, error) {
+	name = strings.ToLower(name)
+	if name == "jpg" {
+		return FormatJPEG, nil
+	}
+	for i, n := range formatNames {
+		if n == name {
+			return Format(i), nil
+		}
+	}
+	return FormatAuto, errors.New("thumbnailer: unknown format: " + name)
+}
+
+// MediaType returns the Media Type of the Format, or an empty string for FormatAuto.
+func (f Format) MediaType() string {
+	switch f {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatPNG:
+		return "image/png"
+	case FormatWebP:
+		return "image/webp"
+	default:
+		return ""
+	}
+}
+
 // Dimensions stores the dimensions of the file and its thumbnail (if applicable).
 type Dimensions struct {
 	Width, Height int
 }
 
-// ThumbError stores the errors returned by the C Libraries used in this package.
+// ThumbError stores the errors returned by the C Libraries used in this package, classified by Kind. If the error was
+// caused by the File's io.Reader or io.Seeker, the original error is kept in Wrapped (and Err is its message), so it
+// can be matched with errors.Is and errors.As. Besides its Kind, a ThumbError matches any ThumbError with the same
+// Library, Domain, Err and Code.
 type ThumbError struct {
 	Library, Domain, Err string
 	Code                 int
+	Kind                 ErrorKind
+	Wrapped              error
 }
 
 // Common ThumbErrors.
@@ -83,11 +189,28 @@ func (t *ThumbError) Error() string {
 	return t.Library + ": " + t.Domain + ": " + t.Err
 }
 
+// Is reports whether the target is the ThumbError's Kind, or a ThumbError with the same Library, Domain, Err and Code.
+func (t *ThumbError) Is(target error) bool {
+	switch target := target.(type) {
+	case ErrorKind:
+		return t.Kind == target
+	case *ThumbError:
+		return t.Library == target.Library && t.Domain == target.Domain && t.Err == target.Err && t.Code == target.Code
+	}
+	return false
+}
+
+// Unwrap returns the wrapped error, if any.
+func (t *ThumbError) Unwrap() error {
+	return t.Wrapped
+}
+
 func avErrorToThumbError(e avError) *ThumbError {
 	return &ThumbError{
 		Library: "ffmpeg",
 		Err:     e.errorString(),
 		Code:    int(e),
+		Kind:    e.kind(),
 	}
 }
 
@@ -96,6 +219,7 @@ func vipsErrorToThumbError(e vipsError) *ThumbError {
 		Library: "vips",
 		Domain:  e.domain,
 		Err:     e.error,
+		Kind:    e.kind(),
 	}
 }
 
@@ -115,7 +239,7 @@ func FileFromReader(r io.Reader, filename ...string) (*File, error) {
 	}
 	return &File{
 		Reader:    io.MultiReader(bytes.NewReader(data), r),
-		MediaType: mimemagic.Match(data, fn, mimemagic.Magic),
+		MediaType: sniff(data, fn),
 	}, nil
 }
 
@@ -129,7 +253,7 @@ func FileFromReadSeeker(r io.ReadSeeker, seekEnd bool, filename ...string) (*Fil
 	if len(filename) > 0 {
 		fn = filename[0]
 	}
-	mediaType, err := mimemagic.MatchReader(r, fn, probeSize, mimemagic.Magic)
+	mediaType, err := sniffReader(r, fn)
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +268,83 @@ func FileFromReadSeeker(r io.ReadSeeker, seekEnd bool, filename ...string) (*Fil
 	}, nil
 }
 
+// FileFromReaderAt takes an io.ReaderAt, the size of its contents, and a filename (for better MIME sniffing, can be
+// empty), and returns a File ready for supplying a thumbnail output via ToWriter or ToPath. The File reads through its
+// own io.SectionReader, so multiple Files, thumbnailed concurrently, can share the same io.ReaderAt, as long as it
+// supports parallel ReadAt calls, as required by the io.ReaderAt contract.
+func FileFromReaderAt(r io.ReaderAt, size int64, name string) (*File, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	mediaType, err := sniffReader(sr, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = sr.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &File{
+		Reader:    sr,
+		Seeker:    sr,
+		SeekEnd:   true,
+		Size:      size,
+		MediaType: mediaType,
+	}, nil
+}
+
+// FileFromFS takes an fs.FS and the name of a file in it, and returns a File ready for supplying a thumbnail output via
+// ToWriter or ToPath. Much like with FileFromPath, the file is reopened when the thumbnail is created, so the File can
+// be thumbnailed more than once.
+func FileFromFS(fsys fs.FS, name string) (file *File, err error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cErr := f.Close()
+		if err == nil {
+			err = cErr
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := sniffReader(f, path.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		SeekEnd:   true,
+		Size:      fi.Size(),
+		MediaType: mediaType,
+		fsys:      fsys,
+		fsName:    name,
+	}, nil
+}
+
+// FS returns the fs.FS and the name of the file in it the File was created from with FileFromFS, or a nil fs.FS if it
+// wasn't.
+func (f *File) FS() (fs.FS, string) {
+	return f.fsys, f.fsName
+}
+
+// openFS opens the File's fs.FS file, preferring io.ReaderAt to io.Seeker for seeking.
+func (f *File) openFS() (fs.File, error) {
+	ff, err := f.fsys.Open(f.fsName)
+	if err != nil {
+		return nil, err
+	}
+	switch s := ff.(type) {
+	case io.ReaderAt:
+		sr := io.NewSectionReader(s, 0, f.Size)
+		f.Reader, f.Seeker = sr, sr
+	case io.Seeker:
+		f.Reader, f.Seeker = ff, s
+	default:
+		f.Reader, f.Seeker = ff, nil
+	}
+	return ff, nil
+}
+
 // FileFromPath takes a filepath and returns a File ready for supplying a thumbnail output via ToFile or ToPath.
 func FileFromPath(path string) (file *File, err error) {
 	f, err := os.Open(path)
@@ -156,18 +357,18 @@ func FileFromPath(path string) (file *File, err error) {
 			err = cErr
 		}
 	}()
-	fs, err := f.Stat()
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	mediaType, err := mimemagic.MatchReader(f, filepath.Base(f.Name()), probeSize, mimemagic.Magic)
+	mediaType, err := sniffReader(f, filepath.Base(f.Name()))
 	if err != nil {
 		return nil, err
 	}
 	return &File{
 		Path:      path,
 		SeekEnd:   true,
-		Size:      fs.Size(),
+		Size:      fi.Size(),
 		MediaType: mediaType,
 	}, nil
 }
@@ -183,7 +384,8 @@ func (f *File) to(size int, quality ...int) *File {
 
 // ToWriter directs the thumbnailer to write the resultant thumbnail to the supplied io.Write at the target bounding box
 // size and quality (quality corresponds to libjpeg quality for JPEG thumbnails and to libimagequant quality for PNG
-// thumbnails).
+// thumbnails). The thumbnail is streamed to the io.Writer in chunks as it's encoded, and an error returned by the
+// io.Writer aborts the encoding and is returned by CreateThumbnailWithContext.
 func (f *File) ToWriter(w io.Writer, size int, quality ...int) *File {
 	f.Writer = w
 	return f.to(size, quality...)
@@ -197,49 +399,156 @@ func (f *File) ToPath(path string, size int, quality ...int) *File {
 	return f.to(size, quality...)
 }
 
+func isAV(file *File) bool {
+	return file.Media == "video" || file.Media == "audio"
+}
+
+// openInput opens the File's fs.FS file, or its path if it's a video or audio file (vips reads paths itself), and
+// returns a function that closes it.
+func openInput(file *File) (func() error, error) {
+	if file.fsys != nil {
+		f, err := file.openFS()
+		if err != nil {
+			return nil, err
+		}
+		return f.Close, nil
+	}
+	if file.Path != "" && isAV(file) {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		file.Reader, file.Seeker = f, f
+		return f.Close, nil
+	}
+	return func() error { return nil }, nil
+}
+
+func thumbError(err error) error {
+	switch tErr := err.(type) {
+	case avError:
+		if tErr == avErrInvalidData {
+			return ErrInvalidData
+		}
+		return avErrorToThumbError(tErr)
+	case vipsError:
+		switch {
+		case tErr.stage == stageUnsupported,
+			tErr.domain == "VipsForeignLoad" && strings.HasSuffix(tErr.error, "not a known file format"):
+			return ErrFileFormatNotSupported
+		case tErr.animated, tErr.domain == "webp2vips" && tErr.error == "unable to read pixels":
+			return ErrAnimatedWEBPNotSupported
+		default:
+			return vipsErrorToThumbError(tErr)
+		}
+	}
+	return err
+}
+
 // CreateThumbnailWithContext creates a thumbnail from the supplied file (should go through FileFromReader,
-// FromReadSeeker or FileFromPath and then ToWriter or ToPath, or equivalent for defined behaviour) and a context for
-// interruption. Currently it's only checked if Done() in FFmpeg before blocking operations via an interrupt callback.
+// FromReadSeeker, FileFromReaderAt, FileFromFS, FileFromURL or FileFromPath and then ToWriter or ToPath, or
+// equivalent for defined behaviour) and a context for interruption. It's checked by FFmpeg before blocking operations
+// via an interrupt callback and while spilling input, and its deadline bounds the time spent in vips. Errors returned
+// by the File's io.Reader or io.Seeker while a library reads it are wrapped in a ThumbError of KindIO, and so is the
+// context's error (of KindCancelled) when it interrupts FFmpeg, which keeps them apart and available to errors.Is and
+// errors.As. Errors returned by the io.Writer are returned as is. The call is traced by the Tracer set by SetTracer,
+// and reported to the Observer set by SetObserver.
 func CreateThumbnailWithContext(ctx context.Context, file *File) (err error) {
+	ctx, span := startSpan(ctx, "thumbnail")
+	span.SetAttributes("media.type", file.MediaType.MediaType())
+	if file.Path != "" {
+		span.SetAttributes("path", file.Path)
+	}
+	obs := file.observe(ctx)
 	defer func() {
-		switch tErr := err.(type) {
-		case avError:
-			if tErr == avErrInvalidData {
-				err = ErrInvalidData
-			} else {
-				err = avErrorToThumbError(tErr)
-			}
-		case vipsError:
-			switch {
-			case tErr.domain == "VipsForeignLoad" && strings.HasSuffix(tErr.error, "not a known file format"):
-				err = ErrFileFormatNotSupported
-			case tErr.domain == "webp2vips" && tErr.error == "unable to read pixels":
-				err = ErrAnimatedWEBPNotSupported
-			default:
-				err = vipsErrorToThumbError(tErr)
-			}
+		err = thumbError(err)
+		obs.done(file, err)
+		span.End(err)
+	}()
+	l := file.limits()
+	if err = l.checkSize(file.Size); err != nil {
+		return err
+	}
+	_, openSpan := startSpan(ctx, "open")
+	closeInput, err := openInput(file)
+	if openSpan.End(err); err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := closeInput(); err == nil {
+			err = cErr
 		}
 	}()
-	if file.Media == "video" || file.Media == "audio" {
-		if file.Path != "" {
-			f, err := os.Open(file.Path)
-			if err != nil {
-				return err
+	if l.MaxInputBytes > 0 && file.Reader != nil {
+		r, restore := limitInput(file, l.MaxInputBytes)
+		defer func() {
+			restore()
+			if r.err != nil {
+				err = r.err
 			}
-			defer func() {
-				cErr := f.Close()
-				if err == nil {
-					err = cErr
+		}()
+	}
+	defer obs.count(file)()
+	if l.MaxDecodeTime > 0 {
+		parent, start, cancel := ctx, time.Now(), context.CancelFunc(nil)
+		ctx, cancel = context.WithTimeout(ctx, l.MaxDecodeTime)
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+				err = &LimitError{
+					Limit: LimitDecodeTime,
+					Value: int64(time.Since(start) / time.Millisecond),
+					Max:   int64(l.MaxDecodeTime / time.Millisecond),
 				}
-			}()
-			file.Reader, file.Seeker = f, f
+			}
+			cancel()
+		}()
+	}
+	defer bindContext(ctx, file)()
+	if isAV(file) {
+		if file.Spool != nil && file.Seeker == nil {
+			return spoolFFmpegThumbnail(ctx, file)
 		}
 		return ffmpegThumbnail(ctx, file)
 	}
-	return thumbnailFromFile(file)
+	return thumbnailFromFile(ctx, file)
 }
 
 // CreateThumbnail calls CreateThumbnailWithContext with a background context.
 func CreateThumbnail(file *File) error {
 	return CreateThumbnailWithContext(context.Background(), file)
 }
+
+// ProbeWithContext populates the supplied file's Dimensions and Orientation, and for video and audio files its
+// Duration (if the container reports it), Title, Artist, HasVideo and HasAudio, without creating a thumbnail. Only as
+// much of the input as the headers require is read, so a File backed by a seekstream.File can be probed while it's
+// still being written. Seekable files are rewound afterwards, while a File from FileFromReader is consumed and can't
+// be thumbnailed after being probed.
+func ProbeWithContext(ctx context.Context, file *File) (err error) {
+	defer func() {
+		err = thumbError(err)
+	}()
+	closeInput, err := openInput(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := closeInput(); err == nil {
+			err = cErr
+		}
+	}()
+	defer bindContext(ctx, file)()
+	if isAV(file) {
+		err = ffmpegProbe(ctx, file)
+	} else {
+		err = probeFile(ctx, file)
+	}
+	if err == nil && file.Seeker != nil && file.Path == "" && file.fsys == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	return err
+}
+
+// Probe calls ProbeWithContext with a background context.
+func Probe(file *File) error {
+	return ProbeWithContext(context.Background(), file)
+}
@@ -1,6 +1,8 @@
 package thumbnailer
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/zRedShift/seekstream"
 )
 
 func TestCreateThumbnail(t *testing.T) {
@@ -183,3 +187,300 @@ func TestCreateThumbnail(t *testing.T) {
 		}
 	})
 }
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestCreateThumbnailWriterError(t *testing.T) {
+	wantErr := errors.New("writer error")
+	for _, filename := range []string{"trollface.png", "schizo_0.mp4"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := FileFromPath(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			if err = CreateThumbnail(f.ToWriter(errWriter{wantErr}, 256)); err != wantErr {
+				t.Errorf("CreateThumbnail() error = %v, want = %v", err, wantErr)
+			}
+			if f.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", false, f.ThumbCreated)
+			}
+		})
+	}
+}
+
+func TestCreateThumbnailConcurrentErrors(t *testing.T) {
+	corrupt := append([]byte("\xff\xd8\xff\xdb"), bytes.Repeat([]byte{0x42}, 1024)...)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				f, err := FileFromPath(filepath.Join("fixtures", "mqdefault_6s.webp"))
+				if err != nil {
+					t.Errorf("FileFromPath() error = %v", err)
+					return
+				}
+				if err = CreateThumbnail(f.ToWriter(ioutil.Discard, 256)); !errors.Is(err, ErrAnimatedWEBPNotSupported) {
+					t.Errorf("CreateThumbnail() error = %v, want = %v", err, ErrAnimatedWEBPNotSupported)
+				}
+				return
+			}
+			f, err := FileFromReader(bytes.NewReader(corrupt), "corrupt.jpg")
+			if err != nil {
+				t.Errorf("FileFromReader() error = %v", err)
+				return
+			}
+			err = CreateThumbnail(f.ToWriter(ioutil.Discard, 256))
+			var tErr *ThumbError
+			if !errors.As(err, &tErr) || tErr.Library != "vips" || tErr.Domain == "thumbnailer" {
+				t.Errorf("CreateThumbnail() error = %v, want a vips message", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCreateThumbnailMode(t *testing.T) {
+	for _, filename := range []string{"trollface.png", "Portrait_6.jpg", "schizo_90.mp4"} {
+		for _, mode := range []Mode{ModeFit, ModeCrop} {
+			t.Run(filename+"/"+mode.String(), func(t *testing.T) {
+				f, err := FileFromPath(filepath.Join("fixtures", filename))
+				if err != nil {
+					t.Fatalf("FileFromPath() error = %v", err)
+				}
+				f.Mode, f.TargetHeight = mode, 64
+				if err = CreateThumbnail(f.ToWriter(ioutil.Discard, 128)); err != nil {
+					t.Fatalf("CreateThumbnail() error = %v", err)
+				}
+				switch width, height := f.Thumbnail.Width, f.Thumbnail.Height; {
+				case mode == ModeCrop && (width != 128 || height != 64):
+					t.Errorf("dimensions want = 128x64, got = %dx%d", width, height)
+				case width > 128 || height > 64 || width != 128 && height != 64:
+					t.Errorf("dimensions want = 128x64 or smaller, got = %dx%d", width, height)
+				}
+			})
+		}
+	}
+	if mode, err := ParseMode("Crop"); mode != ModeCrop || err != nil {
+		t.Errorf("ParseMode() = %v, %v", mode, err)
+	}
+}
+
+func TestCreateThumbnailFrameTime(t *testing.T) {
+	for _, frameTime := range []time.Duration{time.Second, time.Hour} {
+		for _, seekable := range []bool{true, false} {
+			t.Run(fmt.Sprint(frameTime, seekable), func(t *testing.T) {
+				f, err := os.Open(filepath.Join("fixtures", "schizo_0.mp4"))
+				if err != nil {
+					t.Fatalf("os.Open() error = %v", err)
+				}
+				defer f.Close()
+				var file *File
+				if seekable {
+					file, err = FileFromReadSeeker(f, true)
+				} else {
+					file, err = FileFromReader(f)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.FrameTime = frameTime
+				if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 128)); err != nil {
+					t.Fatalf("CreateThumbnail() error = %v", err)
+				}
+				if !file.ThumbCreated || file.Duration <= 0 {
+					t.Errorf("ThumbCreated = %v, Duration = %v", file.ThumbCreated, file.Duration)
+				}
+			})
+		}
+	}
+}
+
+func TestCreateThumbnailSpool(t *testing.T) {
+	for _, filename := range []string{"macabre.mp4", "schizo_0.mp4", "schizo_90.mp4"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("os.Open() error = %v", err)
+			}
+			defer f.Close()
+			file, err := FileFromReader(f, filename)
+			if err != nil {
+				t.Fatalf("FileFromReader() error = %v", err)
+			}
+			file.Spool = &SpillPolicy{Dir: "tmp", MemoryThreshold: 1 << 16}
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 256)); err != nil {
+				t.Errorf("CreateThumbnail() error = %v", err)
+			}
+			if !file.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", true, file.ThumbCreated)
+			}
+			if file.Seeker != nil {
+				t.Errorf("Seeker want = %v, got = %v", nil, file.Seeker)
+			}
+		})
+	}
+}
+
+func TestFileFromReaderAt(t *testing.T) {
+	for _, filename := range []string{"trollface.png", "Portrait_6.jpg", "schizo_90.mp4", "spszut pszek.mp3"} {
+		data, err := ioutil.ReadFile(filepath.Join("fixtures", filename))
+		if err != nil {
+			t.Fatalf("ioutil.ReadFile() error = %v", err)
+		}
+		r := bytes.NewReader(data)
+		t.Run(filename, func(t *testing.T) {
+			wg := new(sync.WaitGroup)
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f, err := FileFromReaderAt(r, r.Size(), filename)
+					if err != nil {
+						t.Errorf("FileFromReaderAt() error = %v", err)
+						return
+					}
+					if err = CreateThumbnail(f.ToWriter(ioutil.Discard, 256)); err != nil {
+						t.Errorf("CreateThumbnail() error = %v", err)
+					} else if !f.ThumbCreated {
+						t.Errorf("ThumbCreated want = %v, got = %v", true, f.ThumbCreated)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestFileFromFS(t *testing.T) {
+	fsys := os.DirFS("fixtures")
+	for _, filename := range []string{"gif_bg.gif", "sample.tif", "small.ogv"} {
+		t.Run(filename, func(t *testing.T) {
+			f, err := FileFromFS(fsys, filename)
+			if err != nil {
+				t.Fatalf("FileFromFS() error = %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err = CreateThumbnail(f.ToWriter(ioutil.Discard, 256)); err != nil {
+					t.Errorf("CreateThumbnail() error = %v", err)
+				}
+			}
+			if !f.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", true, f.ThumbCreated)
+			}
+		})
+	}
+	if _, err := FileFromFS(fsys, "missing"); err == nil {
+		t.Errorf("FileFromFS() error = %v, want non-nil", err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		filename        string
+		wantDims        Dimensions
+		wantOrientation int
+		wantHasVideo    bool
+	}{
+		{"trollface.png", Dimensions{5000, 4068}, 1, false},
+		{"Portrait_6.jpg", Dimensions{1200, 1800}, 6, false},
+		{"sample.tif", Dimensions{1600, 2100}, 1, false},
+		{"schizo_90.mp4", Dimensions{480, 360}, 8, true},
+		{"alpha-webm.webm", Dimensions{720, 576}, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			f, err := FileFromPath(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			if err = Probe(f); err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if f.Dimensions != test.wantDims {
+				t.Errorf("Dimensions want = %v, got = %v", test.wantDims, f.Dimensions)
+			}
+			if f.Orientation != test.wantOrientation {
+				t.Errorf("Orientation want = %v, got = %v", test.wantOrientation, f.Orientation)
+			}
+			if f.HasVideo != test.wantHasVideo {
+				t.Errorf("HasVideo want = %v, got = %v", test.wantHasVideo, f.HasVideo)
+			}
+			if f.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", false, f.ThumbCreated)
+			}
+		})
+	}
+}
+
+func TestProbeReader(t *testing.T) {
+	for _, filename := range []string{"trollface.png", "Portrait_6.jpg"} {
+		t.Run(filename, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("ioutil.ReadFile() error = %v", err)
+			}
+			var read int64
+			f, err := FileFromReader(countingReader{bytes.NewReader(data), &read}, filename)
+			if err != nil {
+				t.Fatalf("FileFromReader() error = %v", err)
+			}
+			if err = Probe(f); err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if f.Width == 0 || f.Height == 0 {
+				t.Errorf("Dimensions want non-zero, got = %v", f.Dimensions)
+			}
+			if read >= int64(len(data)) {
+				t.Errorf("Probe() read the whole input (%d bytes)", read)
+			}
+		})
+	}
+}
+
+func TestProbeSeekstream(t *testing.T) {
+	for _, filename := range []string{"Landscape_8.jpg", "trollface.png"} {
+		t.Run(filename, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("fixtures", filename))
+			if err != nil {
+				t.Fatalf("ioutil.ReadFile() error = %v", err)
+			}
+			s, err := seekstream.NewFile("tmp")
+			if err != nil {
+				t.Fatalf("seekstream.NewFile() error = %v", err)
+			}
+			defer s.Remove()
+			half := len(data) / 2
+			if _, err = s.Write(data[:half]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			f, err := FileFromReadSeeker(s, false, filename)
+			if err != nil {
+				t.Fatalf("FileFromReadSeeker() error = %v", err)
+			}
+			if err = Probe(f); err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if f.Width == 0 || f.Height == 0 {
+				t.Errorf("Dimensions want non-zero, got = %v", f.Dimensions)
+			}
+			done := make(chan error)
+			go func() {
+				done <- CreateThumbnail(f.ToWriter(ioutil.Discard, 256))
+			}()
+			if _, err = s.Write(data[half:]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			s.DoneWriting()
+			if err = <-done; err != nil {
+				t.Errorf("CreateThumbnail() error = %v", err)
+			}
+			if !f.ThumbCreated {
+				t.Errorf("ThumbCreated want = %v, got = %v", true, f.ThumbCreated)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// ErrClosed is returned by Thumbnailer.Thumbnail after the Thumbnailer is closed.
+var ErrClosed = errors.New("thumbnailer: Thumbnailer is closed")
+
+// Config stores the configuration of a Thumbnailer. MaxConcurrent is the maximum number of thumbnails created at once
+// (GOMAXPROCS if not positive), and QueueLength is the number of jobs that can wait for a free worker before
+// Thumbnailer.Thumbnail starts blocking. Quality, Size and Format are used for Files that don't set their own Quality,
+// TargetDimensions or Format, and Limits for Files without their own Limits. Spill replaces SetSpillPolicy for the
+// images of Files without their own Spool, while SpoolVideo opts their non-seekable videos into being spooled
+// according to it (or SetSpillPolicy if nil), as if their Spool was set. The Files passed to Thumbnailer.Thumbnail
+// aren't modified by the Config, as it's applied to copies of them.
+type Config struct {
+	MaxConcurrent, QueueLength, Quality, Size int
+	Format                                    Format
+	Spill                                     *SpillPolicy
+	SpoolVideo                                bool
+	Limits                                    *Limits
+}
+
+// Thumbnailer creates thumbnails with a bounded pool of workers, applying its Config to every File it's given.
+type Thumbnailer struct {
+	config Config
+	jobs   chan *job
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+type job struct {
+	ctx  context.Context
+	file *File
+	done chan error
+}
+
+// New initializes vips and returns a Thumbnailer with the supplied Config, with all of its workers started.
+func New(config Config) *Thumbnailer {
+	initVIPS()
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = runtime.GOMAXPROCS(0)
+	}
+	if config.QueueLength < 0 {
+		config.QueueLength = 0
+	}
+	t := &Thumbnailer{config: config, jobs: make(chan *job, config.QueueLength)}
+	t.wg.Add(config.MaxConcurrent)
+	for i := 0; i < config.MaxConcurrent; i++ {
+		go t.work()
+	}
+	return t
+}
+
+func (t *Thumbnailer) work() {
+	defer t.wg.Done()
+	for j := range t.jobs {
+		if err := j.ctx.Err(); err != nil {
+			j.done <- err
+			continue
+		}
+		f := t.apply(j.file)
+		err := CreateThumbnailWithContext(j.ctx, f)
+		restore(j.file, f)
+		j.done <- err
+	}
+}
+
+// apply returns a copy of the File with the Config applied.
+func (t *Thumbnailer) apply(file *File) *File {
+	f := *file
+	if f.TargetDimensions == 0 {
+		f.TargetDimensions = t.config.Size
+	}
+	if f.Quality == 0 {
+		f.Quality = t.config.Quality
+		if f.Quality == 0 {
+			f.Quality = defaultQuality
+		}
+	}
+	if f.Format == FormatAuto {
+		f.Format = t.config.Format
+	}
+	if f.Spool == nil {
+		f.spill = t.config.Spill
+		if t.config.SpoolVideo {
+			policy := f.spillPolicy()
+			f.Spool = &policy
+		}
+	}
+	if f.Limits == nil {
+		f.Limits = t.config.Limits
+	}
+	return &f
+}
+
+// restore copies the results (metadata, thumbnail and input state) of the File's configured copy back into it,
+// keeping its own settings.
+func restore(file, applied *File) {
+	applied.TargetDimensions, applied.Quality, applied.Format = file.TargetDimensions, file.Quality, file.Format
+	applied.Spool, applied.Limits, applied.spill = file.Spool, file.Limits, file.spill
+	*file = *applied
+}
+
+// Thumbnail queues the creation of the supplied File's thumbnail and waits for it to finish, returning the result of
+// CreateThumbnailWithContext. If the queue is full, it blocks until a worker frees up or the context is done.
+func (t *Thumbnailer) Thumbnail(ctx context.Context, file *File) error {
+	j := &job{ctx: ctx, file: file, done: make(chan error, 1)}
+	t.mu.RLock()
+	if t.closed {
+		t.mu.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case t.jobs <- j:
+		t.mu.RUnlock()
+	case <-ctx.Done():
+		t.mu.RUnlock()
+		return ctx.Err()
+	}
+	return <-j.done
+}
+
+// Close stops accepting new jobs and waits for the queued and in-flight ones to finish. It only stops this
+// Thumbnailer's workers: vips stays initialized for other Thumbnailers and CreateThumbnail calls, and shutting it down
+// with ShutdownVIPS is left to the program.
+func (t *Thumbnailer) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.jobs)
+	t.mu.Unlock()
+	t.wg.Wait()
+	return nil
+}
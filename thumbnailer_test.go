@@ -0,0 +1,72 @@
+package thumbnailer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestThumbnailer(t *testing.T) {
+	tn := New(Config{MaxConcurrent: 2, QueueLength: 1, Size: 128, Format: FormatWebP})
+	filenames := []string{"trollface.png", "Portrait_3.jpg", "schizo_180.mp4", "gif_bg.gif", "small.ogv"}
+	wg := new(sync.WaitGroup)
+	for _, filename := range filenames {
+		f, err := FileFromPath(filepath.Join("fixtures", filename))
+		if err != nil {
+			t.Fatalf("FileFromPath() error = %v", err)
+		}
+		f.Writer = ioutil.Discard
+		wg.Add(1)
+		go func(filename string) {
+			defer wg.Done()
+			if err := tn.Thumbnail(context.Background(), f); err != nil {
+				t.Errorf("Thumbnail(%s) error = %v", filename, err)
+			}
+			if f.TargetDimensions != 0 || f.Quality != 0 || f.Format != FormatAuto || f.Spool != nil {
+				t.Errorf("Thumbnail(%s) modified the File's settings, got = %+v", filename, f.Thumbnail)
+			}
+			if !f.ThumbCreated || f.Thumbnail.Width > 128 || f.Thumbnail.Height > 128 {
+				t.Errorf("Thumbnail(%s) ThumbCreated = %v, Dimensions = %v", filename, f.ThumbCreated,
+					f.Thumbnail.Dimensions)
+			}
+		}(filename)
+	}
+	wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, err := FileFromPath(filepath.Join("fixtures", filenames[0]))
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	if err = tn.Thumbnail(ctx, f.ToWriter(ioutil.Discard, 128)); err != context.Canceled {
+		t.Errorf("Thumbnail() error = %v, want = %v", err, context.Canceled)
+	}
+	if err = tn.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if err = tn.Thumbnail(context.Background(), f); err != ErrClosed {
+		t.Errorf("Thumbnail() error = %v, want = %v", err, ErrClosed)
+	}
+	// Closing a Thumbnailer leaves vips running for the others.
+	other := New(Config{MaxConcurrent: 1})
+	defer other.Close()
+	if err = other.Thumbnail(context.Background(), f.ToWriter(ioutil.Discard, 128)); err != nil || !f.ThumbCreated {
+		t.Errorf("Thumbnail() error = %v, ThumbCreated = %v", err, f.ThumbCreated)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range []Format{FormatAuto, FormatJPEG, FormatPNG, FormatWebP} {
+		if got, err := ParseFormat(format.String()); err != nil || got != format {
+			t.Errorf("ParseFormat(%v) = %v, %v", format, got, err)
+		}
+	}
+	if got, err := ParseFormat("JPG"); err != nil || got != FormatJPEG {
+		t.Errorf("ParseFormat(JPG) = %v, %v", got, err)
+	}
+	if _, err := ParseFormat("bmp"); err == nil {
+		t.Errorf("ParseFormat(bmp) error = %v, want non-nil", err)
+	}
+}
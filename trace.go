@@ -0,0 +1,116 @@
+package thumbnailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer starts the spans of thumbnail jobs. Every call to CreateThumbnailWithContext starts a "thumbnail" span from
+// the context passed to it, with the nested spans of its stages started from the context returned for it: "open" for
+// opening the input, "spool" for spooling non-seekable input, "probe" for FFmpeg opening the container and finding its
+// streams, "decode" for decoding the frames to pick the thumbnail from, "select frame" for picking and converting the
+// most representative frame, "duration" for reading the whole input for its duration, "resize" for vips loading and
+// resizing the image, "encode" for vips encoding the thumbnail, and "write" (nested in "encode") for writing it to the
+// File's io.Writer. Only the stages a File goes through are traced, and resizing overlaps the search for the duration
+// of videos.
+//
+// Spans are annotated with the key-value pairs "media.type", "path", "codec", "width", "height", "duration", "frames",
+// "thumbnail.width", "thumbnail.height" and "output.bytes", where they apply. Tracers for libraries such as
+// OpenTelemetry are thin adapters, and belong outside this package.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. It may be used from a different goroutine than the one that started it, but not
+// concurrently.
+type Span interface {
+	// SetAttributes annotates the span with alternating string keys and values.
+	SetAttributes(args ...interface{})
+	// End ends the span, with the error the stage failed with, if any.
+	End(err error)
+}
+
+var tracer = struct {
+	sync.RWMutex
+	Tracer
+}{}
+
+// SetTracer sets the Tracer of all thumbnail jobs. A nil Tracer disables tracing.
+func SetTracer(t Tracer) {
+	tracer.Lock()
+	tracer.Tracer = t
+	tracer.Unlock()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...interface{}) {}
+
+func (noopSpan) End(error) {}
+
+// startSpan starts a span with the current Tracer, if there is one.
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	tracer.RLock()
+	t := tracer.Tracer
+	tracer.RUnlock()
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	return t.Start(ctx, name)
+}
+
+// NewTextTracer returns a Tracer that writes a line to the io.Writer (e.g. os.Stdout) for every ended span: its name
+// prefixed by the names of its ancestors and followed by a colon, then its duration, attributes and error, e.g.
+// "thumbnail/encode/write: 1.2ms output.bytes=5120". It's meant for debugging and tests.
+func NewTextTracer(w io.Writer) Tracer {
+	return &textTracer{w: w}
+}
+
+type textTracer struct {
+	sync.Mutex
+	w io.Writer
+}
+
+type textSpanKey struct{}
+
+type textSpan struct {
+	tracer *textTracer
+	name   string
+	start  time.Time
+	attrs  []interface{}
+}
+
+func (t *textTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	if parent, ok := ctx.Value(textSpanKey{}).(*textSpan); ok && parent.tracer == t {
+		name = parent.name + "/" + name
+	}
+	s := &textSpan{tracer: t, name: name, start: time.Now()}
+	return context.WithValue(ctx, textSpanKey{}, s), s
+}
+
+func (s *textSpan) SetAttributes(args ...interface{}) {
+	s.attrs = append(s.attrs, args...)
+}
+
+func (s *textSpan) End(err error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %v", s.name, time.Since(s.start))
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		if v, ok := s.attrs[i+1].(string); ok {
+			fmt.Fprintf(&b, " %v=%q", s.attrs[i], v)
+		} else {
+			fmt.Fprintf(&b, " %v=%v", s.attrs[i], s.attrs[i+1])
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(&b, " error=%q", err.Error())
+	}
+	b.WriteByte('\n')
+	s.tracer.Lock()
+	_, _ = io.WriteString(s.tracer.w, b.String())
+	s.tracer.Unlock()
+}
@@ -0,0 +1,110 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetTracer(t *testing.T) {
+	tests := []struct {
+		filename string
+		spans    []string
+	}{
+		{"Landscape_8.jpg", []string{"thumbnail/open", "thumbnail/resize", "thumbnail/encode/write",
+			"thumbnail/encode", "thumbnail"}},
+		{"schizo_0.mp4", []string{"thumbnail/open", "thumbnail/probe", "thumbnail/decode", "thumbnail/select frame",
+			"thumbnail/resize", "thumbnail/encode/write", "thumbnail/encode", "thumbnail"}},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			SetTracer(NewTextTracer(buf))
+			defer SetTracer(nil)
+			file, err := FileFromPath(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Fatalf("FileFromPath() error = %v", err)
+			}
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 256)); err != nil {
+				t.Fatalf("CreateThumbnail() error = %v", err)
+			}
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			var spans []string
+			attrs := make(map[string]string)
+			for _, line := range lines {
+				fields := strings.SplitN(line, ": ", 2)
+				if len(fields) != 2 {
+					t.Fatalf("malformed line %q", line)
+				}
+				spans = append(spans, fields[0])
+				attrs[fields[0]] = fields[1]
+				if strings.Contains(line, "error=") {
+					t.Errorf("span failed: %v", line)
+				}
+			}
+			if strings.Join(spans, ",") != strings.Join(test.spans, ",") {
+				t.Errorf("spans want = %v, got = %v", test.spans, spans)
+			}
+			for _, want := range []string{"thumbnail.width=", "output.bytes="} {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("attribute %v missing from:\n%s", want, buf)
+				}
+			}
+			if strings.HasSuffix(test.filename, ".mp4") {
+				for name, want := range map[string]string{"thumbnail/probe": `codec="h264"`, "thumbnail/decode": "frames="} {
+					if !strings.Contains(attrs[name], want) {
+						t.Errorf("%v attributes want %v, got %v", name, want, attrs[name])
+					}
+				}
+			}
+		})
+	}
+}
+
+type recordingSpan struct {
+	name  string
+	attrs []interface{}
+	err   error
+	ended bool
+}
+
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordingSpan{name: name}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func (s *recordingSpan) SetAttributes(args ...interface{}) { s.attrs = append(s.attrs, args...) }
+
+func (s *recordingSpan) End(err error) { s.err, s.ended = err, true }
+
+func TestTracerWriterError(t *testing.T) {
+	tr := new(recordingTracer)
+	SetTracer(tr)
+	defer SetTracer(nil)
+	file, err := FileFromPath(filepath.Join("fixtures", "Landscape_8.jpg"))
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	wErr := errors.New("write failed")
+	err = CreateThumbnail(file.ToWriter(errWriter{wErr}, 256))
+	if !errors.Is(err, wErr) {
+		t.Fatalf("CreateThumbnail() error = %v", err)
+	}
+	for _, s := range tr.spans {
+		if !s.ended {
+			t.Errorf("span %v not ended", s.name)
+		}
+		if (s.name == "write" || s.name == "encode" || s.name == "thumbnail") != (s.err != nil) {
+			t.Errorf("span %v error = %v", s.name, s.err)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Package upload provides net/http middleware that thumbnails and probes uploaded files while they're received and
+// stored, instead of re-reading them from storage afterwards.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// Errors reported in Result.Err.
+var (
+	ErrFellBehind = errors.New("upload: thumbnailing fell behind the upload")
+	ErrNoStore    = errors.New("upload: no Store function")
+)
+
+// Spec is the specification of a thumbnail created for every uploaded file: its Name, the Size of its bounding box, its
+// Quality (the thumbnailer's default if 0) and its Format.
+type Spec struct {
+	Name          string
+	Size, Quality int
+	Format        thumbnailer.Format
+}
+
+// Config stores the configuration of the middleware. Store stores an uploaded file, and must read r to the end; the
+// field is the name of its form field (empty for non-multipart uploads). Specs are the thumbnails created for every
+// file (only the metadata is probed if there are none). BufferSize is the maximum number of bytes buffered between the
+// upload and the thumbnailer (4 MiB if not positive), MaxFieldsSize the maximum combined size of the non-file form
+// fields (1 MiB if not positive), and Create the function creating the thumbnails
+// (thumbnailer.CreateThumbnailWithContext if nil). Spool is the SpillPolicy of the uploads, used for images, and for
+// video and audio files that can't be thumbnailed without seeking, e.g. MP4 and MOV files with their index at the end
+// (everything is spilled to os.TempDir() with no size limit if nil).
+type Config struct {
+	Store         func(ctx context.Context, field, filename string, r io.Reader) error
+	Specs         []Spec
+	BufferSize    int
+	MaxFieldsSize int64
+	Create        func(ctx context.Context, file *thumbnailer.File) error
+	Spool         *thumbnailer.SpillPolicy
+}
+
+// Thumbnail is a thumbnail created according to its Spec, with its encoded Data, Dimensions and whether it HasAlpha.
+type Thumbnail struct {
+	Spec
+	Data []byte
+	thumbnailer.Dimensions
+	HasAlpha bool
+}
+
+// Result is the outcome of an uploaded file: its form Field, Filename and Size, the File with its sniffed MediaType and
+// probed metadata (Dimensions, Orientation, Duration and so on), and its Thumbnails, in the order of the Specs. Err is
+// the error that stopped thumbnailing or probing, e.g. ErrFellBehind, in which case the stored file should be
+// thumbnailed instead, and the File and Thumbnails may be incomplete.
+type Result struct {
+	Field, Filename string
+	Size            int64
+	File            *thumbnailer.File
+	Thumbnails      []Thumbnail
+	Err             error
+}
+
+// Upload is attached to the contexts of the requests passed to the downstream handler, with the Results of the uploaded
+// files in the order they were received, and the non-file form Fields.
+type Upload struct {
+	Files  []*Result
+	Fields url.Values
+}
+
+type contextKey struct{}
+
+// FromContext returns the Upload attached to the context by the middleware, or nil if there is none.
+func FromContext(ctx context.Context) *Upload {
+	u, _ := ctx.Value(contextKey{}).(*Upload)
+	return u
+}
+
+// Middleware returns middleware that consumes the bodies of requests: the file parts of multipart/form-data bodies, or
+// the whole body of other requests (named after the last element of the URL path). Every file is passed to the Store
+// function and, at the same time, through a bounded buffer, to the thumbnailer, which creates the thumbnails of the
+// Specs (from a lossless intermediate of the largest, if there are several) and records the probed metadata. The upload
+// never waits for the thumbnailer: if the buffer fills up, the file's thumbnailing is abandoned with ErrFellBehind.
+// Once the body is consumed, the middleware waits for the thumbnailer, and calls the downstream handler with the Upload
+// attached to the request's context. Thumbnailing is cancelled if the request is. Requests with malformed bodies are
+// answered with 400 Bad Request, and those whose files can't be stored with 500 Internal Server Error.
+func Middleware(config Config) func(http.Handler) http.Handler {
+	if config.BufferSize <= 0 {
+		config.BufferSize = 4 << 20
+	}
+	if config.MaxFieldsSize <= 0 {
+		config.MaxFieldsSize = 1 << 20
+	}
+	if config.Create == nil {
+		config.Create = thumbnailer.CreateThumbnailWithContext
+	}
+	if config.Spool == nil {
+		config.Spool = new(thumbnailer.SpillPolicy)
+	}
+	m := &middleware{config: config}
+	for _, spec := range config.Specs {
+		if spec.Size > m.size {
+			m.size = spec.Size
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, status, err := m.receive(r)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, u)))
+		})
+	}
+}
+
+type middleware struct {
+	config Config
+	// size is the Size of the largest Spec.
+	size int
+}
+
+func (m *middleware) receive(r *http.Request) (*Upload, int, error) {
+	if m.config.Store == nil {
+		return nil, http.StatusInternalServerError, ErrNoStore
+	}
+	u := &Upload{Fields: make(url.Values)}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		res, err := m.file(r.Context(), "", path.Base(r.URL.Path), r.Body)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		u.Files = append(u.Files, res)
+		return u, 0, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	remaining := m.config.MaxFieldsSize
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return u, 0, nil
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, remaining+1))
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			if remaining -= int64(len(value)); remaining < 0 {
+				return nil, http.StatusRequestEntityTooLarge, errors.New("upload: form fields too large")
+			}
+			u.Fields.Add(part.FormName(), string(value))
+			continue
+		}
+		res, err := m.file(r.Context(), part.FormName(), part.FileName(), part)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		u.Files = append(u.Files, res)
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// file stores and thumbnails a file, returning the error of storing it.
+func (m *middleware) file(ctx context.Context, field, filename string, r io.Reader) (*Result, error) {
+	res := &Result{Field: field, Filename: filename}
+	p := newPipe(m.config.BufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res.File, res.Thumbnails, res.Err = m.thumbnail(ctx, p, filename)
+		p.closeRead()
+	}()
+	counter := new(countingWriter)
+	tee := io.TeeReader(r, io.MultiWriter(counter, p))
+	err := m.config.Store(ctx, field, filename, tee)
+	if err == nil {
+		_, err = io.Copy(io.Discard, tee)
+	}
+	p.closeWrite(err)
+	<-done
+	res.Size = counter.n
+	return res, err
+}
+
+// thumbnail creates the thumbnails of the Specs from the reader. The upload can only be read once, so with several
+// Specs, it's thumbnailed into a lossless PNG of the largest Size first, and the Specs are created from that, without
+// compounding the losses of their encodings. No thumbnails are created if the upload has none, e.g. audio without
+// cover art.
+func (m *middleware) thumbnail(ctx context.Context, r io.Reader, filename string) (*thumbnailer.File,
+	[]Thumbnail, error) {
+	file, err := thumbnailer.FileFromReader(r, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	file.Spool = m.config.Spool
+	if len(m.config.Specs) == 0 {
+		return file, nil, thumbnailer.ProbeWithContext(ctx, file)
+	}
+	if len(m.config.Specs) == 1 {
+		t, err := m.create(ctx, file, m.config.Specs[0])
+		if t == nil {
+			return file, nil, err
+		}
+		return file, []Thumbnail{*t}, err
+	}
+	intermediate := new(bytes.Buffer)
+	file.ToWriter(intermediate, m.size).Format = thumbnailer.FormatPNG
+	if err = m.config.Create(ctx, file); err != nil || !file.ThumbCreated {
+		return file, nil, err
+	}
+	var thumbs []Thumbnail
+	for _, spec := range m.config.Specs {
+		src, err := thumbnailer.FileFromReadSeeker(bytes.NewReader(intermediate.Bytes()), true)
+		if err != nil {
+			return file, thumbs, err
+		}
+		t, err := m.create(ctx, src, spec)
+		if err != nil {
+			return file, thumbs, err
+		}
+		if t != nil {
+			thumbs = append(thumbs, *t)
+		}
+	}
+	return file, thumbs, nil
+}
+
+// create creates the thumbnail of the Spec from the File, returning nil if the File has none.
+func (m *middleware) create(ctx context.Context, file *thumbnailer.File, spec Spec) (*Thumbnail, error) {
+	buf := new(bytes.Buffer)
+	if spec.Quality > 0 {
+		file.ToWriter(buf, spec.Size, spec.Quality)
+	} else {
+		file.ToWriter(buf, spec.Size)
+	}
+	file.Format = spec.Format
+	if err := m.config.Create(ctx, file); err != nil || !file.ThumbCreated {
+		return nil, err
+	}
+	return &Thumbnail{spec, buf.Bytes(), file.Thumbnail.Dimensions, file.HasAlpha}, nil
+}
+
+// pipe is an in-memory pipe whose writes never block: bytes that don't fit in the buffer make reads fail with
+// ErrFellBehind, and those written after the read side is closed are discarded.
+type pipe struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte
+	max        int
+	err        error
+	readClosed bool
+}
+
+func newPipe(max int) *pipe {
+	p := &pipe{max: max}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.readClosed || p.err != nil:
+	case len(p.buf)+len(b) > p.max:
+		p.buf, p.err = nil, ErrFellBehind
+		p.cond.Signal()
+	default:
+		p.buf = append(p.buf, b...)
+		p.cond.Signal()
+	}
+	return len(b), nil
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.buf) == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if len(p.buf) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.buf)
+	if p.buf = p.buf[n:]; len(p.buf) == 0 {
+		p.buf = p.buf[:0:0]
+	}
+	return n, nil
+}
+
+// closeWrite makes reads fail with the error, or io.EOF if it's nil, once the buffer is drained.
+func (p *pipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// closeRead discards the buffer and all further writes.
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	p.buf, p.readClosed = nil, true
+	p.mu.Unlock()
+}
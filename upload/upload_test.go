@@ -0,0 +1,270 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zRedShift/thumbnailer"
+)
+
+// fakeCreate prefixes the contents of the file with the size and format of the thumbnail, failing for the sizes in
+// fail, and creating no thumbnails for the contents in empty.
+type fakeCreate struct {
+	mu    sync.Mutex
+	sizes []int
+	fail  map[int]error
+	empty map[string]bool
+}
+
+func (f *fakeCreate) create(ctx context.Context, file *thumbnailer.File) error {
+	f.mu.Lock()
+	f.sizes = append(f.sizes, file.TargetDimensions)
+	err := f.fail[file.TargetDimensions]
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file.Reader)
+	if err != nil || f.empty[string(data)] {
+		return err
+	}
+	file.Thumbnail.Dimensions = thumbnailer.Dimensions{Width: file.TargetDimensions, Height: file.TargetDimensions}
+	file.ThumbCreated = true
+	prefix := "thumb" + strconv.Itoa(file.TargetDimensions) + file.Format.String() + ":"
+	_, err = file.Writer.Write(append([]byte(prefix), data...))
+	return err
+}
+
+type store struct {
+	mu    sync.Mutex
+	files map[string]string
+	err   error
+}
+
+func (s *store) store(_ context.Context, field, filename string, r io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]string)
+	}
+	s.files[field+"/"+filename] = string(data)
+	return nil
+}
+
+// serve passes the request through the middleware, returning the response and the Upload seen by the handler.
+func serve(config Config, r *http.Request) (*httptest.ResponseRecorder, *Upload) {
+	var u *Upload
+	h := Middleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u = FromContext(r.Context())
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w, u
+}
+
+func multipartRequest(t *testing.T, fields map[string]string, files ...string) *http.Request {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i+1 < len(files); i += 2 {
+		fw, err := mw.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	f, s := new(fakeCreate), new(store)
+	config := Config{
+		Store:  s.store,
+		Specs:  []Spec{{Name: "small", Size: 64}, {Name: "large", Size: 256, Quality: 90}},
+		Create: f.create,
+	}
+	r := multipartRequest(t, map[string]string{"title": "cats"}, "a.png", "first", "b.jpg", "second")
+	w, u := serve(config, r)
+	if w.Code != http.StatusOK || u == nil {
+		t.Fatalf("status = %d, upload = %v", w.Code, u)
+	}
+	if got := u.Fields.Get("title"); got != "cats" {
+		t.Errorf("title = %q", got)
+	}
+	if s.files["file/a.png"] != "first" || s.files["file/b.jpg"] != "second" {
+		t.Errorf("stored files = %v", s.files)
+	}
+	if len(u.Files) != 2 {
+		t.Fatalf("%d files", len(u.Files))
+	}
+	for i, want := range []string{"first", "second"} {
+		res := u.Files[i]
+		if res.Err != nil || res.Field != "file" || res.Size != int64(len(want)) || res.File == nil {
+			t.Errorf("%d: unexpected result %+v", i, res)
+			continue
+		}
+		if len(res.Thumbnails) != 2 {
+			t.Errorf("%d: %d thumbnails", i, len(res.Thumbnails))
+			continue
+		}
+		small, large := res.Thumbnails[0], res.Thumbnails[1]
+		if large.Name != "large" || string(large.Data) != "thumb256auto:thumb256png:"+want || large.Width != 256 {
+			t.Errorf("%d: large thumbnail %+v", i, large)
+		}
+		if small.Name != "small" || string(small.Data) != "thumb64auto:thumb256png:"+want || small.Width != 64 {
+			t.Errorf("%d: small thumbnail %+v", i, small)
+		}
+	}
+	if want := []int{256, 64, 256, 256, 64, 256}; !reflect.DeepEqual(f.sizes, want) {
+		t.Errorf("sizes = %v, want %v", f.sizes, want)
+	}
+}
+
+func TestMiddlewareRaw(t *testing.T) {
+	f, s := new(fakeCreate), new(store)
+	f.fail = map[int]error{64: thumbnailer.ErrInvalidData}
+	config := Config{Store: s.store, Specs: []Spec{{Size: 256}, {Size: 64}}, Create: f.create}
+	r := httptest.NewRequest(http.MethodPut, "/photos/cat.jpg", strings.NewReader("raw"))
+	w, u := serve(config, r)
+	if w.Code != http.StatusOK || u == nil || len(u.Files) != 1 {
+		t.Fatalf("status = %d, upload = %v", w.Code, u)
+	}
+	res := u.Files[0]
+	if res.Field != "" || res.Filename != "cat.jpg" || res.Size != 3 || s.files["/cat.jpg"] != "raw" {
+		t.Errorf("unexpected result %+v, stored %v", res, s.files)
+	}
+	if res.Err != thumbnailer.ErrInvalidData || len(res.Thumbnails) != 1 ||
+		string(res.Thumbnails[0].Data) != "thumb256auto:thumb256png:raw" {
+		t.Errorf("err = %v, thumbnails = %+v", res.Err, res.Thumbnails)
+	}
+}
+
+func TestMiddlewareNoThumbnail(t *testing.T) {
+	for _, specs := range [][]Spec{{{Size: 256}}, {{Size: 256}, {Size: 64, Format: thumbnailer.FormatWebP}}} {
+		f, s := &fakeCreate{empty: map[string]bool{"audio": true}}, new(store)
+		config := Config{Store: s.store, Specs: specs, Create: f.create}
+		w, u := serve(config, httptest.NewRequest(http.MethodPut, "/song.mp3", strings.NewReader("audio")))
+		if w.Code != http.StatusOK || u == nil || len(u.Files) != 1 {
+			t.Fatalf("status = %d, upload = %v", w.Code, u)
+		}
+		if res := u.Files[0]; res.Err != nil || len(res.Thumbnails) != 0 || res.File == nil {
+			t.Errorf("%d specs: err = %v, %d thumbnails", len(specs), res.Err, len(res.Thumbnails))
+		}
+		if want := []int{256}; !reflect.DeepEqual(f.sizes, want) {
+			t.Errorf("%d specs: sizes = %v, want %v", len(specs), f.sizes, want)
+		}
+	}
+}
+
+func TestMiddlewareSpool(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "fixtures", "macabre.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(store)
+	config := Config{
+		Store:      s.store,
+		Specs:      []Spec{{Size: 256}, {Size: 64}},
+		BufferSize: len(data),
+		Spool:      &thumbnailer.SpillPolicy{Dir: t.TempDir(), MemoryThreshold: 1 << 16},
+	}
+	w, u := serve(config, httptest.NewRequest(http.MethodPut, "/macabre.mp4", bytes.NewReader(data)))
+	if w.Code != http.StatusOK || u == nil || len(u.Files) != 1 {
+		t.Fatalf("status = %d, upload = %v", w.Code, u)
+	}
+	res := u.Files[0]
+	if res.Err != nil || len(res.Thumbnails) != 2 || !res.File.HasVideo {
+		t.Fatalf("err = %v, %d thumbnails, file = %+v", res.Err, len(res.Thumbnails), res.File)
+	}
+	for i, size := range []int{256, 64} {
+		if thumb := res.Thumbnails[i]; thumb.Width != size && thumb.Height != size || len(thumb.Data) == 0 {
+			t.Errorf("%d: thumbnail %v, %d bytes", size, thumb.Dimensions, len(thumb.Data))
+		}
+	}
+}
+
+func TestMiddlewareFellBehind(t *testing.T) {
+	f, s := new(fakeCreate), new(store)
+	config := Config{Store: s.store, Specs: []Spec{{Size: 256}}, BufferSize: 16, Create: f.create}
+	data := strings.Repeat("x", 1<<20)
+	w, u := serve(config, httptest.NewRequest(http.MethodPost, "/big.bin", strings.NewReader(data)))
+	if w.Code != http.StatusOK || u == nil || len(u.Files) != 1 {
+		t.Fatalf("status = %d, upload = %v", w.Code, u)
+	}
+	if res := u.Files[0]; !errors.Is(res.Err, ErrFellBehind) || res.Size != int64(len(data)) || len(res.Thumbnails) != 0 {
+		t.Errorf("err = %v, size = %d, %d thumbnails", res.Err, res.Size, len(res.Thumbnails))
+	}
+	if s.files["/big.bin"] != data {
+		t.Error("file not stored in full")
+	}
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	f := new(fakeCreate)
+	for _, tc := range []struct {
+		name   string
+		config Config
+		r      *http.Request
+		status int
+	}{
+		{"no store", Config{}, httptest.NewRequest(http.MethodPost, "/a", nil), http.StatusInternalServerError},
+		{
+			"store error",
+			Config{Store: (&store{err: errors.New("disk full")}).store},
+			multipartRequest(t, nil, "a.png", "data"),
+			http.StatusInternalServerError,
+		},
+		{
+			"fields too large",
+			Config{Store: new(store).store, MaxFieldsSize: 4},
+			multipartRequest(t, map[string]string{"title": "too long"}),
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"malformed body",
+			Config{Store: new(store).store},
+			func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("--x\r\nbroken"))
+				r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+				return r
+			}(),
+			http.StatusBadRequest,
+		},
+	} {
+		tc.config.Create = f.create
+		if w, u := serve(tc.config, tc.r); w.Code != tc.status || u != nil {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
@@ -26,13 +26,251 @@ static int has_alpha(VipsImage *in, gboolean *has_alpha) {
     return err;
 }
 
+static gint64 read_source(VipsSourceCustom *source, void *buf, gint64 length, gpointer handle) {
+    return readSourceCallback((uintptr_t) handle, buf, length);
+}
+
+static gint64 seek_source(VipsSourceCustom *source, gint64 offset, int whence, gpointer handle) {
+    return seekSourceCallback((uintptr_t) handle, offset, whence);
+}
+
+static gint64 write_target(VipsTargetCustom *target, const void *buf, gint64 length, gpointer handle) {
+    return writeTargetCallback((uintptr_t) handle, (void *) buf, length);
+}
+
+#define JPEG_OPTIONS "Q", thumb->quality, "strip", TRUE, "optimize-coding", TRUE, NULL
+#define PNG_OPTIONS "Q", thumb->quality, "strip", TRUE, "palette", TRUE, NULL
+#define WEBP_OPTIONS "Q", thumb->quality, "strip", TRUE, NULL
+
+static int flatten(VipsImage **out) {
+    VipsArrayDouble *background = vips_array_double_newv(3, 255.0, 255.0, 255.0);
+    VipsImage *flat;
+    int err = vips_flatten(*out, &flat, "background", background, NULL);
+    vips_area_unref(VIPS_AREA(background));
+    if (err) {
+        return -1;
+    }
+    g_object_unref(*out);
+    *out = flat;
+    return 0;
+}
+
+static int save(VipsImage *out, RawThumbnail *thumb) {
+    VipsTarget *target = NULL;
+    if (!thumb->output_path) {
+        VipsTargetCustom *custom = vips_target_custom_new();
+        if (!custom) {
+            return -1;
+        }
+        g_signal_connect(custom, "write", G_CALLBACK(write_target), (gpointer) thumb->handle);
+        target = VIPS_TARGET(custom);
+    }
+    int format = thumb->format;
+    if (format == FORMAT_AUTO) {
+        format = thumb->has_alpha ? FORMAT_PNG : FORMAT_JPEG;
+    }
+    int err;
+    switch (format) {
+        case FORMAT_PNG:
+            err = target ? vips_pngsave_target(out, target, PNG_OPTIONS) : vips_pngsave(out, thumb->output_path,
+                                                                                        PNG_OPTIONS);
+            break;
+        case FORMAT_WEBP:
+            err = target ? vips_webpsave_target(out, target, WEBP_OPTIONS) : vips_webpsave(out, thumb->output_path,
+                                                                                          WEBP_OPTIONS);
+            break;
+        default:
+            err = target ? vips_jpegsave_target(out, target, JPEG_OPTIONS) : vips_jpegsave(out, thumb->output_path,
+                                                                                          JPEG_OPTIONS);
+    }
+    if (target) {
+        g_object_unref(target);
+    }
+    return err;
+}
+
+static int free_input(void *input, void *unused) {
+    free(input);
+    return 0;
+}
+
+// load_source loads the image of a source with the loader that recognizes it, marking the call's failure as unsupported
+// if none does.
+static VipsImage *load_source(RawThumbnail *thumb, VipsSource *source, const char **loader) {
+    if (!(*loader = vips_foreign_find_load_source(source))) {
+        thumb->stage = STAGE_UNSUPPORTED;
+        return NULL;
+    }
+    return vips_image_new_from_source(source, "", NULL);
+}
+
+static VipsImage *load_from_buffer(RawThumbnail *thumb, const char **loader) {
+    VipsBlob *blob = vips_blob_new(free_input, thumb->input, thumb->input_size);
+    thumb->input = NULL;
+    VipsSource *source = vips_source_new_from_blob(blob);
+    vips_area_unref(VIPS_AREA(blob));
+    if (!source) {
+        return NULL;
+    }
+    VipsImage *in = load_source(thumb, source, loader);
+    g_object_unref(source);
+    return in;
+}
+
+static VipsImage *load_from_source(RawThumbnail *thumb, const char **loader) {
+    VipsSourceCustom *source = vips_source_custom_new();
+    if (!source) {
+        return NULL;
+    }
+    g_signal_connect(source, "read", G_CALLBACK(read_source), (gpointer) thumb->handle);
+    g_signal_connect(source, "seek", G_CALLBACK(seek_source), (gpointer) thumb->handle);
+    VipsImage *in = load_source(thumb, VIPS_SOURCE(source), loader);
+    g_object_unref(source);
+    return in;
+}
+
+static int load(RawThumbnail *thumb, VipsImage **in) {
+    thumb->stage = STAGE_LOAD;
+    const char *loader = NULL;
+    if (thumb->input_path) {
+        if ((loader = vips_foreign_find_load(thumb->input_path))) {
+            *in = vips_image_new_from_file(thumb->input_path, NULL);
+        } else {
+            thumb->stage = STAGE_UNSUPPORTED;
+            *in = NULL;
+        }
+    } else if (thumb->input_source) {
+        *in = load_from_source(thumb, &loader);
+    } else {
+        *in = load_from_buffer(thumb, &loader);
+    }
+    if (!*in) {
+        return -1;
+    }
+    thumb->width = vips_image_get_width(*in);
+    thumb->height = vips_image_get_height(*in);
+    if (!vips_image_get_typeof(*in, VIPS_META_ORIENTATION) ||
+        vips_image_get_int(*in, VIPS_META_ORIENTATION, &thumb->orientation)) {
+        thumb->orientation = 1;
+    }
+    if (!vips_image_get_typeof(*in, VIPS_META_N_PAGES) || vips_image_get_int(*in, VIPS_META_N_PAGES, &thumb->pages)) {
+        thumb->pages = 1;
+    }
+    // Builds without animated WebP support fail to read the pixels of such images, which can be told by their pages.
+    thumb->animated = g_str_has_prefix(loader, "VipsForeignLoadWebp") && thumb->pages > 1;
+    int err = 0;
+    if (thumb->max_pixels && (gint64) thumb->width * thumb->height > thumb->max_pixels) {
+        err = ERR_TOO_MANY_PIXELS;
+    } else if (thumb->max_pages && thumb->pages > thumb->max_pages) {
+        err = ERR_TOO_MANY_PAGES;
+    }
+    if (err) {
+        g_object_unref(*in);
+        *in = NULL;
+    }
+    return err;
+}
+
+static void eval(VipsImage *image, VipsProgress *progress, RawThumbnail *thumb) {
+    if (g_get_monotonic_time() > thumb->deadline) {
+        vips_image_set_kill(image, TRUE);
+    }
+}
+
+// The vips error buffer is shared by the whole process, its messages don't say which call they came from (many are
+// added by the threads of the vips pipelines), and anything may clear it. So the calls made here move its messages to a
+// log of their own as they go, and a failed call takes the messages logged since it started, except for those already
+// taken by the calls that failed before it: a call's messages are usually logged right before it fails, so concurrent
+// calls only mix their messages up if they fail at the same time. The log is emptied once no calls are in flight, and
+// keeps only the latest messages while they are.
+#define MAX_ERROR_LOG 65536
+
+static GMutex calls_lock;
+static int calls;
+// error_log starts at the offset error_base of all the messages logged, which were taken up to error_claimed.
+static GString *error_log;
+static guint64 error_base, error_claimed;
+
+// drain moves the messages of the vips error buffer to the log. calls_lock must be held.
+static void drain(void) {
+    if (!error_log) {
+        error_log = g_string_new(NULL);
+    }
+    char *buffer = vips_error_buffer_copy();
+    g_string_append(error_log, buffer);
+    g_free(buffer);
+    if (error_log->len > MAX_ERROR_LOG) {
+        gsize drop = error_log->len - MAX_ERROR_LOG / 2;
+        g_string_erase(error_log, 0, drop);
+        error_base += drop;
+    }
+}
+
+// begin_call registers a call, returning the token needed to take its error messages.
+guint64 begin_call(void) {
+    g_mutex_lock(&calls_lock);
+    drain();
+    calls++;
+    guint64 call = error_base + error_log->len;
+    g_mutex_unlock(&calls_lock);
+    return call;
+}
+
+// call_error returns a copy of the messages logged since the call began and not taken yet, or NULL if there are none.
+char *call_error(guint64 call) {
+    char *error = NULL;
+    g_mutex_lock(&calls_lock);
+    drain();
+    guint64 end = error_base + error_log->len, from = MAX(MAX(call, error_claimed), error_base);
+    if (from < end) {
+        error = g_strndup(error_log->str + (from - error_base), end - from);
+    }
+    error_claimed = MAX(error_claimed, end);
+    g_mutex_unlock(&calls_lock);
+    return error;
+}
+
+void end_call(void) {
+    g_mutex_lock(&calls_lock);
+    if (--calls == 0) {
+        drain();
+        error_base += error_log->len;
+        error_claimed = error_base;
+        g_string_truncate(error_log, 0);
+    }
+    g_mutex_unlock(&calls_lock);
+}
+
+static int fail(RawThumbnail *thumb, int stage) {
+    thumb->stage = stage;
+    g_free(thumb->error);
+    thumb->error = call_error(thumb->call);
+    if (thumb->deadline && g_get_monotonic_time() > thumb->deadline) {
+        return ERR_TIMEOUT;
+    }
+    return -1;
+}
+
+int probe(RawThumbnail *thumb) {
+    VipsImage *in;
+    int err = load(thumb, &in);
+    if (err) {
+        return err == -1 ? fail(thumb, thumb->stage) : err;
+    }
+    g_object_unref(in);
+    return 0;
+}
+
 int thumbnail(RawThumbnail *thumb) {
     VipsImage *in, *out;
-    if (!thumb->input_path) {
+    if (thumb->timeout > 0) {
+        thumb->deadline = g_get_monotonic_time() + thumb->timeout;
+    }
+    if (!thumb->input_path && thumb->bands) {
         VipsImage *tmp;
         if (!(tmp = vips_image_new_from_memory(thumb->input, thumb->input_size, thumb->width, thumb->height,
                                               thumb->bands, VIPS_FORMAT_UCHAR))) {
-            return -1;
+            return fail(thumb, STAGE_LOAD);
         }
         GValue orientation = G_VALUE_INIT;
         g_value_init(&orientation, G_TYPE_INT);
@@ -41,48 +279,51 @@ int thumbnail(RawThumbnail *thumb) {
         int err = vips_copy(tmp, &in, "interpretation", VIPS_INTERPRETATION_RGB, NULL);
         g_object_unref(tmp);
         if (err) {
-            return -1;
+            return fail(thumb, STAGE_LOAD);
         }
 
     } else {
-        if (!(in = vips_image_new_from_file(thumb->input_path, NULL))) {
-            return -1;
+        int err = load(thumb, &in);
+        if (err) {
+            return err == -1 ? fail(thumb, thumb->stage) : err;
         }
-        thumb->width = vips_image_get_width(in);
-        thumb->height = vips_image_get_height(in);
-        if (!vips_image_get_typeof(in, VIPS_META_ORIENTATION) ||
-            vips_image_get_int(in, VIPS_META_ORIENTATION, &thumb->orientation)) {
-            thumb->orientation = 1;
+        // vips_thumbnail_image can't shrink on load, so the whole first page is decoded at full size, whatever the
+        // target size: its uncompressed size is the estimate (an overestimate for images above vips's disc threshold,
+        // which are decoded to a temporary file instead).
+        if (reserveMemoryCallback(thumb->handle, (gint64) VIPS_IMAGE_SIZEOF_IMAGE(in))) {
+            g_object_unref(in);
+            return ERR_MEMORY_BUDGET;
         }
     }
+    if (thumb->deadline) {
+        vips_image_set_progress(in, TRUE);
+        g_signal_connect(in, "eval", G_CALLBACK(eval), thumb);
+    }
 
-    int err = vips_thumbnail_image(in, &out, thumb->target_size, "size", VIPS_SIZE_DOWN, NULL);
+    int err = vips_thumbnail_image(in, &out, thumb->target_size, "size", VIPS_SIZE_DOWN, "height",
+                                   thumb->target_height > 0 ? thumb->target_height : thumb->target_size, "crop",
+                                   thumb->crop ? VIPS_INTERESTING_CENTRE : VIPS_INTERESTING_NONE, NULL);
     g_object_unref(in);
     if (err) {
-        return -1;
+        return fail(thumb, STAGE_PROCESS);
     }
     thumb->thumb_width = vips_image_get_width(out);
     thumb->thumb_height = vips_image_get_height(out);
     if (has_alpha(out, &thumb->has_alpha)) {
         g_object_unref(out);
-        return -1;
+        return fail(thumb, STAGE_PROCESS);
     }
 
-    if (!thumb->output_path) {
-        if (!thumb->has_alpha) {
-            err = vips_jpegsave_buffer(out, (void **) &thumb->output, &thumb->output_size, "Q", thumb->quality, "strip",
-                                       TRUE, "optimize-coding", TRUE, NULL);
-        } else {
-            err = vips_pngsave_buffer(out, (void **) &thumb->output, &thumb->output_size, "Q", thumb->quality, "strip",
-                                      TRUE, "palette", TRUE, NULL);
-        }
-    } else {
-        if (!thumb->has_alpha) {
-            err = vips_jpegsave(out, thumb->output_path, "Q", thumb->quality, "strip", TRUE, "optimize-coding", TRUE,
-                                NULL);
-        } else {
-            err = vips_pngsave(out, thumb->output_path, "Q", thumb->quality, "strip", TRUE, "palette", TRUE, NULL);
+    if (thumb->format == FORMAT_JPEG && thumb->has_alpha) {
+        if (flatten(&out)) {
+            g_object_unref(out);
+            return fail(thumb, STAGE_PROCESS);
         }
+        thumb->has_alpha = FALSE;
+    }
+    encodeCallback(thumb->handle);
+    if (save(out, thumb)) {
+        err = fail(thumb, STAGE_SAVE);
     }
     g_object_unref(out);
     return err;
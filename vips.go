@@ -5,12 +5,13 @@ package thumbnailer
 // #include "vips.h"
 import "C"
 import (
+	"context"
 	"io"
-	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/zRedShift/seekstream"
@@ -54,13 +55,19 @@ func SetVIPSOptions(options VIPSOptions) {
 	}
 }
 
+// SetVIPSConcurrency initializes vips and sets the number of threads each vips pipeline uses, which is 1 by default,
+// since thumbnails are usually created concurrently anyway.
+func SetVIPSConcurrency(n int) {
+	initVIPS()
+	C.vips_concurrency_set(C.int(n))
+}
+
 func initVIPS() {
 	once.Do(func() {
 		name := C.CString(os.Args[0])
 		defer free(unsafe.Pointer(name))
 		if C.vips_init(name) != 0 {
-			vErr := errBuf.lastError()
-			panic("couldn't start vips: " + vErr.Error())
+			panic("couldn't start vips: " + C.GoString(C.vips_error_buffer()))
 		}
 		C.vips_concurrency_set(1)
 	})
@@ -95,123 +102,423 @@ func DropAllVIPSCache() {
 	C.vips_cache_drop_all()
 }
 
-type errorBuf struct {
-	sync.Mutex
-	errSlice []string
-	lastErr  vipsError
-}
-
+// vipsError is an error message of vips, along with the stage of the call that failed (one of the STAGE constants of
+// vips.h), if known, and whether it failed on an animated WebP image.
 type vipsError struct {
 	domain, error string
+	stage         int
+	animated      bool
 }
 
 func (v vipsError) Error() string { return "vips: " + v.domain + ": " + v.error }
 
-func (b *errorBuf) lastError() vipsError {
-	b.Lock()
-	defer b.Unlock()
-	errSlice := strings.Split(C.GoString(C.vips_error_buffer()), "\n")
-	if len(errSlice) > 1 {
-		C.vips_error_clear()
-	}
-	b.errSlice = append(errSlice[:len(errSlice)-1], b.errSlice...)
-	if len(b.errSlice) != 0 {
-		err := strings.SplitN(b.errSlice[0], ": ", 2)
-		b.errSlice = b.errSlice[1:]
-		if len(err) == 2 {
-			b.lastErr.domain = err[0]
-			err = err[1:]
+// callError returns the first error message captured by a failed call (see begin_call), and frees the capture. If vips
+// logged no messages, the error only describes the stage that failed.
+func callError(thumb *C.RawThumbnail) vipsError {
+	vErr := vipsError{domain: "thumbnailer", error: stageErrors[int(thumb.stage)]}
+	if thumb.error != nil {
+		vErr = capturedError(&thumb.error)
+	}
+	vErr.stage, vErr.animated = int(thumb.stage), thumb.animated != 0
+	return vErr
+}
+
+// The stages of a vips call.
+const (
+	stageLoad        = C.STAGE_LOAD
+	stageUnsupported = C.STAGE_UNSUPPORTED
+	stageProcess     = C.STAGE_PROCESS
+	stageSave        = C.STAGE_SAVE
+)
+
+var stageErrors = map[int]string{
+	stageLoad:        "failed to load the image",
+	stageUnsupported: "image format not supported",
+	stageProcess:     "failed to process the image",
+	stageSave:        "failed to save the thumbnail",
+}
+
+// capturedError parses and frees an error message captured with call_error.
+func capturedError(capture **C.char) vipsError {
+	if *capture == nil {
+		return vipsError{domain: "thumbnailer", error: "unknown error"}
+	}
+	msg := C.GoString(*capture)
+	C.g_free(C.gpointer(*capture))
+	*capture = nil
+	msg = strings.TrimSpace(msg)
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	err := strings.SplitN(msg, ": ", 2)
+	if len(err) == 1 {
+		return vipsError{domain: "thumbnailer", error: err[0]}
+	}
+	return vipsError{domain: err[0], error: err[1]}
+}
+
+// vipsIO holds the io.Reader and io.Seeker of a custom vips source, and the io.Writer of a custom vips target, along
+// with the first error any of them returned, and the context, memory reservation and outputStages of the call.
+type vipsIO struct {
+	io.Reader
+	io.Seeker
+	io.Writer
+	ctx           context.Context
+	seekEnd       bool
+	releaseMemory func()
+	stages        *outputStages
+	err           error
+}
+
+type ioMap struct {
+	sync.RWMutex
+	m    map[uintptr]*vipsIO
+	next uintptr
+}
+
+func (m *ioMap) io(handle C.uintptr_t) (*vipsIO, bool) {
+	m.RLock()
+	v, ok := m.m[uintptr(handle)]
+	m.RUnlock()
+	return v, ok
+}
+
+func (m *ioMap) set(v *vipsIO) C.uintptr_t {
+	m.Lock()
+	m.next++
+	handle := m.next
+	m.m[handle] = v
+	m.Unlock()
+	return C.uintptr_t(handle)
+}
+
+func (m *ioMap) delete(handle C.uintptr_t) {
+	m.Lock()
+	delete(m.m, uintptr(handle))
+	m.Unlock()
+}
+
+var vipsIOMap = ioMap{m: make(map[uintptr]*vipsIO)}
+
+// maxEmptyReads is the number of consecutive reads returning neither data nor an error after which a custom vips
+// source fails with io.ErrNoProgress, instead of spinning.
+const maxEmptyReads = 100
+
+//export readSourceCallback
+func readSourceCallback(handle C.uintptr_t, buf unsafe.Pointer, length C.gint64) C.gint64 {
+	v, ok := vipsIOMap.io(handle)
+	if !ok || v.Reader == nil {
+		return -1
+	}
+	p := (*[1 << 30]byte)(buf)[:length:length]
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := v.Read(p)
+		if n > 0 {
+			return C.gint64(n)
+		}
+		switch err {
+		case nil:
+			continue
+		case io.EOF:
+			return 0
+		default:
+			v.err = ioError("vips", err)
+			return -1
+		}
+	}
+	v.err = ioError("vips", io.ErrNoProgress)
+	return -1
+}
+
+//export seekSourceCallback
+func seekSourceCallback(handle C.uintptr_t, offset C.gint64, whence C.int) C.gint64 {
+	v, ok := vipsIOMap.io(handle)
+	if !ok || v.Seeker == nil {
+		return -1
+	}
+	if !v.seekEnd && int(whence) == io.SeekEnd {
+		// Refusing to seek the end of a stream that's still being written (which would block until it's complete) makes
+		// vips treat the source as a pipe, as FFmpeg does with its seekCallback.
+		f, ok := unwrapReader(v.Reader).(*seekstream.File)
+		if !ok || !f.IsDone() {
+			return -1
+		}
+		v.seekEnd = true
+	}
+	n, err := v.Seek(int64(offset), int(whence))
+	if err != nil {
+		v.err = ioError("vips", err)
+		return -1
+	}
+	return C.gint64(n)
+}
+
+//export writeTargetCallback
+func writeTargetCallback(handle C.uintptr_t, buf unsafe.Pointer, length C.gint64) C.gint64 {
+	v, ok := vipsIOMap.io(handle)
+	if !ok || v.Writer == nil {
+		return -1
+	}
+	p := (*[1 << 30]byte)(buf)[:length:length]
+	if v.stages != nil {
+		v.stages.writing()
+	}
+	n, err := v.Write(p)
+	if v.stages != nil {
+		v.stages.written += int64(n)
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		v.err = err
+		return -1
+	}
+	return C.gint64(n)
+}
+
+//export reserveMemoryCallback
+func reserveMemoryCallback(handle C.uintptr_t, size C.gint64) C.int {
+	v, ok := vipsIOMap.io(handle)
+	if !ok {
+		return -1
+	}
+	release, err := budget.reserve(v.ctx, int64(size))
+	if err != nil {
+		v.err = err
+		return -1
+	}
+	v.releaseMemory = release
+	return 0
+}
+
+//export encodeCallback
+func encodeCallback(handle C.uintptr_t) {
+	if v, ok := vipsIOMap.io(handle); ok && v.stages != nil {
+		v.stages.encoding()
+	}
+}
+
+func setLimits(ctx context.Context, file *File, thumb *C.RawThumbnail) {
+	l := file.limits()
+	thumb.max_pixels, thumb.max_pages = C.gint64(l.MaxPixels), C.int(l.MaxPages)
+	if deadline, ok := ctx.Deadline(); ok {
+		if thumb.timeout = C.gint64(time.Until(deadline) / time.Microsecond); thumb.timeout <= 0 {
+			thumb.timeout = 1
 		}
-		b.lastErr.error = err[0]
 	}
-	return b.lastErr
 }
 
-var errBuf = &errorBuf{errSlice: make([]string, 0, 10)}
+// setTarget sets the thumbnail's bounding box, Mode, Quality and Format.
+func setTarget(file *File, thumb *C.RawThumbnail) {
+	thumb.target_size, thumb.target_height = C.int(file.TargetDimensions), C.int(file.TargetHeight)
+	thumb.quality, thumb.format = C.int(file.Quality), C.int(file.Format)
+	if file.Mode == ModeCrop {
+		thumb.crop = 1
+	}
+}
 
-func thumbnailFromFFmpeg(file *File, data *C.uchar) error {
+func thumbnailFromFFmpeg(ctx context.Context, file *File, data *C.uchar) error {
 	thumb := C.RawThumbnail{
 		width:       C.int(file.Width),
 		height:      C.int(file.Height),
-		target_size: C.int(file.TargetDimensions),
 		input:       data,
-		quality:     C.int(file.Quality),
 		bands:       3,
 		orientation: C.int(file.Orientation),
 	}
+	setTarget(file, &thumb)
 	if file.HasAlpha {
 		thumb.bands++
 	}
 	thumb.input_size = C.size_t(thumb.bands * thumb.height * thumb.width)
-	return handleThumbnailOutput(file, &thumb)
+	setLimits(ctx, file, &thumb)
+	return handleThumbnailOutput(ctx, file, &thumb)
 }
 
-func thumbnailFromFile(file *File) (err error) {
-	thumb := C.RawThumbnail{
-		target_size: C.int(file.TargetDimensions),
-		quality:     C.int(file.Quality),
+func thumbnailFromFile(ctx context.Context, file *File) error {
+	var thumb C.RawThumbnail
+	setTarget(file, &thumb)
+	setLimits(ctx, file, &thumb)
+	return withInput(ctx, file, &thumb, handleThumbnailOutput)
+}
+
+// probeFile probes the File. Unlike when thumbnailing, non-seekable inputs aren't spilled, but read through a custom
+// vips source without seeking, so only as much of them as the loader needs for the header is consumed.
+func probeFile(ctx context.Context, file *File) error {
+	if file.Path == "" && file.Seeker == nil && file.Reader != nil {
+		return handleProbe(ctx, file, &C.RawThumbnail{input_source: 1})
 	}
+	return withInput(ctx, file, new(C.RawThumbnail), handleProbe)
+}
+
+// withInput sets the RawThumbnail's input from the File and calls handle with it. Seekable inputs (including
+// seekstream.Files, which are read as the data arrives, and whose end isn't sought before they're complete unless
+// SeekEnd is set) are read through a custom vips source, while the rest are spilled according to the File's
+// SpillPolicy.
+func withInput(ctx context.Context, file *File, thumb *C.RawThumbnail,
+	handle func(context.Context, *File, *C.RawThumbnail) error) (err error) {
 	if file.Path != "" {
 		thumb.input_path = C.CString(file.Path)
-	} else if f, ok := file.Reader.(*seekstream.File); ok {
-		f.Wait()
-		thumb.input_path = C.CString(f.Name())
+	} else if file.Seeker != nil {
+		thumb.input_source = 1
+		return handle(ctx, file, thumb)
 	} else {
-		f, err := ioutil.TempFile(os.TempDir(), "")
-		if err != nil {
-			return err
-		}
-		thumb.input_path = C.CString(f.Name())
-		defer func(filename string) {
-			rErr := os.Remove(filename)
-			if err == nil {
-				err = rErr
-			}
-		}(f.Name())
-		_, err = io.Copy(f, file)
-		if cErr := f.Close(); err != nil || cErr != nil {
-			if err == nil {
-				return cErr
+		s := newSpill(file.spillPolicy())
+		defer func() {
+			if cErr := s.Close(); err == nil {
+				err = cErr
 			}
+		}()
+		report := file.phase(PhaseSpool)
+		_, span := startSpan(ctx, "spool")
+		n, err := io.Copy(s, contextReader{file.Reader, ctx})
+		span.SetAttributes("bytes", n)
+		span.End(err)
+		if report(PhaseEvent{Bytes: n, Err: err}); err != nil {
 			return err
 		}
+		if s.file == nil {
+			// vips takes ownership of the input buffer.
+			thumb.input = (*C.uchar)(C.CBytes(s.buf.Bytes()))
+			thumb.input_size = C.size_t(s.buf.Len())
+			return handle(ctx, file, thumb)
+		}
+		thumb.input_path = C.CString(s.file.Name())
 	}
 	defer free(unsafe.Pointer(thumb.input_path))
-	return handleThumbnailOutput(file, &thumb)
+	return handle(ctx, file, thumb)
 }
 
-func handleThumbnailOutput(file *File, thumb *C.RawThumbnail) error {
+func callVIPS(v *vipsIO, file *File, thumb *C.RawThumbnail, fn func(*C.RawThumbnail) C.int) error {
 	runtime.LockOSThread()
 	defer func() {
 		C.vips_thread_shutdown()
 		runtime.UnlockOSThread()
 	}()
-	if file.Thumbnail.Path != "" {
-		thumb.output_path = C.CString(file.Thumbnail.Path)
-		defer free(unsafe.Pointer(thumb.output_path))
+	defer func() {
+		if v.releaseMemory != nil {
+			v.releaseMemory()
+		}
+	}()
+	if thumb.input_source != 0 {
+		v.Reader, v.Seeker, v.seekEnd = file.Reader, file.Seeker, file.SeekEnd
 	}
+	if thumb.output_path == nil {
+		v.Writer = file.Writer
+	}
+	thumb.handle = vipsIOMap.set(v)
+	defer vipsIOMap.delete(thumb.handle)
 	initVIPS()
-	if C.thumbnail(thumb) != 0 {
-		return errBuf.lastError()
+	thumb.call = C.begin_call()
+	code := fn(thumb)
+	C.end_call()
+	switch code {
+	case 0:
+		return nil
+	case C.ERR_TOO_MANY_PIXELS:
+		pixels := int64(thumb.width) * int64(thumb.height)
+		return &LimitError{Limit: LimitPixels, Value: pixels, Max: int64(thumb.max_pixels)}
+	case C.ERR_TOO_MANY_PAGES:
+		return &LimitError{Limit: LimitPages, Value: int64(thumb.pages), Max: int64(thumb.max_pages)}
+	case C.ERR_TIMEOUT:
+		callError(thumb)
+		return context.DeadlineExceeded
+	case C.ERR_MEMORY_BUDGET:
+		return v.err
 	}
-	file.Thumbnail.Width, file.Thumbnail.Height = int(thumb.thumb_width), int(thumb.thumb_height)
-	if thumb.has_alpha != 0 {
-		file.HasAlpha = true
+	vErr := callError(thumb)
+	if v.err != nil {
+		return v.err
 	}
+	return vErr
+}
+
+func setDimensions(file *File, thumb *C.RawThumbnail) {
 	file.Width, file.Height = int(thumb.width), int(thumb.height)
 	file.Orientation = int(thumb.orientation)
 	if file.Orientation > 4 {
 		file.Width, file.Height = file.Height, file.Width
 	}
+}
+
+func handleProbe(ctx context.Context, file *File, thumb *C.RawThumbnail) error {
+	v := &vipsIO{ctx: ctx}
+	if err := callVIPS(v, file, thumb, func(thumb *C.RawThumbnail) C.int { return C.probe(thumb) }); err != nil {
+		return err
+	}
+	setDimensions(file, thumb)
+	return nil
+}
+
+// outputStages traces the resize, encode and write stages of a call to thumbnail, and reports the PhaseResize and
+// PhaseEncode to the File's Observer. The C code tells the stages apart by calling encodeCallback before saving.
+type outputStages struct {
+	ctx, encodeCtx        context.Context
+	file                  *File
+	thumb                 *C.RawThumbnail
+	start, encodeStart    time.Time
+	resize, encode, write Span
+	written               int64
+}
+
+func startOutputStages(ctx context.Context, file *File, thumb *C.RawThumbnail) *outputStages {
+	s := &outputStages{ctx: ctx, file: file, thumb: thumb, start: time.Now()}
+	_, s.resize = startSpan(ctx, "resize")
+	return s
+}
+
+func (s *outputStages) encoding() {
+	s.encodeStart = time.Now()
+	s.resize.SetAttributes("width", int(s.thumb.width), "height", int(s.thumb.height),
+		"thumbnail.width", int(s.thumb.thumb_width), "thumbnail.height", int(s.thumb.thumb_height))
+	s.resize.End(nil)
+	s.file.reportPhase(PhaseResize, s.start, s.encodeStart.Sub(s.start), PhaseEvent{})
+	s.encodeCtx, s.encode = startSpan(s.ctx, "encode")
+}
+
+func (s *outputStages) writing() {
+	if s.write == nil && s.encode != nil {
+		_, s.write = startSpan(s.encodeCtx, "write")
+	}
+}
+
+// end ends the running stages, failing the last one with the call's error, if any.
+func (s *outputStages) end(err error) {
+	if s.encode == nil {
+		s.resize.End(err)
+		s.file.reportPhase(PhaseResize, s.start, time.Since(s.start), PhaseEvent{Err: err})
+		return
+	}
+	output := s.written
+	if s.write != nil {
+		s.write.SetAttributes("output.bytes", output)
+		s.write.End(err)
+	} else if err == nil && s.thumb.output_path != nil {
+		if fi, sErr := os.Stat(s.file.Thumbnail.Path); sErr == nil {
+			output = fi.Size()
+		}
+	}
+	s.encode.SetAttributes("output.bytes", output)
+	s.encode.End(err)
+	s.file.reportPhase(PhaseEncode, s.encodeStart, time.Since(s.encodeStart), PhaseEvent{Err: err})
+}
+
+func handleThumbnailOutput(ctx context.Context, file *File, thumb *C.RawThumbnail) error {
 	if file.Thumbnail.Path != "" {
-		file.ThumbCreated = true
-		return nil
+		thumb.output_path = C.CString(file.Thumbnail.Path)
+		defer free(unsafe.Pointer(thumb.output_path))
 	}
-	defer C.g_free(C.gpointer(thumb.output))
-	p := (*[1 << 30]byte)(unsafe.Pointer(thumb.output))[:thumb.output_size:thumb.output_size]
-	_, err := file.Write(p)
-	if err == nil {
-		file.ThumbCreated = true
+	stages := startOutputStages(ctx, file, thumb)
+	v := &vipsIO{ctx: ctx, stages: stages}
+	err := callVIPS(v, file, thumb, func(thumb *C.RawThumbnail) C.int { return C.thumbnail(thumb) })
+	stages.end(err)
+	if err != nil {
+		return err
 	}
-	return err
+	file.Thumbnail.Width, file.Thumbnail.Height = int(thumb.thumb_width), int(thumb.thumb_height)
+	// An FFmpeg frame's alpha channel may have been opaque, or flattened for a JPEG.
+	file.HasAlpha = thumb.has_alpha != 0
+	setDimensions(file, thumb)
+	file.ThumbCreated = true
+	return nil
 }
@@ -1,13 +1,50 @@
+#include <stdlib.h>
 #include <vips/vips.h>
 
+#define FORMAT_AUTO 0
+#define FORMAT_JPEG 1
+#define FORMAT_PNG 2
+#define FORMAT_WEBP 3
+
+#define ERR_TOO_MANY_PIXELS -2
+#define ERR_TOO_MANY_PAGES -3
+#define ERR_TIMEOUT -4
+#define ERR_MEMORY_BUDGET -5
+
+#define STAGE_LOAD 1
+#define STAGE_UNSUPPORTED 2
+#define STAGE_PROCESS 3
+#define STAGE_SAVE 4
+
 typedef struct RawThumbnail {
     int width, height;
     int thumb_width, thumb_height;
-    int orientation, target_size, bands, quality;
-    unsigned char *input, *output;
-    size_t input_size, output_size;
-    char *input_path, *output_path;
-    gboolean has_alpha;
+    int orientation, target_size, target_height, bands, quality, format, pages, max_pages, stage;
+    gint64 max_pixels, timeout, deadline;
+    guint64 call;
+    unsigned char *input;
+    size_t input_size;
+    char *input_path, *output_path, *error;
+    uintptr_t handle;
+    gboolean input_source, has_alpha, crop, animated;
 } RawThumbnail;
 
-int thumbnail(RawThumbnail *thumb);
\ No newline at end of file
+guint64 begin_call(void);
+
+char *call_error(guint64 call);
+
+void end_call(void);
+
+int probe(RawThumbnail *thumb);
+
+int thumbnail(RawThumbnail *thumb);
+
+extern gint64 readSourceCallback(uintptr_t handle, void *buf, gint64 length);
+
+extern gint64 seekSourceCallback(uintptr_t handle, gint64 offset, int whence);
+
+extern gint64 writeTargetCallback(uintptr_t handle, void *buf, gint64 length);
+
+extern int reserveMemoryCallback(uintptr_t handle, gint64 size);
+
+extern void encodeCallback(uintptr_t handle);
\ No newline at end of file
@@ -0,0 +1,61 @@
+package thumbnailer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestVIPSErrorsConcurrent(t *testing.T) {
+	tests := []struct {
+		filename string
+		wantErr  error
+	}{
+		{"urandom", ErrFileFormatNotSupported},
+		{"Portrait_6.jpg", nil},
+		{"gif_bg.gif", nil},
+		{"sample.tif", nil},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		test := tests[i%len(tests)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := FileFromPath(filepath.Join("fixtures", test.filename))
+			if err != nil {
+				t.Errorf("FileFromPath() error = %v", err)
+				return
+			}
+			if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 128)); err != test.wantErr {
+				t.Errorf("%s: CreateThumbnail() error = %v, want = %v", test.filename, err, test.wantErr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// stallingReader reads nothing, without ever failing.
+type stallingReader struct{}
+
+func (stallingReader) Read([]byte) (int, error) { return 0, nil }
+
+func TestVIPSSourceNoProgress(t *testing.T) {
+	f, err := os.Open(filepath.Join("fixtures", "Portrait_6.jpg"))
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	file, err := FileFromReadSeeker(f, true)
+	if err != nil {
+		t.Fatalf("FileFromReadSeeker() error = %v", err)
+	}
+	file.Reader = stallingReader{}
+	if err = CreateThumbnail(file.ToWriter(ioutil.Discard, 128)); !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("CreateThumbnail() error = %v, want = %v", err, io.ErrNoProgress)
+	}
+}
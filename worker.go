@@ -0,0 +1,616 @@
+package thumbnailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zRedShift/mimemagic"
+)
+
+const (
+	workerEnv       = "THUMBNAILER_WORKER"
+	workerChunkSize = 1 << 16
+	workerTailSize  = 1 << 12
+)
+
+// WorkerConfig stores the configuration of a WorkerPool. Workers is the number of worker processes (GOMAXPROCS if not
+// positive), and MaxJobs is the number of jobs after which a worker is replaced by a fresh one (never if not positive).
+// MaxMemory (the address space, in bytes) and MaxOpenFiles set the corresponding rlimits of every worker, and
+// MaxCPUTime (rounded up to seconds) limits the CPU time of every job through RLIMIT_CPU, which is raised before each
+// one, on platforms that support them, with zero values meaning no limit. Keep in mind that MaxMemory covers the whole
+// address space of the process, including the Go runtime, so it has to be generous. Path and Args are the executable
+// and arguments of the workers, and default to re-executing the current program (os.Executable) with no arguments.
+type WorkerConfig struct {
+	Workers, MaxJobs, MaxOpenFiles int
+	MaxMemory                      int64
+	MaxCPUTime                     time.Duration
+	Path                           string
+	Args                           []string
+}
+
+// WorkerError is returned when a worker process crashes (or fails to start, or is killed by an rlimit) while creating
+// a thumbnail. Err is the reason reported by os/exec, and Stderr contains the tail of whatever the worker printed.
+type WorkerError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *WorkerError) Error() string {
+	if e.Stderr == "" {
+		return "thumbnailer: worker crashed: " + e.Err.Error()
+	}
+	return "thumbnailer: worker crashed: " + e.Err.Error() + ": " + strings.TrimSpace(e.Stderr)
+}
+
+// Unwrap returns the reason of the crash.
+func (e *WorkerError) Unwrap() error {
+	return e.Err
+}
+
+// RunWorker turns the current process into a worker serving a WorkerPool, if it was started as one, and exits when
+// the parent closes it. Otherwise it returns immediately. Programs using a WorkerPool with the default Path and Args
+// must call it at the very beginning of main (or TestMain), before doing anything else.
+func RunWorker() {
+	limits, ok := os.LookupEnv(workerEnv)
+	if !ok {
+		return
+	}
+	cpu, err := setWorkerLimits(limits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "thumbnailer: worker:", err)
+		os.Exit(2)
+	}
+	if err = serveWorker(os.NewFile(3, "worker input"), os.NewFile(4, "worker output"), cpu); err != nil {
+		fmt.Fprintln(os.Stderr, "thumbnailer: worker:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// WorkerPool creates thumbnails in a pool of child processes, so that a crash in vips or FFmpeg doesn't take down the
+// whole program. The File and its Thumbnail are sent to the worker, with the input and output streamed over pipes
+// (except for Files from FileFromPath, which the worker opens itself, and thumbnails written to a path), and the
+// results are copied back once it's done. As the input isn't seekable on the worker's side, videos that need seeking
+// are spooled according to the File's SpillPolicy. A crashed worker results in a WorkerError and is restarted for the
+// next job, and so is a worker whose job's context is done.
+type WorkerPool struct {
+	config  WorkerConfig
+	workers chan *worker
+	mu      sync.RWMutex
+	closed  bool
+}
+
+// NewWorkerPool returns a WorkerPool with the supplied WorkerConfig. Workers are started lazily.
+func NewWorkerPool(config WorkerConfig) (*WorkerPool, error) {
+	if config.Workers <= 0 {
+		config.Workers = runtime.GOMAXPROCS(0)
+	}
+	if config.Path == "" {
+		path, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		config.Path = path
+	}
+	p := &WorkerPool{config: config, workers: make(chan *worker, config.Workers)}
+	for i := 0; i < config.Workers; i++ {
+		p.workers <- nil
+	}
+	return p, nil
+}
+
+// Thumbnail creates the supplied File's thumbnail in a worker, waiting for a free one if all are busy, and returns the
+// result of CreateThumbnailWithContext, or a WorkerError if the worker crashed.
+func (p *WorkerPool) Thumbnail(ctx context.Context, file *File) (err error) {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrClosed
+	}
+	var w *worker
+	select {
+	case w = <-p.workers:
+		p.mu.RUnlock()
+	case <-ctx.Done():
+		p.mu.RUnlock()
+		return ctx.Err()
+	}
+	defer func() {
+		if w != nil && (w.dead() || p.config.MaxJobs > 0 && w.jobs >= p.config.MaxJobs) {
+			w.stop()
+			w = nil
+		}
+		p.workers <- w
+	}()
+	if w == nil {
+		if w, err = startWorker(p.config); err != nil {
+			return err
+		}
+	}
+	return w.run(ctx, file)
+}
+
+// Close stops accepting new jobs, waits for the in-flight ones to finish and stops all the workers.
+func (p *WorkerPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	for i := 0; i < p.config.Workers; i++ {
+		if w := <-p.workers; w != nil {
+			w.stop()
+		}
+	}
+	return nil
+}
+
+// workerFile is the part of a File (and its Thumbnail) sent to a worker, and back with the results.
+type workerFile struct {
+	MediaType                      mimemagic.MediaType
+	Dimensions, ThumbDimensions    Dimensions
+	Spool                          SpillPolicy
+	Limits                         *Limits
+	Format                         Format
+	Mode                           Mode
+	Orientation, Quality           int
+	TargetDimensions, TargetHeight int
+	FrameTime                      time.Duration
+	Size                           int64
+	Duration                       time.Duration
+	Title, Artist, Path, ThumbPath string
+	HasVideo, HasAudio, HasAlpha   bool
+	ThumbCreated, Streamed         bool
+}
+
+func newWorkerFile(file *File) *workerFile {
+	limits := file.limits()
+	return &workerFile{
+		MediaType:        file.MediaType,
+		Dimensions:       file.Dimensions,
+		ThumbDimensions:  file.Thumbnail.Dimensions,
+		Spool:            file.spillPolicy(),
+		Limits:           &limits,
+		Format:           file.Format,
+		Mode:             file.Mode,
+		Orientation:      file.Orientation,
+		Quality:          file.Quality,
+		TargetDimensions: file.TargetDimensions,
+		TargetHeight:     file.TargetHeight,
+		FrameTime:        file.FrameTime,
+		Size:             file.Size,
+		Duration:         file.Duration,
+		Title:            file.Title,
+		Artist:           file.Artist,
+		Path:             file.Path,
+		ThumbPath:        file.Thumbnail.Path,
+		HasVideo:         file.HasVideo,
+		HasAudio:         file.HasAudio,
+		HasAlpha:         file.HasAlpha,
+		ThumbCreated:     file.ThumbCreated,
+	}
+}
+
+func (wf *workerFile) file() *File {
+	spool := wf.Spool
+	file := &File{
+		MediaType: wf.MediaType,
+		Spool:     &spool,
+		Limits:    wf.Limits,
+		Size:      wf.Size,
+		Path:      wf.Path,
+	}
+	file.Format, file.Quality, file.TargetDimensions = wf.Format, wf.Quality, wf.TargetDimensions
+	file.Mode, file.TargetHeight, file.FrameTime = wf.Mode, wf.TargetHeight, wf.FrameTime
+	file.Thumbnail.Path = wf.ThumbPath
+	return file
+}
+
+// apply copies the results back to the File.
+func (wf *workerFile) apply(file *File) {
+	file.Dimensions, file.Thumbnail.Dimensions = wf.Dimensions, wf.ThumbDimensions
+	file.Orientation, file.Duration = wf.Orientation, wf.Duration
+	file.Title, file.Artist = wf.Title, wf.Artist
+	file.HasVideo, file.HasAudio = wf.HasVideo, wf.HasAudio
+	file.HasAlpha, file.ThumbCreated = wf.HasAlpha, wf.ThumbCreated
+	file.Media = wf.MediaType.Media
+}
+
+// workerMessage is sent to a worker: first the File, then its input in chunks (if Streamed) ending with EOF, along
+// with the error that ended the input, if any.
+type workerMessage struct {
+	File *workerFile
+	Data []byte
+	EOF  bool
+	Err  string
+}
+
+// workerResult is sent back by a worker: first the thumbnail in chunks (if not written to a path), then the results.
+type workerResult struct {
+	Data []byte
+	Done bool
+	File *workerFile
+	Err  *workerErr
+}
+
+// workerErrors are the sentinel errors which keep their identity when returned from a worker.
+var workerErrors = []error{
+	ErrInvalidData,
+	ErrFileFormatNotSupported,
+	ErrAnimatedWEBPNotSupported,
+	ErrMemoryBudgetExceeded,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
+
+// workerErr is the gob-encodable form of an error returned by CreateThumbnail in a worker.
+type workerErr struct {
+	Sentinel int
+	Thumb    *ThumbError
+	Limit    *LimitError
+	Spill    *SpillLimitError
+	Message  string
+}
+
+func newWorkerErr(err error) *workerErr {
+	if err == nil {
+		return nil
+	}
+	for i, sentinel := range workerErrors {
+		if err == sentinel {
+			return &workerErr{Sentinel: i + 1}
+		}
+	}
+	switch tErr := err.(type) {
+	case *ThumbError:
+		thumbErr := *tErr
+		thumbErr.Wrapped = nil
+		return &workerErr{Thumb: &thumbErr}
+	case *LimitError:
+		return &workerErr{Limit: tErr}
+	case *SpillLimitError:
+		return &workerErr{Spill: tErr}
+	}
+	return &workerErr{Message: err.Error()}
+}
+
+func (e *workerErr) err() error {
+	switch {
+	case e == nil:
+		return nil
+	case e.Sentinel > 0 && e.Sentinel <= len(workerErrors):
+		return workerErrors[e.Sentinel-1]
+	case e.Thumb != nil:
+		return e.Thumb
+	case e.Limit != nil:
+		return e.Limit
+	case e.Spill != nil:
+		return e.Spill
+	}
+	return errors.New(e.Message)
+}
+
+// tailBuffer keeps the last workerTailSize bytes written to it.
+type tailBuffer struct {
+	sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > workerTailSize {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-workerTailSize:]...)
+	}
+	b.Unlock()
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return string(b.buf)
+}
+
+type worker struct {
+	cmd    *exec.Cmd
+	input  io.WriteCloser
+	output io.ReadCloser
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	stderr tailBuffer
+	jobs   int
+	mu     sync.Mutex
+	killed bool
+	done   chan struct{}
+	err    error
+}
+
+func startWorker(config WorkerConfig) (*worker, error) {
+	inputR, inputW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outputR, outputW, err := os.Pipe()
+	if err != nil {
+		inputR.Close()
+		inputW.Close()
+		return nil, err
+	}
+	w := &worker{input: inputW, output: outputR, done: make(chan struct{})}
+	w.cmd = exec.Command(config.Path, config.Args...)
+	w.cmd.Env = append(os.Environ(), workerEnv+"="+workerLimits(config))
+	w.cmd.Stdout, w.cmd.Stderr = &w.stderr, &w.stderr
+	w.cmd.ExtraFiles = []*os.File{inputR, outputW}
+	err = w.cmd.Start()
+	inputR.Close()
+	outputW.Close()
+	if err != nil {
+		inputW.Close()
+		outputR.Close()
+		return nil, err
+	}
+	w.enc, w.dec = gob.NewEncoder(inputW), gob.NewDecoder(bufio.NewReader(outputR))
+	go func() {
+		w.err = w.cmd.Wait()
+		close(w.done)
+	}()
+	return w, nil
+}
+
+func (w *worker) kill() {
+	w.mu.Lock()
+	if !w.killed {
+		w.killed = true
+		w.cmd.Process.Kill()
+	}
+	w.mu.Unlock()
+}
+
+func (w *worker) dead() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.killed
+}
+
+// stop closes the worker's input, which makes it exit, and kills it if it doesn't do so in time.
+func (w *worker) stop() {
+	w.input.Close()
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		w.kill()
+		<-w.done
+	}
+	w.output.Close()
+}
+
+// crash returns the error describing why the worker died.
+func (w *worker) crash(err error) error {
+	w.kill()
+	<-w.done
+	if w.err != nil {
+		err = w.err
+	}
+	return &WorkerError{Err: err, Stderr: w.stderr.String()}
+}
+
+func (w *worker) send(wf *workerFile, r io.Reader) error {
+	if err := w.enc.Encode(&workerMessage{File: wf}); err != nil || !wf.Streamed {
+		return err
+	}
+	buf := make([]byte, workerChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if eErr := w.enc.Encode(&workerMessage{Data: buf[:n]}); eErr != nil {
+				return eErr
+			}
+		}
+		if err == io.EOF {
+			return w.enc.Encode(&workerMessage{EOF: true})
+		}
+		if err != nil {
+			w.enc.Encode(&workerMessage{EOF: true, Err: err.Error()})
+			return err
+		}
+	}
+}
+
+func (w *worker) run(ctx context.Context, file *File) (err error) {
+	w.jobs++
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.kill()
+		case <-stop:
+		}
+	}()
+	closeInput := func() error { return nil }
+	if file.Path == "" {
+		if closeInput, err = openInput(file); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if cErr := closeInput(); err == nil {
+			err = cErr
+		}
+	}()
+	wf := newWorkerFile(file)
+	wf.Streamed = file.Path == ""
+	sent := make(chan error, 1)
+	go func() {
+		sent <- w.send(wf, file.Reader)
+	}()
+	var writeErr error
+	for {
+		var res workerResult
+		if err = w.dec.Decode(&res); err != nil {
+			switch ctxErr := ctx.Err(); {
+			case ctxErr != nil:
+				w.kill()
+				err = ctxErr
+			case writeErr != nil:
+				err = writeErr
+			default:
+				err = w.crash(err)
+			}
+			// The worker is dead, so stop sending it the input, which mustn't be read after returning.
+			w.input.Close()
+			<-sent
+			return err
+		}
+		if len(res.Data) > 0 && writeErr == nil {
+			if _, writeErr = file.Writer.Write(res.Data); writeErr != nil {
+				w.kill()
+			}
+		}
+		if res.Done {
+			if res.File != nil {
+				res.File.apply(file)
+			}
+			if sErr := <-sent; sErr != nil {
+				return sErr
+			}
+			return res.Err.err()
+		}
+	}
+}
+
+// workerInput reads the input streamed to a worker.
+type workerInput struct {
+	dec  *gob.Decoder
+	buf  []byte
+	eof  bool
+	err  error
+	dErr error
+}
+
+func (r *workerInput) next() {
+	var msg workerMessage
+	if r.dErr = r.dec.Decode(&msg); r.dErr != nil {
+		r.eof, r.err = true, r.dErr
+		return
+	}
+	r.buf = msg.Data
+	if msg.EOF {
+		r.eof = true
+		if msg.Err != "" {
+			r.err = errors.New(msg.Err)
+		}
+	}
+}
+
+func (r *workerInput) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		}
+		r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// drain discards the rest of the input, so that the next message is a File.
+func (r *workerInput) drain() error {
+	for !r.eof {
+		r.next()
+	}
+	return r.dErr
+}
+
+type workerOutput struct {
+	enc *gob.Encoder
+}
+
+func (w workerOutput) Write(p []byte) (int, error) {
+	if err := w.enc.Encode(&workerResult{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serveWorker creates the thumbnails of the Files sent to the worker, allowing each job the supplied CPU time in
+// seconds (unlimited if 0).
+func serveWorker(r io.Reader, w io.Writer, cpu uint64) error {
+	dec, enc := gob.NewDecoder(bufio.NewReader(r)), gob.NewEncoder(w)
+	for {
+		var msg workerMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.File == nil {
+			return errors.New("thumbnailer: unexpected worker message")
+		}
+		file := msg.File.file()
+		var input *workerInput
+		if msg.File.Streamed {
+			input = &workerInput{dec: dec}
+			file.Reader = input
+		}
+		if file.Thumbnail.Path == "" {
+			file.Writer = workerOutput{enc}
+		}
+		if err := limitJobCPU(cpu); err != nil {
+			return err
+		}
+		err := CreateThumbnail(file)
+		if input != nil {
+			if dErr := input.drain(); dErr != nil {
+				return dErr
+			}
+		}
+		if err = enc.Encode(&workerResult{Done: true, File: newWorkerFile(file), Err: newWorkerErr(err)}); err != nil {
+			return err
+		}
+	}
+}
+
+// workerLimits encodes the rlimits of the WorkerConfig for the workerEnv variable.
+func workerLimits(config WorkerConfig) string {
+	cpu := int64((config.MaxCPUTime + time.Second - 1) / time.Second)
+	return strconv.FormatInt(config.MaxMemory, 10) + "," + strconv.FormatInt(cpu, 10) + "," +
+		strconv.Itoa(config.MaxOpenFiles)
+}
+
+func parseWorkerLimits(limits string) (memory, cpu, files uint64, err error) {
+	fields := strings.Split(limits, ",")
+	if len(fields) != 3 {
+		return 0, 0, 0, errors.New("thumbnailer: invalid worker limits: " + limits)
+	}
+	values := make([]uint64, 3)
+	for i, field := range fields {
+		if values[i], err = strconv.ParseUint(field, 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return values[0], values[1], values[2], nil
+}
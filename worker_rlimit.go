@@ -0,0 +1,55 @@
+// +build linux darwin freebsd
+
+package thumbnailer
+
+import "syscall"
+
+// setWorkerLimits applies the rlimits passed by the WorkerPool to the current process, except for the CPU time, which
+// is limited per job by limitJobCPU, and returned.
+func setWorkerLimits(limits string) (uint64, error) {
+	memory, cpu, files, err := parseWorkerLimits(limits)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range []struct {
+		resource int
+		value    uint64
+	}{{syscall.RLIMIT_AS, memory}, {syscall.RLIMIT_NOFILE, files}} {
+		if l.value == 0 {
+			continue
+		}
+		var rlimit syscall.Rlimit
+		if err = syscall.Getrlimit(l.resource, &rlimit); err != nil {
+			return 0, err
+		}
+		if l.value < rlimit.Max {
+			rlimit.Max = l.value
+		}
+		rlimit.Cur = rlimit.Max
+		if err = syscall.Setrlimit(l.resource, &rlimit); err != nil {
+			return 0, err
+		}
+	}
+	return cpu, nil
+}
+
+// limitJobCPU allows the next job the supplied CPU time in seconds (none if 0), on top of what the process used so
+// far, by moving the soft RLIMIT_CPU, as the rlimit covers the whole life of the process.
+func limitJobCPU(cpu uint64) error {
+	if cpu == 0 {
+		return nil
+	}
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return err
+	}
+	used := usage.Utime.Nano() + usage.Stime.Nano()
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CPU, &rlimit); err != nil {
+		return err
+	}
+	if rlimit.Cur = uint64((used+1e9-1)/1e9) + cpu; rlimit.Cur > rlimit.Max {
+		rlimit.Cur = rlimit.Max
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_CPU, &rlimit)
+}
@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd
+
+package thumbnailer
+
+// setWorkerLimits only validates the rlimits passed by the WorkerPool, as they aren't supported on this platform.
+func setWorkerLimits(limits string) (uint64, error) {
+	_, cpu, _, err := parseWorkerLimits(limits)
+	return cpu, err
+}
+
+// limitJobCPU does nothing, as rlimits aren't supported on this platform.
+func limitJobCPU(uint64) error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	RunWorker()
+	os.Exit(m.Run())
+}
+
+func TestWorkerPool(t *testing.T) {
+	p, err := NewWorkerPool(WorkerConfig{Workers: 1, MaxJobs: 2, MaxOpenFiles: 256})
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error = %v", err)
+	}
+	defer p.Close()
+	tests := []struct {
+		filename   string
+		fromReader bool
+		wantDims   Dimensions
+	}{
+		{"trollface.png", false, Dimensions{5000, 4068}},
+		{"Portrait_6.jpg", true, Dimensions{1200, 1800}},
+		{"schizo_0.mp4", false, Dimensions{480, 360}},
+		{"schizo_90.mp4", true, Dimensions{360, 480}},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			path := filepath.Join("fixtures", test.filename)
+			var file *File
+			if test.fromReader {
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatalf("os.Open() error = %v", err)
+				}
+				defer f.Close()
+				file, err = FileFromReader(f, test.filename)
+			} else {
+				file, err = FileFromPath(path)
+			}
+			if err != nil {
+				t.Fatalf("File error = %v", err)
+			}
+			var buf bytes.Buffer
+			if err = p.Thumbnail(context.Background(), file.ToWriter(&buf, 256)); err != nil {
+				t.Fatalf("Thumbnail() error = %v", err)
+			}
+			if !file.ThumbCreated || buf.Len() == 0 {
+				t.Errorf("ThumbCreated want = %v, got = %v, with %v bytes", true, file.ThumbCreated, buf.Len())
+			}
+			if file.Dimensions != test.wantDims {
+				t.Errorf("Dimensions want = %v, got = %v", test.wantDims, file.Dimensions)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolErrors(t *testing.T) {
+	p, err := NewWorkerPool(WorkerConfig{Workers: 1})
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error = %v", err)
+	}
+	file, err := FileFromPath(filepath.Join("fixtures", "urandom"))
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	if err = p.Thumbnail(context.Background(), file.ToWriter(new(bytes.Buffer), 256)); err != ErrFileFormatNotSupported {
+		t.Errorf("Thumbnail() error = %v, want = %v", err, ErrFileFormatNotSupported)
+	}
+	if err = p.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if err = p.Thumbnail(context.Background(), file); err != ErrClosed {
+		t.Errorf("Thumbnail() error = %v, want = %v", err, ErrClosed)
+	}
+	p, err = NewWorkerPool(WorkerConfig{Workers: 1, MaxMemory: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error = %v", err)
+	}
+	defer p.Close()
+	file, err = FileFromPath(filepath.Join("fixtures", "trollface.png"))
+	if err != nil {
+		t.Fatalf("FileFromPath() error = %v", err)
+	}
+	var wErr *WorkerError
+	if err = p.Thumbnail(context.Background(), file.ToWriter(new(bytes.Buffer), 256)); !errors.As(err, &wErr) {
+		t.Errorf("Thumbnail() error = %v, want = *WorkerError", err)
+	}
+}
+
+func TestWorkerPoolCPUTime(t *testing.T) {
+	p, err := NewWorkerPool(WorkerConfig{Workers: 1, MaxCPUTime: time.Second})
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error = %v", err)
+	}
+	defer p.Close()
+	// Every job stays well under the limit, but together they take longer than it.
+	for i := 0; i < 12; i++ {
+		file, err := FileFromPath(filepath.Join("fixtures", "trollface.png"))
+		if err != nil {
+			t.Fatalf("FileFromPath() error = %v", err)
+		}
+		if err = p.Thumbnail(context.Background(), file.ToWriter(new(bytes.Buffer), 256)); err != nil {
+			t.Fatalf("Thumbnail() #%d error = %v", i, err)
+		}
+	}
+}
+
+// cancellingReader cancels its context on the first Read after armed is set, and counts the reads made after
+// returned is set.
+type cancellingReader struct {
+	r                     io.Reader
+	cancel                context.CancelFunc
+	armed, returned, late int32
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.returned) != 0 {
+		atomic.AddInt32(&r.late, 1)
+	}
+	if atomic.LoadInt32(&r.armed) != 0 {
+		r.cancel()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(p) > 1<<10 {
+		p = p[:1<<10]
+	}
+	return r.r.Read(p)
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	p, err := NewWorkerPool(WorkerConfig{Workers: 1})
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error = %v", err)
+	}
+	defer p.Close()
+	data, err := os.ReadFile(filepath.Join("fixtures", "trollface.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancellingReader{r: bytes.NewReader(data), cancel: cancel}
+	file, err := FileFromReader(r, "trollface.png")
+	if err != nil {
+		t.Fatalf("FileFromReader() error = %v", err)
+	}
+	atomic.StoreInt32(&r.armed, 1)
+	if err = p.Thumbnail(ctx, file.ToWriter(new(bytes.Buffer), 256)); err != context.Canceled {
+		t.Errorf("Thumbnail() error = %v, want = %v", err, context.Canceled)
+	}
+	atomic.StoreInt32(&r.returned, 1)
+	time.Sleep(100 * time.Millisecond)
+	if late := atomic.LoadInt32(&r.late); late != 0 {
+		t.Errorf("Reader read %d times after Thumbnail() returned", late)
+	}
+}